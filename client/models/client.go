@@ -4,12 +4,17 @@ package models
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
 )
 
 type KVClient struct {
-	conn net.Conn
+	conn   net.Conn
+	reader *bufio.Reader // kept across calls, so bytes read ahead aren't lost
+	info   *ServerInfo   // reported by the server in reply to Hello
 }
 
 func NewKVClient(address string) (*KVClient, error) {
@@ -17,7 +22,18 @@ func NewKVClient(address string) (*KVClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &KVClient{conn: conn}, nil
+	return &KVClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// NewKVClientTLS connects to a node serving TLS. config holds the CAs the
+// node is verified with and, for nodes that check them, the client
+// certificate.
+func NewKVClientTLS(address string, config *tls.Config) (*KVClient, error) {
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	return &KVClient{conn: conn, reader: bufio.NewReader(conn)}, nil
 }
 
 func (c *KVClient) sendCommand(command string) (string, error) {
@@ -26,10 +42,13 @@ func (c *KVClient) sendCommand(command string) (string, error) {
 		return "", err
 	}
 
-	response, err := bufio.NewReader(c.conn).ReadString('\n')
+	response, err := c.reader.ReadString('\n')
 	if err != nil {
 		return "", err
 	}
+	if err := ReplyError(response); err != nil {
+		return "", err
+	}
 
 	return response, nil
 }
@@ -70,6 +89,32 @@ func (c *KVClient) Delete(collectionName, key string) (string, error) {
 	return c.sendCommand(fmt.Sprintf("DELETE %s %s", collectionName, key))
 }
 
+// MGet returns the values of the keys in order, nil for the missing ones.
+func (c *KVClient) MGet(collectionName string, keys ...string) ([]*string, error) {
+	res, err := c.sendCommand(fmt.Sprintf("MGET %s %s", collectionName, strings.Join(keys, " ")))
+	if err != nil {
+		return nil, err
+	}
+	var values []*string
+	if err := json.Unmarshal([]byte(res), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// MSet writes all the pairs atomically. Values can't hold spaces.
+func (c *KVClient) MSet(collectionName string, pairs map[string]string) (string, error) {
+	parts := make([]string, 0, 2*len(pairs))
+	for key, value := range pairs {
+		parts = append(parts, key, value)
+	}
+	return c.sendCommand(fmt.Sprintf("MSET %s %s", collectionName, strings.Join(parts, " ")))
+}
+
+func (c *KVClient) MDel(collectionName string, keys ...string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("MDEL %s %s", collectionName, strings.Join(keys, " ")))
+}
+
 func (c *KVClient) SetTTL(collectionName, key, ttl string) (string, error) {
 	return c.sendCommand(fmt.Sprintf("SET-TTL %s %s %s", collectionName, key, ttl))
 }
@@ -92,7 +137,7 @@ func (c *KVClient) Subscribe(topic string) (<-chan string, error) {
 	go func() {
 		for {
 			// Assuming the server sends messages terminated by newline
-			response, err := bufio.NewReader(c.conn).ReadString('\n')
+			response, err := c.reader.ReadString('\n')
 			if err != nil {
 				close(messages)
 				return
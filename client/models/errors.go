@@ -0,0 +1,79 @@
+// errors.go
+
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+// Error replies of the server look like "ERROR <code> <message>". The client
+// returns them as a *ServerError, which matches the error of its code with
+// errors.Is:
+//
+//	if _, err := client.Get("users", "alice"); errors.Is(err, models.ErrNotFound) {
+//		...
+//	}
+var (
+	ErrGeneric        = errors.New("server error")
+	ErrSyntax         = errors.New("syntax error")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrNotFound       = errors.New("not found")
+	ErrWrongType      = errors.New("wrong type")
+	ErrNoAuth         = errors.New("authentication required")
+	ErrReadOnly       = errors.New("node is read-only")
+	ErrMoved          = errors.New("key moved")
+	ErrTimeout        = errors.New("timed out")
+	ErrLocked         = errors.New("key is locked")
+	ErrDeadlock       = errors.New("deadlock detected")
+	ErrNoProto        = errors.New("unsupported protocol version")
+	ErrTooLarge       = errors.New("request too large")
+	ErrNoScript       = errors.New("script not loaded")
+)
+
+var errorCodes = map[string]error{
+	"ERR":       ErrGeneric,
+	"SYNTAX":    ErrSyntax,
+	"UNKNOWN":   ErrUnknownCommand,
+	"NOTFOUND":  ErrNotFound,
+	"WRONGTYPE": ErrWrongType,
+	"NOAUTH":    ErrNoAuth,
+	"READONLY":  ErrReadOnly,
+	"MOVED":     ErrMoved,
+	"TIMEOUT":   ErrTimeout,
+	"LOCKED":    ErrLocked,
+	"DEADLOCK":  ErrDeadlock,
+	"NOPROTO":   ErrNoProto,
+	"TOOLARGE":  ErrTooLarge,
+	"NOSCRIPT":  ErrNoScript,
+}
+
+// ServerError is an error reply of the server.
+type ServerError struct {
+	Code    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Code + " " + e.Message
+}
+
+// Unwrap returns the error of the code, or ErrGeneric for codes the client
+// doesn't know.
+func (e *ServerError) Unwrap() error {
+	if err, ok := errorCodes[e.Code]; ok {
+		return err
+	}
+	return ErrGeneric
+}
+
+// ReplyError returns the error carried by a reply, or nil if the reply is not
+// an error. It is meant for the replies of a Pipeline.
+func ReplyError(reply string) error {
+	rest, ok := strings.CutPrefix(strings.TrimRight(reply, "\r\n"), "ERROR ")
+	if !ok {
+		return nil
+	}
+	code, message, _ := strings.Cut(rest, " ")
+	return &ServerError{Code: code, Message: message}
+}
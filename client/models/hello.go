@@ -0,0 +1,77 @@
+// hello.go
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PROTOCOL_VERSION is the version of the text protocol the client speaks.
+const PROTOCOL_VERSION = 1
+
+// ServerInfo is what the server reports about itself in reply to HELLO.
+type ServerInfo struct {
+	Server     string   `json:"server"`
+	Version    string   `json:"version"`
+	Proto      int      `json:"proto"`
+	ID         string   `json:"id"`
+	Role       string   `json:"role"`
+	Auth       string   `json:"auth"`
+	Codecs     []string `json:"codecs"`
+	Features   []string `json:"features"`
+	ClientName string   `json:"client_name"`
+}
+
+// HasFeature reports whether the server offers the feature.
+func (s *ServerInfo) HasFeature(feature string) bool {
+	for _, f := range s.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// HelloOptions are the optional parts of HELLO.
+type HelloOptions struct {
+	Username string // authenticates the connection when set
+	Password string
+	Name     string // names the connection on the server
+}
+
+// Hello opens the conversation with the server: it checks that the server
+// speaks the client's protocol version, authenticates and names the
+// connection. A server that speaks another version makes it fail with
+// ErrNoProto, so a client fails fast instead of misreading replies during a
+// rolling upgrade.
+func (c *KVClient) Hello(opts HelloOptions) (*ServerInfo, error) {
+	parts := []string{"HELLO", fmt.Sprint(PROTOCOL_VERSION)}
+	if opts.Username != "" {
+		parts = append(parts, "AUTH", opts.Username, opts.Password)
+	}
+	if opts.Name != "" {
+		parts = append(parts, "SETNAME", opts.Name)
+	}
+
+	res, err := c.sendCommand(strings.Join(parts, " "))
+	if err != nil {
+		return nil, err
+	}
+	var info ServerInfo
+	if err := json.Unmarshal([]byte(res), &info); err != nil {
+		return nil, fmt.Errorf("unexpected HELLO reply %q: %w", strings.TrimSpace(res), err)
+	}
+	if info.Proto != PROTOCOL_VERSION {
+		return nil, &ServerError{Code: "NOPROTO", Message: fmt.Sprintf("server speaks protocol %d, client speaks %d", info.Proto, PROTOCOL_VERSION)}
+	}
+	c.info = &info
+	return &info, nil
+}
+
+// ServerInfo returns what the server reported in reply to Hello, or nil if
+// Hello wasn't called.
+func (c *KVClient) ServerInfo() *ServerInfo {
+	return c.info
+}
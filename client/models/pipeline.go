@@ -0,0 +1,68 @@
+// pipeline.go
+
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pipeline queues commands and sends them in a single write, then reads one
+// reply per command. It saves a round trip per command.
+type Pipeline struct {
+	client   *KVClient
+	commands []string
+}
+
+func (c *KVClient) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+// Queue adds a raw command to the pipeline.
+func (p *Pipeline) Queue(command string) *Pipeline {
+	p.commands = append(p.commands, command)
+	return p
+}
+
+func (p *Pipeline) Set(collectionName, key, value string) *Pipeline {
+	return p.Queue(fmt.Sprintf("SET %s %s %s", collectionName, key, value))
+}
+
+func (p *Pipeline) Get(collectionName, key string) *Pipeline {
+	return p.Queue(fmt.Sprintf("GET %s %s", collectionName, key))
+}
+
+func (p *Pipeline) Delete(collectionName, key string) *Pipeline {
+	return p.Queue(fmt.Sprintf("DELETE %s %s", collectionName, key))
+}
+
+// Len returns the number of queued commands.
+func (p *Pipeline) Len() int {
+	return len(p.commands)
+}
+
+// Exec sends the queued commands and returns their replies in order. The
+// pipeline is empty afterwards. On a read error the replies read so far are
+// returned with it. Error replies are returned as they are, ReplyError turns
+// them into errors.
+func (p *Pipeline) Exec() ([]string, error) {
+	commands := p.commands
+	p.commands = nil
+	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	if _, err := p.client.conn.Write([]byte(strings.Join(commands, "\n") + "\n")); err != nil {
+		return nil, err
+	}
+
+	replies := make([]string, 0, len(commands))
+	for range commands {
+		reply, err := p.client.reader.ReadString('\n')
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
@@ -0,0 +1,92 @@
+package models_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sk25469/kv-client/models"
+)
+
+// pipelineServer reads batch commands before replying to any of them, which
+// only works when the client sends them without waiting for the replies.
+// Each reply echoes its command.
+func pipelineServer(t *testing.T, batch int) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		for {
+			commands := make([]string, 0, batch)
+			for len(commands) < batch {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				commands = append(commands, line)
+			}
+			for _, command := range commands {
+				if command == "GET users missing\n" {
+					command = "ERROR NOTFOUND key not found\n"
+				}
+				conn.Write([]byte(command))
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestPipelineSendsCommandsTogether(t *testing.T) {
+	client, err := models.NewKVClient(pipelineServer(t, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	pipeline := client.Pipeline().
+		Set("users", "alice", "admin").
+		Get("users", "alice").
+		Get("users", "missing").
+		Delete("users", "alice")
+	if pipeline.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4", pipeline.Len())
+	}
+	replies, err := pipeline.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"SET users alice admin\n",
+		"GET users alice\n",
+		"ERROR NOTFOUND key not found\n",
+		"DELETE users alice\n",
+	}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("replies %q, want %q", replies, want)
+	}
+	if err := models.ReplyError(replies[2]); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ReplyError(%q) = %v, want ErrNotFound", replies[2], err)
+	}
+	if pipeline.Len() != 0 {
+		t.Errorf("Len() = %d after Exec, want 0", pipeline.Len())
+	}
+
+	// the pipeline can be reused, and the connection stays in step
+	replies, err = pipeline.Queue("PING").Queue("PING").Queue("PING").Queue("PING").Exec()
+	if err != nil || len(replies) != 4 || replies[3] != "PING\n" {
+		t.Errorf("second Exec = %q, %v", replies, err)
+	}
+}
@@ -0,0 +1,206 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sk25469/kv/logger"
+)
+
+var log = logger.NewPackageLogger("certs")
+
+const (
+	// RELOAD_DELAY lets the writes of a certificate rotation settle, so the
+	// new certificate isn't loaded with the old key.
+	RELOAD_DELAY = 200 * time.Millisecond
+)
+
+type StoreParams struct {
+	CertFile string // PEM certificate chain of the node
+	KeyFile  string // PEM private key of the certificate
+	CAFile   string // PEM bundle of the CAs peers are verified with, see ServerConfig and ClientConfig when empty
+}
+
+// Store holds the certificate of the node and the CAs it trusts. The files
+// are watched and loaded again when they change; connections opened after
+// that use the new ones. A reload that fails keeps the previous certificate.
+type Store struct {
+	params  StoreParams
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func NewStore(params StoreParams) (*Store, error) {
+	if params.CertFile == "" || params.KeyFile == "" {
+		return nil, errors.New("certificate and key files are required")
+	}
+	s := &Store{params: params, done: make(chan struct{})}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch the certificates: %v", err)
+	}
+	// the directories are watched rather than the files, rotations that
+	// replace a file by renaming another over it would end a file watch
+	dirs := map[string]bool{}
+	for _, file := range s.files() {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %v", dir, err)
+		}
+	}
+	s.watcher = watcher
+	go s.watch()
+	return s, nil
+}
+
+func (s *Store) files() []string {
+	files := []string{s.params.CertFile, s.params.KeyFile}
+	if s.params.CAFile != "" {
+		files = append(files, s.params.CAFile)
+	}
+	return files
+}
+
+// Reload reads the certificate, key and CAs from their files.
+func (s *Store) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.params.CertFile, s.params.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	var pool *x509.CertPool
+	if s.params.CAFile != "" {
+		pem, err := os.ReadFile(s.params.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", s.params.CAFile)
+		}
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.pool = pool
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) watch() {
+	watched := map[string]bool{}
+	for _, file := range s.files() {
+		watched[filepath.Clean(file)] = true
+	}
+	var reload *time.Timer
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			// Kubernetes swaps a ..data symlink when it updates a secret
+			if !watched[filepath.Clean(event.Name)] && filepath.Base(event.Name) != "..data" {
+				continue
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if reload != nil {
+				reload.Stop()
+			}
+			reload = time.AfterFunc(RELOAD_DELAY, func() {
+				if err := s.Reload(); err != nil {
+					log.Errorf("Error reloading certificates, keeping the previous ones: %v", err)
+					return
+				}
+				log.Infof("Certificates reloaded from %s", s.params.CertFile)
+			})
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("Error watching certificates: %v", err)
+		case <-s.done:
+			if reload != nil {
+				reload.Stop()
+			}
+			return
+		}
+	}
+}
+
+// Close stops watching the files.
+func (s *Store) Close() error {
+	close(s.done)
+	return s.watcher.Close()
+}
+
+// Certificate returns the certificate of the node.
+func (s *Store) Certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+// CAs returns the CAs peers are verified with, nil for the system roots.
+func (s *Store) CAs() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pool
+}
+
+// ServerConfig returns the configuration of listeners of the given ALPN
+// protocols. Clients may present a certificate, which is verified with the
+// CAs of the store; VerifiedPeer tells whether a connection did. Without a
+// CA file no certificate is asked for, the system roots would take any
+// publicly issued certificate as the one of a node.
+func (s *Store) ServerConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		// every handshake takes the certificate and CAs loaded last
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*s.Certificate()},
+			}
+			if pool := s.CAs(); pool != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = pool
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig returns the configuration for dialing serverName, presenting
+// the certificate of the node. The server is verified with the system roots
+// when the store has no CA file.
+func (s *Store) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    s.CAs(),
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.Certificate(), nil
+		},
+	}
+}
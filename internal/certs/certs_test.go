@@ -0,0 +1,248 @@
+package certs_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sk25469/kv/internal/certs"
+	"github.com/sk25469/kv/logger"
+)
+
+func TestMain(m *testing.M) {
+	// reloads log, keep the file out of the package directory
+	dir, err := os.MkdirTemp("", "certs-logs")
+	if err != nil {
+		panic(err)
+	}
+	logger.InitLogger(logger.Config{LogLevel: "info", LogFile: filepath.Join(dir, "app.log")})
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// issue writes a certificate for 127.0.0.1 and its key to dir, signed by
+// parent or self-signed when parent is nil.
+func issue(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	// written next to the file and renamed over it, as rotations do
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newStore(t *testing.T) (*certs.Store, string) {
+	t.Helper()
+	dir := t.TempDir()
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "node", ca, caKey)
+	store, err := certs.NewStore(certs.StoreParams{
+		CertFile: filepath.Join(dir, "node.crt"),
+		KeyFile:  filepath.Join(dir, "node.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, dir
+}
+
+// serve answers every line with whether the peer has a verified certificate.
+func serve(t *testing.T, store *certs.Store, required bool) string {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := certs.NewListener(inner, store, required)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+					if certs.VerifiedPeer(conn) {
+						conn.Write([]byte("verified\n"))
+					} else {
+						conn.Write([]byte("unverified\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return inner.Addr().String()
+}
+
+func roundTrip(t *testing.T, conn net.Conn) (string, error) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestListener(t *testing.T) {
+	store, _ := newStore(t)
+
+	for _, required := range []bool{false, true} {
+		address := serve(t, store, required)
+
+		// a node presents its certificate
+		conn, err := tls.Dial("tcp", address, store.ClientConfig("127.0.0.1"))
+		if err != nil {
+			t.Fatalf("required=%v: %v", required, err)
+		}
+		if reply, err := roundTrip(t, conn); err != nil || reply != "verified\n" {
+			t.Errorf("required=%v: mutual TLS got %q, %v", required, reply, err)
+		}
+		conn.Close()
+
+		// a client only verifies the server
+		conn, err = tls.Dial("tcp", address, &tls.Config{RootCAs: store.CAs(), ServerName: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("required=%v: %v", required, err)
+		}
+		if reply, err := roundTrip(t, conn); err != nil || reply != "unverified\n" {
+			t.Errorf("required=%v: TLS got %q, %v", required, reply, err)
+		}
+		conn.Close()
+
+		plain, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := roundTrip(t, plain)
+		if required && err == nil {
+			t.Errorf("plaintext was served on a listener requiring TLS: %q", reply)
+		}
+		if !required && reply != "unverified\n" {
+			t.Errorf("plaintext got %q, %v", reply, err)
+		}
+		plain.Close()
+	}
+}
+
+func TestNoPeerIsVerifiedWithoutCAFile(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "node", ca, caKey)
+	store, err := certs.NewStore(certs.StoreParams{
+		CertFile: filepath.Join(dir, "node.crt"),
+		KeyFile:  filepath.Join(dir, "node.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	address := serve(t, store, true)
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reply, err := roundTrip(t, conn); err != nil || reply != "unverified\n" {
+		t.Errorf("got %q, %v, want unverified", reply, err)
+	}
+}
+
+func TestStoreReloadsChangedCertificate(t *testing.T) {
+	store, dir := newStore(t)
+	before := store.Certificate()
+	leaf, err := x509.ParseCertificate(before.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate both the CA and the node certificate
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "node", ca, caKey)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Certificate() == before {
+		if time.Now().After(deadline) {
+			t.Fatal("the certificate was not reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// new connections are served with the new certificate
+	address := serve(t, store, true)
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: store.CAs(), ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Cmp(leaf.SerialNumber) == 0 {
+		t.Error("the connection was served with the previous certificate")
+	}
+}
@@ -0,0 +1,138 @@
+package certs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+	// RECORD_HANDSHAKE is the first byte of every TLS connection, the type of
+	// the record carrying the ClientHello
+	RECORD_HANDSHAKE = 0x16
+)
+
+// ErrPlaintext is returned by connections that didn't start a TLS handshake
+// on a listener that requires one.
+var ErrPlaintext = errors.New("plaintext connection on a TLS listener")
+
+// NewListener serves TLS with the certificate of the store on inner. The
+// first byte of a connection tells whether it starts a TLS handshake; the
+// others are plaintext and are refused when required is set, or served as
+// they are otherwise, so nodes can move to TLS one at a time. nextProtos are
+// the ALPN protocols of the listener, "h2" for gRPC.
+func NewListener(inner net.Listener, store *Store, required bool, nextProtos ...string) net.Listener {
+	return &listener{Listener: inner, config: store.ServerConfig(nextProtos...), required: required}
+}
+
+type listener struct {
+	net.Listener
+	config   *tls.Config
+	required bool
+}
+
+// Accept returns the connection right away, the handshake runs on its
+// first read or write so a slow client doesn't hold up the others.
+func (l *listener) Accept() (net.Conn, error) {
+	raw, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: raw, listener: l}, nil
+}
+
+// Conn is a connection accepted by a TLS listener.
+type Conn struct {
+	net.Conn // the accepted connection, deadlines are set on it
+	listener *listener
+	once     sync.Once
+	conn     net.Conn // the TLS or plaintext connection once detected
+	tls      *tls.Conn
+	err      error
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.detect)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.once.Do(c.detect)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Write(p)
+}
+
+// detect reads the first byte of the connection and runs the TLS handshake
+// if it starts one.
+func (c *Conn) detect() {
+	c.Conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(c.Conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+	buffered := &bufferedConn{Conn: c.Conn, reader: reader}
+	if first[0] != RECORD_HANDSHAKE {
+		if c.listener.required {
+			log.Errorf("Refusing plaintext connection from %v, TLS is required", c.RemoteAddr())
+			c.err = ErrPlaintext
+			c.Conn.Close()
+			return
+		}
+		c.conn = buffered
+		return
+	}
+
+	tlsConn := tls.Server(buffered, c.listener.config)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Errorf("TLS handshake with %v failed: %v", c.RemoteAddr(), err)
+		c.err = err
+		c.Conn.Close()
+		return
+	}
+	c.conn = tlsConn
+	c.tls = tlsConn
+}
+
+// ConnectionState returns the state of the TLS connection, ok is false for
+// plaintext connections or before the handshake.
+func (c *Conn) ConnectionState() (state tls.ConnectionState, ok bool) {
+	c.once.Do(c.detect)
+	if c.tls == nil {
+		return state, false
+	}
+	return c.tls.ConnectionState(), true
+}
+
+// VerifiedPeer reports whether the peer of conn presented a certificate
+// signed by a CA the node trusts.
+func VerifiedPeer(conn net.Conn) bool {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return false
+	}
+	state, ok := c.ConnectionState()
+	return ok && len(state.VerifiedChains) > 0
+}
+
+// bufferedConn reads through the reader that peeked at the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
@@ -0,0 +1,234 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// Binary protocol. Every message is a frame:
+//
+//	magic    2 bytes  0xBE 0xEF
+//	version  1 byte
+//	opcode   1 byte
+//	request  8 bytes  id chosen by the client, echoed in the reply
+//	length   4 bytes  payload length
+//	payload  fields, each a type byte, a 4 byte length and the data
+//
+// Integers are big endian. Unlike the text protocol, keys and values may hold
+// any byte, spaces and newlines included.
+const (
+	FRAME_VERSION     = 1
+	FRAME_HEADER_SIZE = 16
+	// FRAME_MAX_PAYLOAD caps the payload of a single frame
+	FRAME_MAX_PAYLOAD = 64 * 1024 * 1024
+)
+
+var FRAME_MAGIC = [2]byte{0xBE, 0xEF}
+
+var ErrFrame = errors.New("invalid frame")
+
+// IsBinary reports whether a connection starting with the given byte speaks
+// the binary protocol.
+func IsBinary(first byte) bool {
+	return first == FRAME_MAGIC[0]
+}
+
+// ReadFrame reads the next frame off the stream.
+func ReadFrame(r io.Reader) (*codec_model.Frame, error) {
+	return ReadFrameMax(r, 0)
+}
+
+// ReadFrameMax reads a frame like ReadFrame, failing with utils.ErrTooLarge
+// for a payload over maxSize bytes. A maxSize of 0 leaves only
+// FRAME_MAX_PAYLOAD.
+func ReadFrameMax(r io.Reader, maxSize int) (*codec_model.Frame, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != FRAME_MAGIC[0] || header[1] != FRAME_MAGIC[1] {
+		return nil, fmt.Errorf("%w: bad magic %x", ErrFrame, header[:2])
+	}
+	frame := &codec_model.Frame{
+		Version:   header[2],
+		Opcode:    codec_model.Opcode(header[3]),
+		RequestID: binary.BigEndian.Uint64(header[4:12]),
+	}
+	if frame.Version != FRAME_VERSION {
+		return frame, fmt.Errorf("%w: unsupported version %d", ErrFrame, frame.Version)
+	}
+	length := binary.BigEndian.Uint32(header[12:16])
+	if length > FRAME_MAX_PAYLOAD {
+		return frame, fmt.Errorf("%w: payload of %d bytes is too large", ErrFrame, length)
+	}
+	if maxSize > 0 && int(length) > maxSize {
+		return frame, fmt.Errorf("%w: payload of %d bytes is over %d", utils.ErrTooLarge, length, maxSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	for len(payload) > 0 {
+		if len(payload) < 5 {
+			return frame, fmt.Errorf("%w: truncated field", ErrFrame)
+		}
+		size := binary.BigEndian.Uint32(payload[1:5])
+		if uint32(len(payload)-5) < size {
+			return frame, fmt.Errorf("%w: truncated field", ErrFrame)
+		}
+		frame.Fields = append(frame.Fields, codec_model.Field{
+			Type: codec_model.FieldType(payload[0]),
+			Data: payload[5 : 5+size],
+		})
+		payload = payload[5+size:]
+	}
+	return frame, nil
+}
+
+// MarshalFrame serializes a frame for the wire.
+func MarshalFrame(frame *codec_model.Frame) []byte {
+	var payload bytes.Buffer
+	for _, field := range frame.Fields {
+		payload.WriteByte(byte(field.Type))
+		binary.Write(&payload, binary.BigEndian, uint32(len(field.Data)))
+		payload.Write(field.Data)
+	}
+
+	buf := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+payload.Len())
+	buf[0], buf[1] = FRAME_MAGIC[0], FRAME_MAGIC[1]
+	buf[2] = frame.Version
+	if buf[2] == 0 {
+		buf[2] = FRAME_VERSION
+	}
+	buf[3] = byte(frame.Opcode)
+	binary.BigEndian.PutUint64(buf[4:12], frame.RequestID)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(payload.Len()))
+	return append(buf, payload.Bytes()...)
+}
+
+type BinaryCodecLayer struct{}
+
+func NewBinaryCodecLayer() *BinaryCodecLayer {
+	return &BinaryCodecLayer{}
+}
+
+// Encode parses a whole frame into the command it carries. The request id
+// of the frame is kept on the command.
+func (b *BinaryCodecLayer) Encode(data string, sendTo, sentFrom interface{}) (interface{}, error) {
+	frame, err := ReadFrame(strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return b.EncodeFrame(frame)
+}
+
+// Decode serializes a reply frame.
+func (b *BinaryCodecLayer) Decode(data interface{}) ([]byte, error) {
+	frame, ok := data.(*codec_model.Frame)
+	if !ok {
+		return nil, errors.New("unknown message type")
+	}
+	return MarshalFrame(frame), nil
+}
+
+// EncodeFrame builds the command carried by a request frame.
+func (b *BinaryCodecLayer) EncodeFrame(frame *codec_model.Frame) (*codec_model.Command, error) {
+	args := make([]string, 0, len(frame.Fields))
+	for _, field := range frame.Fields {
+		if field.Type != codec_model.FieldString {
+			return nil, fmt.Errorf("%w: request fields must be strings", ErrFrame)
+		}
+		args = append(args, string(field.Data))
+	}
+
+	var parts []string
+	switch frame.Opcode {
+	case codec_model.OpGet:
+		parts = append([]string{"GET"}, args...)
+	case codec_model.OpSet:
+		parts = append([]string{"SET"}, args...)
+	case codec_model.OpDelete:
+		parts = append([]string{"DEL"}, args...)
+	case codec_model.OpPing:
+		parts = append([]string{"PING"}, args...)
+	case codec_model.OpCommand:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%w: command without a name", ErrFrame)
+		}
+		parts = append([]string{strings.ToUpper(args[0])}, args[1:]...)
+	default:
+		return nil, fmt.Errorf("%w: unknown opcode 0x%02x", ErrFrame, byte(frame.Opcode))
+	}
+
+	wantArgs := map[codec_model.Opcode]int{codec_model.OpGet: 1, codec_model.OpSet: 2, codec_model.OpDelete: 1}
+	if n, ok := wantArgs[frame.Opcode]; ok && len(args) != n {
+		return nil, fmt.Errorf("%w: %s takes %d fields, got %d", ErrFrame, parts[0], n, len(args))
+	}
+
+	cmd := codec_model.NewCommand(parts)
+	cmd.RequestID = frame.RequestID
+	return cmd, nil
+}
+
+// ReplyFrame builds the frame answering the request with the given id.
+// Aggregates nested in arrays or maps are flattened into their parent.
+func ReplyFrame(requestID uint64, reply codec_model.Reply) *codec_model.Frame {
+	frame := &codec_model.Frame{Version: FRAME_VERSION, RequestID: requestID}
+	switch reply.Type {
+	case codec_model.StatusReply:
+		frame.Opcode = codec_model.OpStatus
+	case codec_model.ErrorReply:
+		frame.Opcode = codec_model.OpError
+	case codec_model.IntegerReply:
+		frame.Opcode = codec_model.OpInteger
+	case codec_model.BulkReply:
+		frame.Opcode = codec_model.OpBulk
+	case codec_model.NilReply:
+		frame.Opcode = codec_model.OpNil
+		return frame
+	case codec_model.ArrayReply, codec_model.MapReply:
+		if reply.Elems == nil {
+			frame.Opcode = codec_model.OpNil
+			return frame
+		}
+		frame.Opcode = codec_model.OpArray
+		if reply.Type == codec_model.MapReply {
+			frame.Opcode = codec_model.OpMap
+		}
+		frame.Fields = appendFields(nil, reply.Elems)
+		return frame
+	}
+	frame.Fields = appendFields(nil, []codec_model.Reply{reply})
+	return frame
+}
+
+func appendFields(fields []codec_model.Field, replies []codec_model.Reply) []codec_model.Field {
+	for _, reply := range replies {
+		switch reply.Type {
+		case codec_model.StatusReply, codec_model.BulkReply:
+			fields = append(fields, codec_model.Field{Type: codec_model.FieldString, Data: []byte(reply.Str)})
+		case codec_model.ErrorReply:
+			fields = append(fields, codec_model.Field{Type: codec_model.FieldError, Data: []byte(reply.Str)})
+		case codec_model.IntegerReply:
+			data := binary.BigEndian.AppendUint64(nil, uint64(reply.Int))
+			fields = append(fields, codec_model.Field{Type: codec_model.FieldInteger, Data: data})
+		case codec_model.NilReply:
+			fields = append(fields, codec_model.Field{Type: codec_model.FieldNil})
+		case codec_model.ArrayReply, codec_model.MapReply:
+			if reply.Elems == nil {
+				fields = append(fields, codec_model.Field{Type: codec_model.FieldNil})
+				continue
+			}
+			fields = appendFields(fields, reply.Elems)
+		}
+	}
+	return fields
+}
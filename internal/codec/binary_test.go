@@ -0,0 +1,110 @@
+package codec_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/sk25469/kv/internal/codec"
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+)
+
+func stringField(s string) codec_model.Field {
+	return codec_model.Field{Type: codec_model.FieldString, Data: []byte(s)}
+}
+
+func TestBinaryCodec_Request(t *testing.T) {
+	request := &codec_model.Frame{
+		Opcode:    codec_model.OpSet,
+		RequestID: 42,
+		Fields:    []codec_model.Field{stringField("greeting"), stringField("hello world\nbye")},
+	}
+
+	c := codec.NewCodecLayerService()
+	data, err := c.Decode(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := codec.ReadFrame(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := c.EncodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Type != codec_model.Set || cmd.Key != "greeting" || cmd.Value != "hello world\nbye" || cmd.RequestID != 42 {
+		t.Errorf("command = %+v", cmd)
+	}
+
+	// the whole frame also goes through ICodec
+	var icodec codec.ICodec = codec.NewBinaryCodecLayer()
+	encoded, err := icodec.Encode(string(data), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded.(*codec_model.Command).Value != "hello world\nbye" {
+		t.Errorf("ICodec command = %+v", encoded)
+	}
+}
+
+func TestBinaryCodec_Invalid(t *testing.T) {
+	valid := codec.MarshalFrame(&codec_model.Frame{Opcode: codec_model.OpGet, Fields: []codec_model.Field{stringField("k")}})
+
+	badMagic := append([]byte{}, valid...)
+	badMagic[1] = 0x00
+	badVersion := append([]byte{}, valid...)
+	badVersion[2] = 9
+	tooLarge := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(tooLarge[12:16], codec.FRAME_MAX_PAYLOAD+1)
+	truncatedField := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(truncatedField[17:21], 100)
+
+	for name, data := range map[string][]byte{
+		"magic":   badMagic,
+		"version": badVersion,
+		"length":  tooLarge,
+		"field":   truncatedField,
+	} {
+		if _, err := codec.ReadFrame(bytes.NewReader(data)); !errors.Is(err, codec.ErrFrame) {
+			t.Errorf("%s: expected a frame error, got %v", name, err)
+		}
+	}
+
+	c := codec.NewCodecLayerService()
+	for name, frame := range map[string]*codec_model.Frame{
+		"opcode": {Opcode: 0x7f},
+		"fields": {Opcode: codec_model.OpSet, Fields: []codec_model.Field{stringField("k")}},
+		"type":   {Opcode: codec_model.OpGet, Fields: []codec_model.Field{{Type: codec_model.FieldInteger, Data: make([]byte, 8)}}},
+	} {
+		if _, err := c.EncodeFrame(frame); !errors.Is(err, codec.ErrFrame) {
+			t.Errorf("%s: expected a frame error, got %v", name, err)
+		}
+	}
+}
+
+func TestReplyFrame(t *testing.T) {
+	reply := codec_model.Array(codec_model.Status("OK"), codec_model.Integer(-1), codec_model.Nil(), codec_model.Error("ERR no"))
+	frame, err := codec.ReadFrame(bytes.NewReader(codec.MarshalFrame(codec.ReplyFrame(7, reply))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.RequestID != 7 || frame.Opcode != codec_model.OpArray || len(frame.Fields) != 4 {
+		t.Fatalf("frame = %+v", frame)
+	}
+
+	want := []codec_model.FieldType{codec_model.FieldString, codec_model.FieldInteger, codec_model.FieldNil, codec_model.FieldError}
+	for i, field := range frame.Fields {
+		if field.Type != want[i] {
+			t.Errorf("field %d has type %d, want %d", i, field.Type, want[i])
+		}
+	}
+	if n := int64(binary.BigEndian.Uint64(frame.Fields[1].Data)); n != -1 {
+		t.Errorf("integer field = %d", n)
+	}
+
+	if frame := codec.ReplyFrame(8, codec_model.NilArray()); frame.Opcode != codec_model.OpNil {
+		t.Errorf("nil array opcode = 0x%02x", byte(frame.Opcode))
+	}
+}
@@ -20,12 +20,14 @@ type CodecLayerParams struct {
 type CodecLayerService struct {
 	commandCodecLayerService *CommandCodecLayer
 	commCodecLayerService    *CommCodecLayer
+	binaryCodecLayerService  *BinaryCodecLayer
 }
 
 func NewCodecLayerService() *CodecLayerService {
 	return &CodecLayerService{
 		commandCodecLayerService: NewCommandCodecLayer(),
 		commCodecLayerService:    NewCommCodecLayer(),
+		binaryCodecLayerService:  NewBinaryCodecLayer(),
 	}
 }
 
@@ -49,7 +51,14 @@ func (c *CodecLayerService) Decode(data interface{}) ([]byte, error) {
 	case *codec_model.CommunicationModel:
 		res, err := v.Decode()
 		return res, err
+	case *codec_model.Frame:
+		return c.binaryCodecLayerService.Decode(v)
 	default:
 		return []byte{}, errors.New("unknown message type")
 	}
 }
+
+// EncodeFrame builds the command carried by a frame of the binary protocol.
+func (c *CodecLayerService) EncodeFrame(frame *codec_model.Frame) (*codec_model.Command, error) {
+	return c.binaryCodecLayerService.EncodeFrame(frame)
+}
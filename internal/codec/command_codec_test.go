@@ -0,0 +1,29 @@
+package codec_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sk25469/kv/internal/codec"
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+)
+
+func TestEncodeScriptAsJSONString(t *testing.T) {
+	c := codec.NewCodecLayerService()
+	for _, tc := range []struct {
+		line string
+		args []string
+	}{
+		{`EVAL "return kv.get(KEYS[1]) .. \" \" .. ARGV[1]" 1 k v` + "\n", []string{`return kv.get(KEYS[1]) .. " " .. ARGV[1]`, "1", "k", "v"}},
+		{`SCRIPT LOAD "return 1"` + "\n", []string{"LOAD", "return 1"}},
+		{"EVAL return 0\n", []string{"return", "0"}},
+	} {
+		cmd, err := c.Encode(tc.line, nil, nil)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.line, err)
+		}
+		if args := cmd.(*codec_model.Command).Args; !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("%q: got args %q, want %q", tc.line, args, tc.args)
+		}
+	}
+}
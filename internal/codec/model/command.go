@@ -15,6 +15,31 @@ const (
 	Set          CommandType = "SET"
 	Get          CommandType = "GET"
 	Delete       CommandType = "DEL"
+	MGet         CommandType = "MGET"
+	MSet         CommandType = "MSET"
+	MDel         CommandType = "MDEL"
+	Cdc          CommandType = "CDC"
+	Backup       CommandType = "BACKUP"
+	Watch        CommandType = "WATCH"
+	Unwatch      CommandType = "UNWATCH"
+	Multi        CommandType = "MULTI"
+	Exec         CommandType = "EXEC"
+	Discard      CommandType = "DISCARD"
+	Begin        CommandType = "BEGIN"
+	Commit       CommandType = "COMMIT"
+	Rollback     CommandType = "ROLLBACK"
+	Savepoint    CommandType = "SAVEPOINT"
+	Release      CommandType = "RELEASE"
+	Batch        CommandType = "BATCH"
+	Scan         CommandType = "SCAN"
+	Hello        CommandType = "HELLO"
+	Auth         CommandType = "AUTH"
+	SetChunk     CommandType = "SETCHUNK"
+	GetRange     CommandType = "GETRANGE"
+	StrLen       CommandType = "STRLEN"
+	Eval         CommandType = "EVAL"
+	EvalSha      CommandType = "EVALSHA"
+	Script       CommandType = "SCRIPT"
 	IAM          CommandType = "COMM:IAM"
 	HEALTH_CHECK CommandType = "COMM:HEALTH_CHECK"
 	ECHO         CommandType = "COMM:ECHO"
@@ -70,6 +95,9 @@ type Command struct {
 	Args  []string // Arguments of the command
 	Key   string
 	Value string
+	// RequestID is the id a binary frame carried the command with, so the
+	// reply can echo it
+	RequestID uint64
 }
 
 // ParseCommand parses a raw command string into a Command struct
@@ -81,6 +109,48 @@ func (c *Command) Encode(rawCommand string) *Command {
 		return nil // Ignore empty commands
 	}
 
+	// a replicated batch carries its writes as JSON, which may hold spaces
+	if parts[0] == "BATCH" {
+		parts = []string{parts[0], strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rawCommand), parts[0]))}
+	}
+	// and so does a script, as a JSON string
+	if parts[0] == "EVAL" || (parts[0] == "SCRIPT" && len(parts) > 1 && strings.EqualFold(parts[1], "LOAD")) {
+		parts = splitScript(rawCommand, parts)
+	}
+	return NewCommand(parts)
+}
+
+// splitScript splits a command whose script argument is a JSON string. The
+// parts split on whitespace are returned as they are if it is not.
+func splitScript(rawCommand string, parts []string) []string {
+	head := parts[:1]
+	if parts[0] == "SCRIPT" {
+		head = parts[:2]
+	}
+	rest := strings.TrimSpace(rawCommand)
+	for _, part := range head {
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, part))
+	}
+	if !strings.HasPrefix(rest, `"`) {
+		return parts
+	}
+
+	var script string
+	decoder := json.NewDecoder(strings.NewReader(rest))
+	if err := decoder.Decode(&script); err != nil {
+		return parts
+	}
+	split := append(append([]string{}, head...), script)
+	return append(split, strings.Fields(rest[decoder.InputOffset():])...)
+}
+
+// NewCommand builds a command from its name and arguments, for protocols
+// that frame every argument on its own.
+func NewCommand(parts []string) *Command {
+	if len(parts) == 0 {
+		return nil
+	}
+
 	Args := []string{}
 	if len(parts) > 1 {
 		Args = parts[1:]
@@ -88,9 +158,12 @@ func (c *Command) Encode(rawCommand string) *Command {
 
 	var key, value string
 
-	if len(Args) > 1 {
-		key = Args[len(Args)-2]
-		value = Args[len(Args)-1]
+	if parts[0] == "BATCH" {
+		value = strings.Join(Args, " ")
+		Args = []string{value}
+	} else if len(Args) > 1 {
+		key = Args[0]
+		value = Args[1]
 	} else if len(Args) == 1 {
 		key = Args[0]
 	}
@@ -112,6 +185,56 @@ func (c *Command) Encode(rawCommand string) *Command {
 		cmd.Type = Get
 	case "DEL":
 		cmd.Type = Delete
+	case "MGET":
+		cmd.Type = MGet
+	case "MSET":
+		cmd.Type = MSet
+	case "MDEL":
+		cmd.Type = MDel
+	case "CDC":
+		cmd.Type = Cdc
+	case "BACKUP":
+		cmd.Type = Backup
+	case "WATCH":
+		cmd.Type = Watch
+	case "UNWATCH":
+		cmd.Type = Unwatch
+	case "MULTI":
+		cmd.Type = Multi
+	case "EXEC":
+		cmd.Type = Exec
+	case "DISCARD":
+		cmd.Type = Discard
+	case "BEGIN":
+		cmd.Type = Begin
+	case "COMMIT":
+		cmd.Type = Commit
+	case "ROLLBACK":
+		cmd.Type = Rollback
+	case "SAVEPOINT":
+		cmd.Type = Savepoint
+	case "RELEASE":
+		cmd.Type = Release
+	case "BATCH":
+		cmd.Type = Batch
+	case "SCAN":
+		cmd.Type = Scan
+	case "HELLO":
+		cmd.Type = Hello
+	case "AUTH":
+		cmd.Type = Auth
+	case "SETCHUNK":
+		cmd.Type = SetChunk
+	case "GETRANGE":
+		cmd.Type = GetRange
+	case "STRLEN":
+		cmd.Type = StrLen
+	case "EVAL":
+		cmd.Type = Eval
+	case "EVALSHA":
+		cmd.Type = EvalSha
+	case "SCRIPT":
+		cmd.Type = Script
 	}
 
 	return cmd
@@ -0,0 +1,46 @@
+package model
+
+// Opcode says what a binary frame carries. Requests use the opcodes below
+// 0x80, replies the ones from 0x80 on, one per reply type.
+type Opcode uint8
+
+const (
+	OpGet     Opcode = 0x01 // fields: key
+	OpSet     Opcode = 0x02 // fields: key, value
+	OpDelete  Opcode = 0x03 // fields: key
+	OpCommand Opcode = 0x04 // fields: name, args...
+	OpPing    Opcode = 0x05 // no fields
+
+	OpStatus  Opcode = 0x80 // fields: status
+	OpError   Opcode = 0x81 // fields: message
+	OpInteger Opcode = 0x82 // fields: integer
+	OpBulk    Opcode = 0x83 // fields: value
+	OpNil     Opcode = 0x84 // no fields
+	OpArray   Opcode = 0x85 // fields: one per element
+	OpMap     Opcode = 0x86 // fields: keys and values alternating
+)
+
+// FieldType is the type of a field in the payload of a binary frame.
+type FieldType uint8
+
+const (
+	FieldString  FieldType = 0x01
+	FieldInteger FieldType = 0x02 // 8 bytes, big endian, two's complement
+	FieldNil     FieldType = 0x03
+	FieldError   FieldType = 0x04
+)
+
+// Field is a typed field of a binary frame.
+type Field struct {
+	Type FieldType
+	Data []byte
+}
+
+// Frame is a message of the binary protocol. Replies carry the RequestID of
+// the request they answer.
+type Frame struct {
+	Version   uint8
+	Opcode    Opcode
+	RequestID uint64
+	Fields    []Field
+}
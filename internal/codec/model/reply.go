@@ -0,0 +1,60 @@
+package model
+
+// ReplyType is the type of a reply in protocols that tell them apart, such
+// as RESP.
+type ReplyType int
+
+const (
+	StatusReply ReplyType = iota
+	ErrorReply
+	IntegerReply
+	BulkReply
+	NilReply
+	ArrayReply
+	MapReply
+)
+
+// Reply is a typed reply. Arrays hold their elements in Elems, maps hold
+// their keys and values alternating. An array with nil Elems is a nil array.
+type Reply struct {
+	Type  ReplyType
+	Str   string
+	Int   int64
+	Elems []Reply
+}
+
+func Status(status string) Reply {
+	return Reply{Type: StatusReply, Str: status}
+}
+
+func Error(message string) Reply {
+	return Reply{Type: ErrorReply, Str: message}
+}
+
+func Integer(n int64) Reply {
+	return Reply{Type: IntegerReply, Int: n}
+}
+
+func Bulk(value string) Reply {
+	return Reply{Type: BulkReply, Str: value}
+}
+
+func Nil() Reply {
+	return Reply{Type: NilReply}
+}
+
+func Array(elems ...Reply) Reply {
+	if elems == nil {
+		elems = []Reply{}
+	}
+	return Reply{Type: ArrayReply, Elems: elems}
+}
+
+// NilArray is an array that is not there, as opposed to an empty one.
+func NilArray() Reply {
+	return Reply{Type: ArrayReply}
+}
+
+func Map(keysAndValues ...Reply) Reply {
+	return Reply{Type: MapReply, Elems: keysAndValues}
+}
@@ -0,0 +1,171 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// RESP protocol versions a connection can speak. Clients start on RESP2 and
+// switch with HELLO 3.
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+const (
+	// RESP_MAX_BULK_LENGTH caps a single argument, like redis' proto-max-bulk-len
+	RESP_MAX_BULK_LENGTH = 512 * 1024 * 1024
+	// RESP_MAX_ARGS caps the number of arguments of a single command
+	RESP_MAX_ARGS = 1024 * 1024
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// IsRESP reports whether a connection starting with the given byte speaks
+// RESP. RESP clients always send commands as arrays of bulk strings.
+func IsRESP(first byte) bool {
+	return first == '*'
+}
+
+// ReadRESPCommand reads a command sent as a RESP array of bulk strings and
+// returns its arguments.
+func ReadRESPCommand(r *bufio.Reader) ([]string, error) {
+	return ReadRESPCommandMax(r, 0)
+}
+
+// ReadRESPCommandMax reads a command like ReadRESPCommand, failing with
+// utils.ErrTooLarge before reading an argument that takes the command over
+// maxSize bytes. A maxSize of 0 means no limit.
+func ReadRESPCommandMax(r *bufio.Reader, maxSize int) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("%w: expected '*', got %q", ErrProtocol, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > RESP_MAX_ARGS {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	args := make([]string, 0, max(n, 0))
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got %q", ErrProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > RESP_MAX_BULK_LENGTH {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+		total += size
+		if maxSize > 0 && total > maxSize {
+			return nil, fmt.Errorf("%w: over %d bytes", utils.ErrTooLarge, maxSize)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readRESPLine reads a header line. It only holds a type and a length, so a
+// line that doesn't fit the buffer of the reader is refused rather than read
+// on until its end.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: line too long", ErrProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return "", fmt.Errorf("%w: line not terminated by CRLF", ErrProtocol)
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// EncodeRESP builds a command from the arguments of a RESP request. Command
+// names are case-insensitive in RESP.
+func (c *CodecLayerService) EncodeRESP(args []string) (*codec_model.Command, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%w: empty command", ErrProtocol)
+	}
+	parts := append([]string{strings.ToUpper(args[0])}, args[1:]...)
+	return codec_model.NewCommand(parts), nil
+}
+
+// EncodeReply serializes a reply for a client speaking the given RESP
+// version. RESP3 types are downgraded to their RESP2 equivalents.
+func EncodeReply(reply codec_model.Reply, proto int) []byte {
+	var sb strings.Builder
+	writeReply(&sb, reply, proto)
+	return []byte(sb.String())
+}
+
+func writeReply(sb *strings.Builder, reply codec_model.Reply, proto int) {
+	switch reply.Type {
+	case codec_model.StatusReply:
+		sb.WriteString("+" + singleLine(reply.Str) + "\r\n")
+	case codec_model.ErrorReply:
+		sb.WriteString("-" + singleLine(reply.Str) + "\r\n")
+	case codec_model.IntegerReply:
+		sb.WriteString(":" + strconv.FormatInt(reply.Int, 10) + "\r\n")
+	case codec_model.BulkReply:
+		sb.WriteString("$" + strconv.Itoa(len(reply.Str)) + "\r\n" + reply.Str + "\r\n")
+	case codec_model.NilReply:
+		if proto >= RESP3 {
+			sb.WriteString("_\r\n")
+		} else {
+			sb.WriteString("$-1\r\n")
+		}
+	case codec_model.ArrayReply:
+		if reply.Elems == nil {
+			// an array that is not there, like the reply of an aborted EXEC
+			if proto >= RESP3 {
+				sb.WriteString("_\r\n")
+			} else {
+				sb.WriteString("*-1\r\n")
+			}
+			return
+		}
+		sb.WriteString("*" + strconv.Itoa(len(reply.Elems)) + "\r\n")
+		for _, elem := range reply.Elems {
+			writeReply(sb, elem, proto)
+		}
+	case codec_model.MapReply:
+		if proto >= RESP3 {
+			sb.WriteString("%" + strconv.Itoa(len(reply.Elems)/2) + "\r\n")
+		} else {
+			sb.WriteString("*" + strconv.Itoa(len(reply.Elems)) + "\r\n")
+		}
+		for _, elem := range reply.Elems {
+			writeReply(sb, elem, proto)
+		}
+	}
+}
+
+// singleLine keeps status and error replies on one line.
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -2,10 +2,12 @@ package comm
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"time"
 
+	"github.com/sk25469/kv/internal/certs"
 	codec_model "github.com/sk25469/kv/internal/codec/model"
 	network "github.com/sk25469/kv/internal/network/model"
 	"github.com/sk25469/kv/logger"
@@ -42,14 +44,18 @@ type ICommunication interface {
 }
 
 type CommunicationServiceParams struct {
+	Certs      *certs.Store        // messages to other nodes go over mutual TLS with it when set
+	NodeConfig *network.NodeConfig // this node, whose credentials log in to the others
 }
 
 type CommunicationService struct {
 	topologyMap *network.TopologyMap //  map of nodes in the network
 	etcdClient  *clientv3.Client
+	certs       *certs.Store
+	nodeConfig  *network.NodeConfig
 }
 
-func NewCommunicationService() *CommunicationService {
+func NewCommunicationService(params CommunicationServiceParams) *CommunicationService {
 	etcdClient, err := clientv3.New(clientv3.Config{
 		Endpoints:   utils.EtcdEndpoints,
 		DialTimeout: 5 * time.Second,
@@ -60,6 +66,8 @@ func NewCommunicationService() *CommunicationService {
 	return &CommunicationService{
 		topologyMap: network.NewTopologyMap(),
 		etcdClient:  etcdClient,
+		certs:       params.Certs,
+		nodeConfig:  params.NodeConfig,
 	}
 }
 
@@ -139,7 +147,7 @@ func (c *CommunicationService) DiscoverNodes() error {
 
 func (c *CommunicationService) sendMessage(node *network.NodeConfig, msgId string, req []byte) {
 	go func(node *network.NodeConfig) {
-		conn, err := net.Dial("tcp", node.IP+":"+node.Port)
+		conn, err := c.dial(node)
 		if err != nil {
 			log.Errorf("Error connecting to node %v: %v", node.ID, err)
 			return
@@ -155,6 +163,33 @@ func (c *CommunicationService) sendMessage(node *network.NodeConfig, msgId strin
 
 }
 
+// dial connects to a node, over TLS presenting the certificate of this node
+// when it has one, and logs in with the credentials of this node when it has
+// them. The reply to the login is left unread, like the replies to messages.
+func (c *CommunicationService) dial(node *network.NodeConfig) (net.Conn, error) {
+	address := net.JoinHostPort(node.IP, node.Port)
+	dialer := &net.Dialer{Timeout: utils.DEFAULT_CTX_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if c.certs == nil {
+		conn, err = dialer.Dial("tcp", address)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, c.certs.ClientConfig(node.IP))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.nodeConfig != nil && c.nodeConfig.RequiresAuth() {
+		username, password := c.nodeConfig.Credentials()
+		if _, err := fmt.Fprintf(conn, "%s %s %s\n", codec_model.Auth, username, password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
 func (c *CommunicationService) registerNode(nodeConfig *network.NodeConfig) error {
 	ctx, cancel := context.WithTimeout(context.Background(), utils.DEFAULT_CTX_TIMEOUT)
 	defer cancel()
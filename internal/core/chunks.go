@@ -0,0 +1,89 @@
+package core
+
+import (
+	"strconv"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/middleware"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+)
+
+// Values over the request size limit of the node move in chunks:
+//
+//	SETCHUNK <key> <offset> <chunk>   length of the value after the write
+//	GETRANGE <key> <start> <end>      bytes start to end of the value, both included
+//	STRLEN <key>                      length of the value
+//
+// An upload starts at offset 0, which replaces the value, and every chunk
+// after it goes at the current end of the value. A chunk for any other offset
+// is refused with the length of the value, so an interrupted upload resumes
+// from there. Each chunk is logged and replicated as an APPEND of its own
+// bytes, the value is never written to the WAL as a whole. The storage keeps
+// the chunks as segments of the value rather than copying it on every chunk,
+// and GETRANGE and STRLEN read the segments without putting the value
+// together. GETRANGE takes negative offsets from the end of the value, like
+// redis.
+
+func (c *CoreService) setChunk(nodeConfig *network.NodeConfig, cmd *codec_model.Command) ([]byte, error) {
+	if len(cmd.Args) != 3 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: SETCHUNK <key> <offset> <chunk>")
+	}
+	key, chunk := cmd.Args[0], cmd.Args[2]
+	offset, err := strconv.Atoi(cmd.Args[1])
+	if err != nil || offset < 0 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "offset must be a non-negative integer")
+	}
+
+	var length int
+	var writes []wal.LogEntry
+	_, err = c.storageLayer.Exec(nil, func(tx *middleware.Tx) error {
+		current, ok, err := tx.Length(key)
+		if err != nil {
+			return err
+		}
+		entry := wal.LogEntry{Operation: wal.SET, Key: key, Value: chunk}
+		if offset > 0 {
+			if !ok || offset != current {
+				return utils.NewError(utils.ERROR_GENERIC, "chunk offset %d does not match the value length %d", offset, current)
+			}
+			entry.Operation = wal.APPEND
+		}
+		writes = []wal.LogEntry{entry}
+		length = offset + len(chunk)
+		return tx.ApplyBatch(writes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.replicateBatch(nodeConfig, writes)
+	return []byte(strconv.Itoa(length)), nil
+}
+
+func (c *CoreService) getRange(cmd *codec_model.Command) ([]byte, error) {
+	if len(cmd.Args) != 3 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: GETRANGE <key> <start> <end>")
+	}
+	start, err1 := strconv.Atoi(cmd.Args[1])
+	end, err2 := strconv.Atoi(cmd.Args[2])
+	if err1 != nil || err2 != nil {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "start and end must be integers")
+	}
+	value, err := c.storageLayer.GetRange(cmd.Args[0], start, end)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+func (c *CoreService) strlen(cmd *codec_model.Command) ([]byte, error) {
+	if len(cmd.Args) != 1 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: STRLEN <key>")
+	}
+	length, err := c.storageLayer.Length(cmd.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.Itoa(length)), nil
+}
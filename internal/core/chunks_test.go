@@ -0,0 +1,74 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	wal "github.com/sk25469/kv/internal/persistence"
+)
+
+func TestSetChunkUploadsAndResumes(t *testing.T) {
+	tc := newTestCore(t)
+
+	for _, step := range []struct{ command, want string }{
+		{"SETCHUNK big 0 hello", "5"},
+		{"SETCHUNK big 5 _wor", "9"},
+		// a chunk sent again after a lost reply is refused with the length
+		// to resume from
+		{"SETCHUNK big 5 _wor", "ERROR ERR chunk offset 5 does not match the value length 9"},
+		{"SETCHUNK big 12 ld", "ERROR ERR chunk offset 12 does not match the value length 9"},
+		{"SETCHUNK big 9 ld", "11"},
+		{"SETCHUNK new 3 abc", "ERROR ERR chunk offset 3 does not match the value length 0"},
+		{"SETCHUNK big -1 x", "ERROR SYNTAX offset must be a non-negative integer"},
+		{"GET big", "hello_world"},
+		{"STRLEN big", "11"},
+	} {
+		if got := tc.run(nil, step.command); got != step.want {
+			t.Errorf("%s = %q, want %q", step.command, got, step.want)
+		}
+	}
+
+	// offset 0 starts over
+	if got := tc.run(nil, "SETCHUNK big 0 new"); got != "3" {
+		t.Fatalf("SETCHUNK at 0 = %q", got)
+	}
+	if got := tc.run(nil, "GET big"); got != "new" {
+		t.Errorf("GET after a new upload = %q", got)
+	}
+
+	// the WAL holds the chunks, never the whole value
+	var ops []string
+	for _, entry := range tc.logged() {
+		for _, e := range append([]wal.LogEntry{entry}, entry.Entries...) {
+			if e.Key == "big" {
+				ops = append(ops, string(e.Operation)+" "+e.Value)
+			}
+		}
+	}
+	if got := strings.Join(ops, ","); got != "SET hello,APPEND _wor,APPEND ld,SET new" {
+		t.Errorf("logged %s", got)
+	}
+}
+
+func TestGetRangeAndStrLen(t *testing.T) {
+	tc := newTestCore(t)
+	tc.run(nil, "SET s 0123456789")
+
+	for _, step := range []struct{ command, want string }{
+		{"GETRANGE s 0 3", "0123"},
+		{"GETRANGE s 8 100", "89"},
+		{"GETRANGE s -3 -1", "789"},
+		{"GETRANGE s -100 1", "01"},
+		{"GETRANGE s 0 -1", "0123456789"},
+		{"GETRANGE s 5 2", ""},
+		{"GETRANGE s 20 30", ""},
+		{"GETRANGE s a 1", "ERROR SYNTAX start and end must be integers"},
+		{"STRLEN s", "10"},
+		{"STRLEN missing", "ERROR NOTFOUND key not found"},
+		{"GETRANGE missing 0 1", "ERROR NOTFOUND key not found"},
+	} {
+		if got := tc.run(nil, step.command); got != step.want {
+			t.Errorf("%s = %q, want %q", step.command, got, step.want)
+		}
+	}
+}
@@ -1,12 +1,20 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
 	codec_model "github.com/sk25469/kv/internal/codec/model"
 	"github.com/sk25469/kv/internal/comm"
 	"github.com/sk25469/kv/internal/middleware"
 	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
 	"github.com/sk25469/kv/internal/replication"
 	"github.com/sk25469/kv/logger"
+	"github.com/sk25469/kv/utils"
 )
 
 var log = logger.NewPackageLogger("core")
@@ -25,6 +33,7 @@ type CoreService struct {
 	storageLayer       *middleware.StorageMiddleware
 	communicationLayer *comm.CommunicationService
 	replicationLayer   *replication.ReplicationService
+	scripts            *scriptCache
 }
 
 func NewCoreService(params CoreServiceParams) *CoreService {
@@ -32,20 +41,51 @@ func NewCoreService(params CoreServiceParams) *CoreService {
 		storageLayer:       params.StorageLayer,
 		communicationLayer: params.CommunicationLayer.(*comm.CommunicationService),
 		replicationLayer:   params.ReplicationLayer.(*replication.ReplicationService),
+		scripts:            newScriptCache(),
 	}
 }
 
 func (c *CoreService) RunCommand(data interface{}, nodeConfig *network.NodeConfig) ([]byte, error) {
+	return c.RunSessionCommand(data, nodeConfig, nil)
+}
+
+// RunCommandContext runs a command unless ctx is done first. A command that
+// started is not interrupted, its writes are applied as a whole or not at all.
+func (c *CoreService) RunCommandContext(ctx context.Context, data interface{}, nodeConfig *network.NodeConfig) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.RunSessionCommand(data, nodeConfig, nil)
+}
+
+// RunSessionCommand runs a command on behalf of a client connection. Without
+// a session, commands that need per-client state are rejected.
+func (c *CoreService) RunSessionCommand(data interface{}, nodeConfig *network.NodeConfig, session *Session) ([]byte, error) {
+	if cmd, ok := data.(*codec_model.Command); ok && cmd != nil {
+		if err := checkArity(cmd); err != nil {
+			return nil, err
+		}
+		if session != nil {
+			if res, handled, err := c.runSessionCommand(cmd, nodeConfig, session); handled {
+				return res, err
+			}
+		} else if isSessionCommand(cmd.Type) {
+			return nil, utils.NewError(utils.ERROR_GENERIC, "%s needs a client session", cmd.Name)
+		}
+	}
+
 	switch v := data.(type) {
 	case *codec_model.Command:
-		cmdInBytes := v.Decode()
+		if v == nil {
+			return nil, utils.NewError(utils.ERROR_SYNTAX, "empty command")
+		}
 		switch v.Type {
 		case codec_model.Set:
 			err := c.storageLayer.Set(v.Key, v.Value)
 			if err != nil {
 				return nil, err
 			}
-			c.replicationLayer.ReplicateData(nodeConfig, v.ID.String(), cmdInBytes)
+			c.replicationLayer.ReplicateData(nodeConfig, v.ID.String(), replicationData(v))
 			return []byte("write successfull"), nil
 		case codec_model.Get:
 			res, err := c.storageLayer.Get(v.Key)
@@ -54,13 +94,57 @@ func (c *CoreService) RunCommand(data interface{}, nodeConfig *network.NodeConfi
 			}
 			return []byte(res), nil
 		case codec_model.Delete:
-			err := c.storageLayer.Delete(v.Key)
+			existed, err := c.storageLayer.Delete(v.Key)
 			if err != nil {
 				return nil, err
 			}
-			c.replicationLayer.ReplicateData(nodeConfig, v.ID.String(), cmdInBytes)
+			if !existed {
+				return []byte("nothing to delete"), nil
+			}
+			c.replicationLayer.ReplicateData(nodeConfig, v.ID.String(), replicationData(v))
 
 			return []byte("delete successfull"), nil
+		case codec_model.MGet:
+			return c.mget(v)
+		case codec_model.MSet, codec_model.MDel:
+			return c.runMultiKeyWrite(nodeConfig, v)
+		case codec_model.Batch:
+			// a BATCH is a WAL record replicated from another node and may
+			// hold raw APPEND entries, clients write through the commands
+			if session == nil || !session.peer {
+				return nil, utils.NewError(utils.ERROR_NOAUTH, "BATCH is only accepted from other nodes")
+			}
+			var writes []wal.LogEntry
+			if err := json.Unmarshal([]byte(v.Value), &writes); err != nil {
+				return nil, utils.NewError(utils.ERROR_SYNTAX, "decoding batch: %v", err)
+			}
+			if err := c.ApplyBatch(nodeConfig, writes); err != nil {
+				return nil, err
+			}
+			return []byte("batch successfull"), nil
+		case codec_model.Scan:
+			return c.scan(v)
+		case codec_model.SetChunk:
+			return c.setChunk(nodeConfig, v)
+		case codec_model.GetRange:
+			return c.getRange(v)
+		case codec_model.StrLen:
+			return c.strlen(v)
+		case codec_model.Eval, codec_model.EvalSha:
+			return c.eval(nodeConfig, v)
+		case codec_model.Script:
+			return c.script(v)
+		case codec_model.Backup:
+			if len(v.Args) != 1 {
+				return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: BACKUP <name>")
+			}
+			manifest, err := c.storageLayer.Backup(v.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			return []byte(fmt.Sprintf("backup %s written at sequence %d", v.Args[0], manifest.Sequence)), nil
+		default:
+			return nil, utils.NewError(utils.ERROR_UNKNOWN, "unknown command: %s", v.Name)
 		}
 	case *codec_model.CommunicationModel:
 		switch v.Command {
@@ -71,3 +155,132 @@ func (c *CoreService) RunCommand(data interface{}, nodeConfig *network.NodeConfi
 	}
 	return nil, nil
 }
+
+// checkArity refuses SET, GET and DEL with other arguments than their own,
+// rather than run them with the key or value taken from the wrong ones.
+func checkArity(cmd *codec_model.Command) error {
+	switch cmd.Type {
+	case codec_model.Set:
+		if len(cmd.Args) != 2 {
+			return utils.NewError(utils.ERROR_SYNTAX, "usage: SET <key> <value>")
+		}
+	case codec_model.Get:
+		if len(cmd.Args) != 1 {
+			return utils.NewError(utils.ERROR_SYNTAX, "usage: GET <key>")
+		}
+	case codec_model.Delete:
+		if len(cmd.Args) != 1 {
+			return utils.NewError(utils.ERROR_SYNTAX, "usage: DEL <key>")
+		}
+	}
+	return nil
+}
+
+// ScanResult is the reply to SCAN. Next is set when more keys are left and
+// is passed as AFTER to get them.
+type ScanResult struct {
+	Entries []middleware.KeyValue `json:"entries"`
+	Next    string                `json:"next,omitempty"`
+}
+
+// scan runs SCAN [MATCH <prefix>] [AFTER <key>] [COUNT <n>] and returns the
+// result as JSON.
+func (c *CoreService) scan(cmd *codec_model.Command) ([]byte, error) {
+	var prefix, after string
+	count := utils.SCAN_DEFAULT_COUNT
+	for i := 0; i < len(cmd.Args); i += 2 {
+		if i+1 >= len(cmd.Args) {
+			return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: SCAN [MATCH <prefix>] [AFTER <key>] [COUNT <n>]")
+		}
+		value := cmd.Args[i+1]
+		switch strings.ToUpper(cmd.Args[i]) {
+		case "MATCH":
+			prefix = value
+		case "AFTER":
+			after = value
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, utils.NewError(utils.ERROR_SYNTAX, "invalid count: %s", value)
+			}
+			count = n
+		default:
+			return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: SCAN [MATCH <prefix>] [AFTER <key>] [COUNT <n>]")
+		}
+	}
+
+	entries, more, err := c.storageLayer.Scan(prefix, after, count)
+	if err != nil {
+		return nil, err
+	}
+	result := ScanResult{Entries: entries}
+	if more {
+		result.Next = entries[len(entries)-1].Key
+	}
+	return json.Marshal(result)
+}
+
+// ApplyBatch writes the batch to the WAL as one record, applies it and
+// replicates it as a single BATCH command.
+func (c *CoreService) ApplyBatch(nodeConfig *network.NodeConfig, writes []wal.LogEntry) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	if err := c.storageLayer.ApplyBatch(writes); err != nil {
+		return err
+	}
+	c.replicateBatch(nodeConfig, writes)
+	return nil
+}
+
+// replicateBatch sends the writes to the replicas as a single BATCH command.
+func (c *CoreService) replicateBatch(nodeConfig *network.NodeConfig, writes []wal.LogEntry) {
+	if len(writes) == 0 {
+		return
+	}
+	batch, err := batchCommand(writes)
+	if err != nil {
+		log.Errorf("error encoding batch for replication: %v", err)
+		return
+	}
+	c.replicationLayer.ReplicateData(nodeConfig, batch.ID.String(), batch.Decode())
+}
+
+// batchCommand is the BATCH command carrying the writes.
+func batchCommand(writes []wal.LogEntry) (*codec_model.Command, error) {
+	data, err := json.Marshal(writes)
+	if err != nil {
+		return nil, err
+	}
+	return (&codec_model.Command{}).Encode("BATCH " + string(data)), nil
+}
+
+// replicationData is the command line sent to the replicas for a write. The
+// text protocol splits on whitespace, so a write whose key or value holds
+// any goes out as a BATCH, which carries it as JSON.
+func replicationData(cmd *codec_model.Command) []byte {
+	if cmd.Type == codec_model.Batch || !strings.ContainsAny(cmd.Key+cmd.Value, " \t\r\n") {
+		return cmd.Decode()
+	}
+
+	entry := wal.LogEntry{Operation: wal.SET, Key: cmd.Key, Value: cmd.Value}
+	if cmd.Type == codec_model.Delete {
+		entry = wal.LogEntry{Operation: wal.DELETE, Key: cmd.Key}
+	}
+	data, err := json.Marshal([]wal.LogEntry{entry})
+	if err != nil {
+		return cmd.Decode()
+	}
+	return []byte("BATCH " + string(data) + "\n")
+}
+
+// LastSequence returns the WAL sequence of the last write.
+func (c *CoreService) LastSequence() uint64 {
+	return c.storageLayer.LastSequence()
+}
+
+// StreamChanges delivers every SET, DELETE and BATCH applied after the given WAL
+// sequence, in order, until ctx is done or fn returns an error.
+func (c *CoreService) StreamChanges(ctx context.Context, from uint64, fn func(wal.LogEntry) error) error {
+	return c.storageLayer.Stream(ctx, from, fn)
+}
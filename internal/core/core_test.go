@@ -0,0 +1,181 @@
+package core_test
+
+import (
+	"testing"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/comm"
+	"github.com/sk25469/kv/internal/core"
+	"github.com/sk25469/kv/internal/middleware"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/internal/replication"
+	"github.com/sk25469/kv/internal/storage"
+	"github.com/sk25469/kv/utils"
+)
+
+type testCore struct {
+	t       *testing.T
+	core    *core.CoreService
+	storage *middleware.StorageMiddleware
+	dataDir string
+	config  *network.NodeConfig
+}
+
+func newTestCore(t *testing.T) *testCore {
+	t.Helper()
+	dataDir := t.TempDir()
+	sm, err := middleware.NewStorageMiddleware(storage.NewInMemoryHashMap(), dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Recover(wal.RecoveryTarget{}); err != nil {
+		t.Fatal(err)
+	}
+	cs := comm.NewCommunicationService(comm.CommunicationServiceParams{})
+	rs := replication.NewReplicationService(replication.ReplicationServiceParams{CommunicationLayer: cs})
+	return &testCore{
+		t:       t,
+		core:    core.NewCoreService(core.CoreServiceParams{StorageLayer: sm, CommunicationLayer: cs, ReplicationLayer: rs}),
+		storage: sm,
+		dataDir: dataDir,
+		config:  &network.NodeConfig{ID: "test"},
+	}
+}
+
+// run runs the command line and returns the reply, or the error as it is
+// sent to clients.
+func (tc *testCore) run(session *core.Session, line string) string {
+	tc.t.Helper()
+	res, err := tc.core.RunSessionCommand((&codec_model.Command{}).Encode(line), tc.config, session)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	return string(res)
+}
+
+// logged closes the storage and returns the WAL entries written so far.
+func (tc *testCore) logged() []wal.LogEntry {
+	tc.t.Helper()
+	if err := tc.storage.Close(); err != nil {
+		tc.t.Fatal(err)
+	}
+	w, err := wal.NewFileWAL(tc.dataDir)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	defer w.Close()
+	_, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return entries
+}
+
+func TestExecLogsQueuedWritesAsOneBatch(t *testing.T) {
+	tc := newTestCore(t)
+	session := core.NewSession()
+	tc.run(session, "SET b 2")
+
+	for _, line := range []string{"MULTI", "SET a 1", "GET a", "DEL b", "GET b", "MSET c 3 d 4", "MDEL c x"} {
+		want := "QUEUED"
+		if line == "MULTI" {
+			want = "OK"
+		}
+		if reply := tc.run(session, line); reply != want {
+			t.Fatalf("%s replied %q", line, reply)
+		}
+	}
+	reply := tc.run(session, "EXEC")
+	want := `["write successfull","1","delete successfull","` + utils.FormatError(storage.ErrKeyNotFound) + `","OK","1"]`
+	if reply != want {
+		t.Fatalf("EXEC replied %s, want %s", reply, want)
+	}
+	for key, want := range map[string]string{"a": "1", "d": "4"} {
+		if reply := tc.run(nil, "GET "+key); reply != want {
+			t.Errorf("GET %s replied %q, want %q", key, reply, want)
+		}
+	}
+
+	entries := tc.logged()
+	if len(entries) != 2 || entries[1].Operation != wal.BATCH {
+		t.Fatalf("expected the SET and one BATCH entry, got %+v", entries)
+	}
+	batch := entries[1].Entries
+	if len(batch) != 5 || batch[0].Key != "a" || batch[1].Operation != wal.DELETE || batch[4].Key != "c" || batch[4].Operation != wal.DELETE {
+		t.Fatalf("unexpected batch: %+v", batch)
+	}
+}
+
+func TestExecAbortsWhenWatchedKeyChanges(t *testing.T) {
+	tc := newTestCore(t)
+	session, other := core.NewSession(), core.NewSession()
+
+	tc.run(session, "WATCH a")
+	tc.run(other, "SET a 1")
+	tc.run(session, "MULTI")
+	tc.run(session, "SET a 2")
+	tc.run(session, "SET b 2")
+	if reply := tc.run(session, "EXEC"); reply != utils.NIL_REPLY {
+		t.Fatalf("EXEC replied %q after a watched key changed", reply)
+	}
+	if reply := tc.run(nil, "GET a"); reply != "1" {
+		t.Errorf("GET a replied %q", reply)
+	}
+	if entries := tc.logged(); len(entries) != 1 {
+		t.Errorf("expected only the SET of the other client logged, got %+v", entries)
+	}
+}
+
+func TestBatchIsOnlyAcceptedFromPeers(t *testing.T) {
+	tc := newTestCore(t)
+	batch := `BATCH [{"operation":"APPEND","key":"a","value":"x"}]`
+
+	for _, session := range []*core.Session{nil, core.NewSession()} {
+		if reply := tc.run(session, batch); reply != utils.FormatError(utils.NewError(utils.ERROR_NOAUTH, "BATCH is only accepted from other nodes")) {
+			t.Errorf("a client's BATCH replied %q", reply)
+		}
+	}
+	if reply := tc.run(nil, "GET a"); reply == "x" {
+		t.Fatal("a client's BATCH was applied")
+	}
+
+	peer := core.NewSession()
+	peer.SetPeer(true)
+	if reply := tc.run(peer, batch); reply != "batch successfull" {
+		t.Fatalf("a peer's BATCH replied %q", reply)
+	}
+	if reply := tc.run(nil, "GET a"); reply != "x" {
+		t.Errorf("GET a replied %q after the peer's BATCH", reply)
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	tc := newTestCore(t)
+	session := core.NewSession()
+	tc.run(nil, "SET a 0")
+
+	for _, line := range []string{"BEGIN", "SET a 1", "SAVEPOINT first", "SET a 2", "DEL b", "SET c 3", "ROLLBACK to first"} {
+		if reply := tc.run(session, line); reply != "OK" {
+			t.Fatalf("%s replied %q", line, reply)
+		}
+	}
+	if reply := tc.run(session, "GET a"); reply != "1" {
+		t.Errorf("GET a replied %q after rolling back to the savepoint", reply)
+	}
+	if reply := tc.run(session, "GET c"); reply != utils.FormatError(storage.ErrKeyNotFound) {
+		t.Errorf("GET c replied %q after rolling back to the savepoint", reply)
+	}
+	if reply := tc.run(session, "RELEASE first"); reply != "OK" {
+		t.Fatalf("RELEASE replied %q", reply)
+	}
+	if reply := tc.run(session, "ROLLBACK TO first"); reply == "OK" {
+		t.Error("rolled back to a released savepoint")
+	}
+	if reply := tc.run(session, "COMMIT"); reply != "OK" {
+		t.Fatalf("COMMIT replied %q", reply)
+	}
+	if reply := tc.run(nil, "GET a"); reply != "1" {
+		t.Errorf("GET a replied %q after COMMIT", reply)
+	}
+}
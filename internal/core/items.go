@@ -0,0 +1,61 @@
+package core
+
+import (
+	"github.com/sk25469/kv/internal/middleware"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+)
+
+// ItemUpdate is the write UpdateItem applies to a key.
+type ItemUpdate struct {
+	Delete bool // delete the key, Value and Meta are ignored
+	Value  string
+	Meta   wal.KeyMeta
+}
+
+// GetItems returns the keys that exist with their flags, expiry and version.
+func (c *CoreService) GetItems(keys []string) (map[string]middleware.Item, error) {
+	return c.storageLayer.Items(keys)
+}
+
+// UpdateItem passes the current item of the key, or nil if it does not
+// exist, to fn with writes blocked and applies the update fn returns, if
+// any. It is how compare-and-set style commands run atomically. The version
+// of the key after the update is returned.
+func (c *CoreService) UpdateItem(nodeConfig *network.NodeConfig, key string, fn func(item *middleware.Item) (*ItemUpdate, error)) (uint64, error) {
+	var version uint64
+	var writes []wal.LogEntry
+	_, err := c.storageLayer.Exec(nil, func(tx *middleware.Tx) error {
+		item, ok, err := tx.Item(key)
+		if err != nil {
+			return err
+		}
+		current := &item
+		if !ok {
+			current = nil
+		}
+
+		update, err := fn(current)
+		if err != nil || update == nil {
+			version = tx.Version(key)
+			return err
+		}
+
+		entry := wal.LogEntry{Operation: wal.SET, Key: key, Value: update.Value, KeyMeta: update.Meta}
+		if update.Delete {
+			entry = wal.LogEntry{Operation: wal.DELETE, Key: key}
+		}
+		writes = []wal.LogEntry{entry}
+		if err := tx.ApplyBatch(writes); err != nil {
+			return err
+		}
+		version = tx.Version(key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// a BATCH carries the metadata to the replicas
+	c.replicateBatch(nodeConfig, writes)
+	return version, nil
+}
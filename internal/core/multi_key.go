@@ -0,0 +1,107 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/middleware"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/internal/storage"
+	"github.com/sk25469/kv/utils"
+)
+
+// Multi-key commands save a round trip per key:
+//
+//	MGET <key> [key...]                 JSON array of values, null for missing keys
+//	MSET <key> <value> [key value...]   OK
+//	MDEL <key> [key...]                 number of keys deleted
+//
+// MSET and MDEL are written to the WAL as one BATCH entry, so they are
+// applied and replicated atomically.
+
+func (c *CoreService) mget(cmd *codec_model.Command) ([]byte, error) {
+	if len(cmd.Args) == 0 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: MGET <key> [key...]")
+	}
+	values, err := c.storageLayer.GetMany(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mgetResult(cmd.Args, values))
+}
+
+// mgetResult lines the values up with the keys, nil for the missing ones.
+func mgetResult(keys []string, values map[string]string) []*string {
+	result := make([]*string, len(keys))
+	for i, key := range keys {
+		if value, ok := values[key]; ok {
+			result[i] = &value
+		}
+	}
+	return result
+}
+
+func (c *CoreService) runMultiKeyWrite(nodeConfig *network.NodeConfig, cmd *codec_model.Command) ([]byte, error) {
+	var result []byte
+	var writes []wal.LogEntry
+	_, err := c.storageLayer.Exec(nil, func(tx *middleware.Tx) error {
+		var err error
+		if result, writes, err = multiKeyWrites(tx, cmd); err != nil || len(writes) == 0 {
+			return err
+		}
+		return tx.ApplyBatch(writes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.replicateBatch(nodeConfig, writes)
+	return result, nil
+}
+
+// keyReader reads the keys an MDEL deletes, from the storage or through the
+// writes of a MULTI block.
+type keyReader interface {
+	Get(key string) (string, error)
+}
+
+// multiKeyWrites returns the reply of an MSET or MDEL and the writes to
+// apply as one batch.
+func multiKeyWrites(reader keyReader, cmd *codec_model.Command) ([]byte, []wal.LogEntry, error) {
+	switch cmd.Type {
+	case codec_model.MSet:
+		if len(cmd.Args) == 0 || len(cmd.Args)%2 != 0 {
+			return nil, nil, utils.NewError(utils.ERROR_SYNTAX, "usage: MSET <key> <value> [key value...]")
+		}
+		writes := make([]wal.LogEntry, 0, len(cmd.Args)/2)
+		for i := 0; i < len(cmd.Args); i += 2 {
+			writes = append(writes, wal.LogEntry{Operation: wal.SET, Key: cmd.Args[i], Value: cmd.Args[i+1]})
+		}
+		return []byte("OK"), writes, nil
+	case codec_model.MDel:
+		if len(cmd.Args) == 0 {
+			return nil, nil, utils.NewError(utils.ERROR_SYNTAX, "usage: MDEL <key> [key...]")
+		}
+		// only keys that exist are deleted and counted, each once
+		var writes []wal.LogEntry
+		seen := make(map[string]bool, len(cmd.Args))
+		for _, key := range cmd.Args {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			_, err := reader.Get(key)
+			if errors.Is(err, storage.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			writes = append(writes, wal.LogEntry{Operation: wal.DELETE, Key: key})
+		}
+		return []byte(strconv.Itoa(len(writes))), writes, nil
+	}
+	return nil, nil, utils.NewError(utils.ERROR_UNKNOWN, "unknown command: %s", cmd.Name)
+}
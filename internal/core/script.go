@@ -0,0 +1,423 @@
+package core
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/middleware"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/internal/storage"
+	"github.com/sk25469/kv/utils"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Scripts are Lua, run atomically against the storage:
+//
+//	EVAL <script> <numkeys> [key...] [arg...]     result of the script
+//	EVALSHA <sha1> <numkeys> [key...] [arg...]    same, for a loaded script
+//	SCRIPT LOAD <script>                          sha1 of the script
+//	SCRIPT EXISTS <sha1> [sha1...]                JSON array of 1 and 0
+//	SCRIPT FLUSH                                  OK
+//
+// On the text protocol a script holding spaces is sent as a JSON string:
+//
+//	EVAL "local n = kv.incr(KEYS[1]) if n > tonumber(ARGV[1]) then kv.del(KEYS[1]) end return n" 1 hits 10
+//
+// The keys and arguments are in the KEYS and ARGV tables, and the storage is
+// reached through kv.get(key), kv.set(key, value), kv.del(key) and
+// kv.incr(key [, by]). Nothing else outside the script is reachable: there
+// is no io, os or loading of code. Writes are buffered while the script runs
+// and then go to the WAL as one BATCH entry, so a script that fails, or runs
+// out of time or memory, leaves the storage as it was.
+//
+// The storage is locked while a script runs, reads wait as well as writes, so
+// scripts get SCRIPT_TIMEOUT at most. Besides the size of the Lua stacks, the
+// strings string.rep builds and the bytes a script writes, a script is stopped
+// once SCRIPT_MAX_ALLOC bytes were allocated while it runs. Go only counts
+// allocations for the whole process, so the budget covers whatever else the
+// node allocates meanwhile, and is checked every SCRIPT_ALLOC_CHECK: a single
+// allocation may overshoot it before the script stops.
+
+const (
+	SCRIPT_TIMEOUT         = 5 * time.Second
+	SCRIPT_CALL_STACK_SIZE = 200
+	SCRIPT_REGISTRY_SIZE   = 1024
+	SCRIPT_REGISTRY_MAX    = 256 * 1024
+	SCRIPT_MAX_STRING      = 1024 * 1024      // longest string string.rep builds
+	SCRIPT_MAX_WRITES      = 16 * 1024 * 1024 // bytes of keys and values a script may write
+	SCRIPT_MAX_ALLOC       = 128 * 1024 * 1024
+	SCRIPT_ALLOC_CHECK     = time.Millisecond
+)
+
+// scriptCache holds the compiled scripts by sha1, for EVALSHA.
+type scriptCache struct {
+	mu      sync.RWMutex
+	scripts map[string]*lua.FunctionProto
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{scripts: make(map[string]*lua.FunctionProto)}
+}
+
+// load compiles the script and caches it. It returns the sha1 of the script.
+func (sc *scriptCache) load(source string) (string, *lua.FunctionProto, error) {
+	sum := sha1.Sum([]byte(source))
+	sha := hex.EncodeToString(sum[:])
+	if proto, ok := sc.get(sha); ok {
+		return sha, proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(source), "script")
+	if err != nil {
+		return "", nil, utils.NewError(utils.ERROR_SYNTAX, "compiling script: %v", err)
+	}
+	proto, err := lua.Compile(chunk, "script")
+	if err != nil {
+		return "", nil, utils.NewError(utils.ERROR_SYNTAX, "compiling script: %v", err)
+	}
+	sc.mu.Lock()
+	sc.scripts[sha] = proto
+	sc.mu.Unlock()
+	return sha, proto, nil
+}
+
+func (sc *scriptCache) get(sha string) (*lua.FunctionProto, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	proto, ok := sc.scripts[strings.ToLower(sha)]
+	return proto, ok
+}
+
+func (sc *scriptCache) flush() {
+	sc.mu.Lock()
+	sc.scripts = make(map[string]*lua.FunctionProto)
+	sc.mu.Unlock()
+}
+
+func (c *CoreService) eval(nodeConfig *network.NodeConfig, cmd *codec_model.Command) ([]byte, error) {
+	if len(cmd.Args) < 2 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: %s <script> <numkeys> [key...] [arg...]", cmd.Name)
+	}
+
+	var proto *lua.FunctionProto
+	if cmd.Type == codec_model.EvalSha {
+		var ok bool
+		if proto, ok = c.scripts.get(cmd.Args[0]); !ok {
+			return nil, utils.NewError(utils.ERROR_NOSCRIPT, "no script with sha1 %s, load it with SCRIPT LOAD", cmd.Args[0])
+		}
+	} else {
+		var err error
+		if _, proto, err = c.scripts.load(cmd.Args[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	numKeys, err := strconv.Atoi(cmd.Args[1])
+	if err != nil || numKeys < 0 || numKeys > len(cmd.Args)-2 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "numkeys must be between 0 and the number of arguments")
+	}
+	keys, args := cmd.Args[2:2+numKeys], cmd.Args[2+numKeys:]
+
+	var result string
+	var writes []wal.LogEntry
+	_, err = c.storageLayer.Exec(nil, func(tx *middleware.Tx) error {
+		run := &scriptRun{overlayTx: newOverlayTx(tx)}
+		var err error
+		if result, err = run.call(proto, keys, args); err != nil {
+			return err
+		}
+		writes = run.writes
+		if len(writes) == 0 {
+			return nil
+		}
+		return tx.ApplyBatch(writes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.replicateBatch(nodeConfig, writes)
+	return []byte(result), nil
+}
+
+func (c *CoreService) script(cmd *codec_model.Command) ([]byte, error) {
+	if len(cmd.Args) == 0 {
+		return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: SCRIPT LOAD <script> | EXISTS <sha1> [sha1...] | FLUSH")
+	}
+	switch strings.ToUpper(cmd.Args[0]) {
+	case "LOAD":
+		if len(cmd.Args) != 2 {
+			return nil, utils.NewError(utils.ERROR_SYNTAX, "usage: SCRIPT LOAD <script>")
+		}
+		sha, _, err := c.scripts.load(cmd.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return []byte(sha), nil
+	case "EXISTS":
+		exists := make([]int, len(cmd.Args)-1)
+		for i, sha := range cmd.Args[1:] {
+			if _, ok := c.scripts.get(sha); ok {
+				exists[i] = 1
+			}
+		}
+		return json.Marshal(exists)
+	case "FLUSH":
+		c.scripts.flush()
+		return []byte("OK"), nil
+	}
+	return nil, utils.NewError(utils.ERROR_SYNTAX, "unknown SCRIPT subcommand: %s", cmd.Args[0])
+}
+
+// scriptRun is a single run of a script. Its writes are buffered so the
+// script reads what it wrote.
+type scriptRun struct {
+	*overlayTx
+	writeBytes int
+	err        error // error of the storage API that stopped the script
+}
+
+func (r *scriptRun) call(proto *lua.FunctionProto, keys, args []string) (string, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       SCRIPT_CALL_STACK_SIZE,
+		RegistrySize:        SCRIPT_REGISTRY_SIZE,
+		RegistryMaxSize:     SCRIPT_REGISTRY_MAX,
+		MinimizeStackMemory: true,
+	})
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), SCRIPT_TIMEOUT)
+	defer cancel()
+	L.SetContext(ctx)
+	var tooLarge atomic.Bool
+	go watchAllocs(ctx, cancel, &tooLarge)
+
+	openScriptLibs(L)
+	L.SetGlobal("KEYS", stringTable(L, keys))
+	L.SetGlobal("ARGV", stringTable(L, args))
+	L.SetGlobal("kv", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":  r.get,
+		"set":  r.set,
+		"del":  r.del,
+		"incr": r.incr,
+	}))
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		switch {
+		case r.err != nil:
+			return "", r.err
+		case tooLarge.Load():
+			return "", utils.NewError(utils.ERROR_TOOLARGE, "script allocated more than %d bytes", SCRIPT_MAX_ALLOC)
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return "", utils.NewError(utils.ERROR_TIMEOUT, "script ran for more than %v", SCRIPT_TIMEOUT)
+		}
+		// the message alone, the stack trace would span lines
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) && apiErr.Object != nil {
+			return "", utils.NewError(utils.ERROR_GENERIC, "script failed: %s", apiErr.Object.String())
+		}
+		return "", utils.NewError(utils.ERROR_GENERIC, "script failed: %v", err)
+	}
+	return scriptResult(L.Get(-1))
+}
+
+// watchAllocs cancels the script once the process allocated more than
+// SCRIPT_MAX_ALLOC bytes since it started, and sets tooLarge. It returns when
+// ctx is done.
+func watchAllocs(ctx context.Context, cancel context.CancelFunc, tooLarge *atomic.Bool) {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	start := sample[0].Value.Uint64()
+
+	ticker := time.NewTicker(SCRIPT_ALLOC_CHECK)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metrics.Read(sample)
+			if sample[0].Value.Uint64()-start > SCRIPT_MAX_ALLOC {
+				tooLarge.Store(true)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// openScriptLibs opens the libraries scripts may use, without the functions
+// that reach outside the script.
+func openScriptLibs(L *lua.LState) {
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "print", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	str := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	rep := str.RawGetString("rep")
+	L.SetField(str, "rep", L.NewFunction(func(L *lua.LState) int {
+		if len(L.CheckString(1))*max(L.CheckInt(2), 0) > SCRIPT_MAX_STRING {
+			L.RaiseError("string.rep: result longer than %d bytes", SCRIPT_MAX_STRING)
+		}
+		L.Insert(rep, 1)
+		L.Call(L.GetTop()-1, 1)
+		return 1
+	}))
+}
+
+func stringTable(L *lua.LState, values []string) *lua.LTable {
+	table := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		table.Append(lua.LString(value))
+	}
+	return table
+}
+
+// read returns the value of the key as the script sees it.
+func (r *scriptRun) read(key string) (string, bool, error) {
+	value, err := r.Get(key)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (r *scriptRun) write(L *lua.LState, entry wal.LogEntry) {
+	r.writeBytes += len(entry.Key) + len(entry.Value)
+	if r.writeBytes > SCRIPT_MAX_WRITES {
+		r.fail(L, utils.NewError(utils.ERROR_TOOLARGE, "script wrote more than %d bytes", SCRIPT_MAX_WRITES))
+	}
+	r.overlayTx.write(entry)
+}
+
+// fail stops the script with an error of the storage API.
+func (r *scriptRun) fail(L *lua.LState, err error) {
+	r.err = err
+	L.RaiseError("%v", err)
+}
+
+func (r *scriptRun) get(L *lua.LState) int {
+	value, ok, err := r.read(L.CheckString(1))
+	if err != nil {
+		r.fail(L, err)
+	}
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(value))
+	return 1
+}
+
+func (r *scriptRun) set(L *lua.LState) int {
+	key := L.CheckString(1)
+	value := L.CheckString(2)
+	r.write(L, wal.LogEntry{Operation: wal.SET, Key: key, Value: value})
+	return 0
+}
+
+// del deletes the key and returns whether it existed.
+func (r *scriptRun) del(L *lua.LState) int {
+	key := L.CheckString(1)
+	_, ok, err := r.read(key)
+	if err != nil {
+		r.fail(L, err)
+	}
+	if ok {
+		r.write(L, wal.LogEntry{Operation: wal.DELETE, Key: key})
+	}
+	L.Push(lua.LBool(ok))
+	return 1
+}
+
+// incr adds to the integer value of the key, 0 if it does not exist, and
+// returns the result.
+func (r *scriptRun) incr(L *lua.LState) int {
+	key := L.CheckString(1)
+	by := int64(L.OptInt(2, 1))
+	value, ok, err := r.read(key)
+	if err != nil {
+		r.fail(L, err)
+	}
+	var n int64
+	if ok {
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			r.fail(L, utils.NewError(utils.ERROR_WRONGTYPE, "value of %s is not an integer", key))
+		}
+	}
+	n += by
+	r.write(L, wal.LogEntry{Operation: wal.SET, Key: key, Value: strconv.FormatInt(n, 10)})
+	L.Push(lua.LNumber(n))
+	return 1
+}
+
+// scriptResult turns the value a script returned into the reply: strings and
+// numbers as they are, nil and false as the nil reply, true as 1 and tables
+// as JSON arrays of their elements.
+func scriptResult(value lua.LValue) (string, error) {
+	switch v := value.(type) {
+	case *lua.LTable:
+		elems := make([]interface{}, 0, v.Len())
+		for i := 1; i <= v.Len(); i++ {
+			elems = append(elems, scriptValue(v.RawGetInt(i)))
+		}
+		data, err := json.Marshal(elems)
+		return string(data), err
+	}
+	switch v := scriptValue(value).(type) {
+	case nil:
+		return utils.NIL_REPLY, nil
+	case string:
+		return v, nil
+	default:
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+}
+
+// scriptValue converts a Lua value to its JSON form.
+func scriptValue(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		if f := float64(v); f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f)
+		}
+		return float64(v)
+	case lua.LBool:
+		if v {
+			return 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sk25469/kv/internal/core"
+)
+
+func TestScriptErrorLeavesTheStorageAsItWas(t *testing.T) {
+	tc := newTestCore(t)
+	session := core.NewSession()
+	tc.run(session, "SET a 1")
+
+	if got := tc.run(session, `EVAL "kv.set(KEYS[1], '2') kv.set('b', '3') error('stop')" 1 a`); !strings.HasPrefix(got, "ERROR ERR") {
+		t.Fatalf("failing script replied %q", got)
+	}
+	if got := tc.run(session, "GET a"); got != "1" {
+		t.Errorf("a is %q after the failed script, want 1", got)
+	}
+	if got := tc.run(session, "GET b"); got != "ERROR NOTFOUND key not found" {
+		t.Errorf("b is %q after the failed script", got)
+	}
+	if entries := tc.logged(); len(entries) != 1 {
+		t.Errorf("logged %d entries, want only the SET", len(entries))
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	tc := newTestCore(t)
+	session := core.NewSession()
+
+	for _, tt := range []struct{ name, script, want string }{
+		{"writes", `local v = string.rep('x', 1024 * 1024) for i = 1, 20 do kv.set('k' .. i, v) end`, "ERROR TOOLARGE"},
+		{"string.rep", `return string.rep('x', 2 * 1024 * 1024)`, "ERROR ERR"},
+		{"memory", `local s = 'x' for i = 1, 40 do s = s .. s end return #s`, "ERROR TOOLARGE"},
+		{"tables", `local t = {} for i = 1, 1e9 do t[i] = i end`, "ERROR TOOLARGE"},
+	} {
+		if got := tc.run(session, `EVAL "`+tt.script+`" 0`); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: replied %q, want %s", tt.name, got, tt.want)
+		}
+	}
+	if got := tc.run(session, "GET k1"); got != "ERROR NOTFOUND key not found" {
+		t.Errorf("k1 is set after the script went over the write cap")
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	tc := newTestCore(t)
+	session := core.NewSession()
+
+	if got := tc.run(session, `EVAL "kv.set('a', '1') while true do end" 0`); !strings.HasPrefix(got, "ERROR TIMEOUT") {
+		t.Fatalf("endless script replied %q", got)
+	}
+	if got := tc.run(session, "GET a"); got != "ERROR NOTFOUND key not found" {
+		t.Errorf("a is %q after the script timed out", got)
+	}
+}
+
+func TestScriptSandbox(t *testing.T) {
+	tc := newTestCore(t)
+	session := core.NewSession()
+
+	for _, script := range []string{
+		`return load('return 1')()`,
+		`return require('os')`,
+		`return dofile('/etc/passwd')`,
+		`return io.open('/etc/passwd')`,
+		`return os.execute('true')`,
+		`return string.dump(function() end)`,
+	} {
+		if got := tc.run(session, `EVAL "`+script+`" 0`); !strings.HasPrefix(got, "ERROR") {
+			t.Errorf("%s replied %q", script, got)
+		}
+	}
+}
+
+func TestEvalSha(t *testing.T) {
+	tc := newTestCore(t)
+	session := core.NewSession()
+
+	sha := tc.run(session, `SCRIPT LOAD "return ARGV[1] .. KEYS[1]"`)
+	if len(sha) != 40 {
+		t.Fatalf("SCRIPT LOAD replied %q", sha)
+	}
+	if got := tc.run(session, "EVALSHA "+sha+" 1 b a"); got != "ab" {
+		t.Errorf("EVALSHA replied %q, want ab", got)
+	}
+	if got := tc.run(session, "SCRIPT FLUSH"); got != "OK" {
+		t.Errorf("SCRIPT FLUSH replied %q", got)
+	}
+	if got := tc.run(session, "EVALSHA "+sha+" 1 b a"); !strings.HasPrefix(got, "ERROR NOSCRIPT") {
+		t.Errorf("EVALSHA after SCRIPT FLUSH replied %q", got)
+	}
+}
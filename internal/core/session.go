@@ -0,0 +1,368 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/middleware"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/internal/storage"
+	"github.com/sk25469/kv/utils"
+)
+
+// Session holds the state of a single client connection: the keys it
+// watches, the commands queued after MULTI and the writes buffered after
+// BEGIN.
+type Session struct {
+	name       string // set with HELLO SETNAME
+	watched    map[string]uint64
+	queue      []*codec_model.Command
+	multi      bool
+	writes     []wal.LogEntry
+	savepoints []savepoint
+	inTx       bool
+	peer       bool // the connection comes from another node
+	authed     bool // the client logged in, or needs not to
+}
+
+// savepoint marks how many writes were buffered when it was set.
+type savepoint struct {
+	name   string
+	writes int
+}
+
+func NewSession() *Session {
+	return &Session{}
+}
+
+// Name returns the name the client gave the connection, if any.
+func (s *Session) Name() string {
+	return s.name
+}
+
+func (s *Session) SetName(name string) {
+	s.name = name
+}
+
+// SetPeer marks the connection as coming from another node of the cluster,
+// which may send the BATCH records replication carries.
+func (s *Session) SetPeer(peer bool) {
+	s.peer = peer
+}
+
+// Authenticated reports whether the session may run commands.
+func (s *Session) Authenticated() bool {
+	return s.authed
+}
+
+// SetAuthenticated lets the session run commands, once the client logged in
+// or when the node has no credentials.
+func (s *Session) SetAuthenticated(authed bool) {
+	s.authed = authed
+}
+
+// runSessionCommand handles WATCH, UNWATCH, MULTI, EXEC, DISCARD, BEGIN,
+// COMMIT and ROLLBACK. Every other command is buffered while a transaction is
+// open and queued while a MULTI block is open. It reports whether
+// the command was handled.
+func (c *CoreService) runSessionCommand(cmd *codec_model.Command, nodeConfig *network.NodeConfig, session *Session) ([]byte, bool, error) {
+	switch cmd.Type {
+	case codec_model.Watch:
+		if session.multi {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "WATCH inside MULTI is not allowed")
+		}
+		if len(cmd.Args) == 0 {
+			return nil, true, utils.NewError(utils.ERROR_SYNTAX, "usage: WATCH <key> [key...]")
+		}
+		if session.watched == nil {
+			session.watched = make(map[string]uint64)
+		}
+		for _, key := range cmd.Args {
+			// keep the first version seen if the key is watched twice
+			if _, ok := session.watched[key]; !ok {
+				session.watched[key] = c.storageLayer.Version(key)
+			}
+		}
+		return []byte("OK"), true, nil
+	case codec_model.Unwatch:
+		session.watched = nil
+		return []byte("OK"), true, nil
+	case codec_model.Multi:
+		if session.multi {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "MULTI calls can not be nested")
+		}
+		if session.inTx {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "MULTI inside a transaction is not allowed")
+		}
+		session.multi = true
+		session.queue = nil
+		return []byte("OK"), true, nil
+	case codec_model.Discard:
+		if !session.multi {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "DISCARD without MULTI")
+		}
+		session.reset()
+		return []byte("OK"), true, nil
+	case codec_model.Exec:
+		if !session.multi {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "EXEC without MULTI")
+		}
+		res, err := c.execQueued(nodeConfig, session)
+		return res, true, err
+	case codec_model.Begin:
+		if session.inTx {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "transaction already started")
+		}
+		if session.multi {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "BEGIN inside MULTI is not allowed")
+		}
+		session.endTransaction()
+		session.inTx = true
+		return []byte("OK"), true, nil
+	case codec_model.Commit:
+		if !session.inTx {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "transaction not started")
+		}
+		writes := session.writes
+		session.endTransaction()
+		if err := c.ApplyBatch(nodeConfig, writes); err != nil {
+			return nil, true, err
+		}
+		return []byte("OK"), true, nil
+	case codec_model.Rollback:
+		if !session.inTx {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "transaction not started")
+		}
+		// ROLLBACK TO <savepoint> keeps the transaction open
+		if len(cmd.Args) > 0 && strings.EqualFold(cmd.Args[0], "TO") {
+			if len(cmd.Args) != 2 {
+				return nil, true, utils.NewError(utils.ERROR_SYNTAX, "usage: ROLLBACK TO <savepoint>")
+			}
+			index, err := session.savepointIndex(cmd.Args[1])
+			if err != nil {
+				return nil, true, err
+			}
+			session.writes = session.writes[:session.savepoints[index].writes]
+			session.savepoints = session.savepoints[:index+1]
+			return []byte("OK"), true, nil
+		}
+		session.endTransaction()
+		return []byte("OK"), true, nil
+	case codec_model.Savepoint:
+		if !session.inTx {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "transaction not started")
+		}
+		if len(cmd.Args) != 1 {
+			return nil, true, utils.NewError(utils.ERROR_SYNTAX, "usage: SAVEPOINT <name>")
+		}
+		session.savepoints = append(session.savepoints, savepoint{name: cmd.Args[0], writes: len(session.writes)})
+		return []byte("OK"), true, nil
+	case codec_model.Release:
+		if !session.inTx {
+			return nil, true, utils.NewError(utils.ERROR_GENERIC, "transaction not started")
+		}
+		if len(cmd.Args) != 1 {
+			return nil, true, utils.NewError(utils.ERROR_SYNTAX, "usage: RELEASE <savepoint>")
+		}
+		index, err := session.savepointIndex(cmd.Args[0])
+		if err != nil {
+			return nil, true, err
+		}
+		// savepoints set after it go away with it
+		session.savepoints = session.savepoints[:index]
+		return []byte("OK"), true, nil
+	}
+
+	if session.inTx {
+		return session.runInTransaction(c, cmd)
+	}
+	if !session.multi {
+		return nil, false, nil
+	}
+	switch cmd.Type {
+	case codec_model.Set, codec_model.Get, codec_model.Delete, codec_model.MGet, codec_model.MSet, codec_model.MDel:
+		session.queue = append(session.queue, cmd)
+		return []byte("QUEUED"), true, nil
+	default:
+		return nil, true, utils.NewError(utils.ERROR_GENERIC, "%s cannot be queued in MULTI", cmd.Name)
+	}
+}
+
+// execQueued runs the queued commands atomically if none of the watched keys
+// changed. Their writes go to the WAL as one BATCH entry and to the replicas
+// as one BATCH command. The results are returned as a JSON array, or
+// NIL_REPLY if the transaction was aborted.
+func (c *CoreService) execQueued(nodeConfig *network.NodeConfig, session *Session) ([]byte, error) {
+	queue, watched := session.queue, session.watched
+	session.reset()
+
+	results := make([]string, 0, len(queue))
+	var writes []wal.LogEntry
+	ok, err := c.storageLayer.Exec(watched, func(tx *middleware.Tx) error {
+		run := newOverlayTx(tx)
+		for _, cmd := range queue {
+			result, err := run.runQueued(cmd)
+			if err != nil {
+				results = append(results, utils.FormatError(err))
+				continue
+			}
+			results = append(results, result)
+		}
+		if writes = run.writes; len(writes) == 0 {
+			return nil
+		}
+		return tx.ApplyBatch(writes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []byte(utils.NIL_REPLY), nil
+	}
+
+	c.replicateBatch(nodeConfig, writes)
+	return json.Marshal(results)
+}
+
+// overlayTx buffers writes on top of a Tx, nil for a deleted key, so the
+// commands after them read what was written before it all goes to the WAL.
+type overlayTx struct {
+	tx      *middleware.Tx
+	overlay map[string]*string
+	writes  []wal.LogEntry
+}
+
+func newOverlayTx(tx *middleware.Tx) *overlayTx {
+	return &overlayTx{tx: tx, overlay: make(map[string]*string)}
+}
+
+// Get returns the value of the key with the buffered writes applied.
+func (o *overlayTx) Get(key string) (string, error) {
+	if value, ok := o.overlay[key]; ok {
+		if value == nil {
+			return "", storage.ErrKeyNotFound
+		}
+		return *value, nil
+	}
+	return o.tx.Get(key)
+}
+
+func (o *overlayTx) write(entry wal.LogEntry) {
+	if entry.Operation == wal.DELETE {
+		o.overlay[entry.Key] = nil
+	} else {
+		value := entry.Value
+		o.overlay[entry.Key] = &value
+	}
+	o.writes = append(o.writes, entry)
+}
+
+// runQueued runs a queued command and returns its result.
+func (o *overlayTx) runQueued(cmd *codec_model.Command) (string, error) {
+	switch cmd.Type {
+	case codec_model.Set:
+		o.write(wal.LogEntry{Operation: wal.SET, Key: cmd.Key, Value: cmd.Value})
+		return "write successfull", nil
+	case codec_model.Get:
+		return o.Get(cmd.Key)
+	case codec_model.Delete:
+		_, err := o.Get(cmd.Key)
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			return "nothing to delete", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		o.write(wal.LogEntry{Operation: wal.DELETE, Key: cmd.Key})
+		return "delete successfull", nil
+	case codec_model.MGet:
+		if len(cmd.Args) == 0 {
+			return "", utils.NewError(utils.ERROR_SYNTAX, "usage: MGET <key> [key...]")
+		}
+		values := make(map[string]string, len(cmd.Args))
+		for _, key := range cmd.Args {
+			if value, err := o.Get(key); err == nil {
+				values[key] = value
+			}
+		}
+		res, err := json.Marshal(mgetResult(cmd.Args, values))
+		return string(res), err
+	case codec_model.MSet, codec_model.MDel:
+		res, writes, err := multiKeyWrites(o, cmd)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range writes {
+			o.write(entry)
+		}
+		return string(res), nil
+	}
+	return "", utils.NewError(utils.ERROR_UNKNOWN, "unknown command: %s", cmd.Name)
+}
+
+// runInTransaction buffers writes until COMMIT and serves reads from the
+// buffered writes before falling back to the storage.
+func (s *Session) runInTransaction(c *CoreService, cmd *codec_model.Command) ([]byte, bool, error) {
+	switch cmd.Type {
+	case codec_model.Set:
+		s.writes = append(s.writes, wal.LogEntry{Operation: wal.SET, Key: cmd.Key, Value: cmd.Value})
+		return []byte("OK"), true, nil
+	case codec_model.Delete:
+		s.writes = append(s.writes, wal.LogEntry{Operation: wal.DELETE, Key: cmd.Key})
+		return []byte("OK"), true, nil
+	case codec_model.Get:
+		for i := len(s.writes) - 1; i >= 0; i-- {
+			if s.writes[i].Key != cmd.Key {
+				continue
+			}
+			if s.writes[i].Operation == wal.DELETE {
+				return nil, true, storage.ErrKeyNotFound
+			}
+			return []byte(s.writes[i].Value), true, nil
+		}
+		res, err := c.storageLayer.Get(cmd.Key)
+		if err != nil {
+			return nil, true, err
+		}
+		return []byte(res), true, nil
+	default:
+		return nil, true, utils.NewError(utils.ERROR_GENERIC, "%s is not allowed in a transaction", cmd.Name)
+	}
+}
+
+func isSessionCommand(cmdType codec_model.CommandType) bool {
+	switch cmdType {
+	case codec_model.Watch, codec_model.Unwatch, codec_model.Multi, codec_model.Exec, codec_model.Discard,
+		codec_model.Begin, codec_model.Commit, codec_model.Rollback, codec_model.Savepoint, codec_model.Release:
+		return true
+	}
+	return false
+}
+
+// savepointIndex returns the position of the most recent savepoint with the
+// given name.
+func (s *Session) savepointIndex(name string) (int, error) {
+	for i := len(s.savepoints) - 1; i >= 0; i-- {
+		if s.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, utils.NewError(utils.ERROR_NOTFOUND, "no such savepoint: %s", name)
+}
+
+// endTransaction drops the buffered writes and savepoints.
+func (s *Session) endTransaction() {
+	s.inTx = false
+	s.writes = nil
+	s.savepoints = nil
+}
+
+// reset ends the MULTI block. An open transaction is left alone.
+func (s *Session) reset() {
+	s.multi = false
+	s.queue = nil
+	s.watched = nil
+}
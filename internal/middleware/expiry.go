@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/internal/storage"
+)
+
+// EXPIRY_INTERVAL is how often expired keys are deleted. Reads hide them as
+// soon as they expire.
+const EXPIRY_INTERVAL = time.Second
+
+// Item is a value with its metadata and version.
+type Item struct {
+	Value   string
+	Meta    wal.KeyMeta
+	Version uint64 // WAL sequence of the last write to the key
+}
+
+// Items returns the keys that exist with their metadata, read together so no
+// write lands in between.
+func (sm *StorageMiddleware) Items(keys []string) (map[string]Item, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	items := make(map[string]Item, len(keys))
+	for _, key := range keys {
+		item, ok, err := sm.item(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			items[key] = item
+		}
+	}
+	return items, nil
+}
+
+// Item returns the key with its metadata and reports whether it exists.
+func (tx *Tx) Item(key string) (Item, bool, error) {
+	return tx.sm.item(key)
+}
+
+// Version returns the WAL sequence of the last write to the key.
+func (tx *Tx) Version(key string) uint64 {
+	return tx.sm.versions[key]
+}
+
+// item reads a key with its metadata. Called with sm.mu held.
+func (sm *StorageMiddleware) item(key string) (Item, bool, error) {
+	value, err := sm.get(key)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return Item{}, false, nil
+	}
+	if err != nil {
+		return Item{}, false, err
+	}
+	return Item{Value: value, Meta: sm.meta[key], Version: sm.versions[key]}, true, nil
+}
+
+// copyMeta returns a copy of the metadata for a snapshot. Called with sm.mu
+// held.
+func (sm *StorageMiddleware) copyMeta() map[string]wal.KeyMeta {
+	meta := make(map[string]wal.KeyMeta, len(sm.meta))
+	for key, m := range sm.meta {
+		meta[key] = m
+	}
+	return meta
+}
+
+// ExpireKeys deletes the keys that expired, as a single BATCH entry so the
+// deletes reach the WAL stream. It returns the deleted keys.
+func (sm *StorageMiddleware) ExpireKeys() ([]string, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.readOnly {
+		return nil, nil
+	}
+	now := time.Now()
+	var keys []string
+	var deletes []wal.LogEntry
+	for key, meta := range sm.meta {
+		if meta.Expired(now) {
+			keys = append(keys, key)
+			deletes = append(deletes, wal.LogEntry{Operation: wal.DELETE, Key: key})
+		}
+	}
+	if len(deletes) == 0 {
+		return nil, nil
+	}
+	return keys, sm.applyBatch(deletes)
+}
+
+func (sm *StorageMiddleware) periodicExpiry() {
+	ticker := time.NewTicker(EXPIRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := sm.ExpireKeys(); err != nil {
+				log.Printf("deleting expired keys failed: %v", err)
+			}
+		case <-sm.stopCheckpoint:
+			return
+		}
+	}
+}
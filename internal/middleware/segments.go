@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sk25469/kv/internal/storage"
+)
+
+// segments are the chunks appended to a key after the value held by the
+// storage. An upload in chunks appends a segment per chunk instead of
+// copying the value into the storage every time, and GETRANGE and STRLEN
+// read the segments as they are. The value is only put together for reads
+// and snapshots of the whole key.
+type segments struct {
+	parts  []string
+	length int // of the parts together
+}
+
+// Length returns the length of the value of the key.
+func (sm *StorageMiddleware) Length(key string) (int, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.length(key)
+}
+
+// Length returns the length of the value of the key and reports whether it
+// exists.
+func (tx *Tx) Length(key string) (int, bool, error) {
+	length, err := tx.sm.length(key)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return 0, false, nil
+	}
+	return length, err == nil, err
+}
+
+// GetRange returns the bytes start to end of the value of the key, both
+// included, copying no more of the value than that. Negative offsets count
+// from the end.
+func (sm *StorageMiddleware) GetRange(key string, start, end int) (string, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	head, err := sm.head(key)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	length := len(head)
+	if seg := sm.segments[key]; seg != nil {
+		parts = seg.parts
+		length += seg.length
+	}
+
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = length + end
+	}
+	end = min(end, length-1)
+	if start > end {
+		return "", nil
+	}
+
+	var b strings.Builder
+	b.Grow(end - start + 1)
+	offset := 0
+	for _, part := range append([]string{head}, parts...) {
+		from, to := max(start-offset, 0), min(end+1-offset, len(part))
+		if from < to {
+			b.WriteString(part[from:to])
+		}
+		offset += len(part)
+		if offset > end {
+			break
+		}
+	}
+	return b.String(), nil
+}
+
+// head reads the part of the value of a key the storage holds, hiding the
+// key once it expired. Called with sm.mu held.
+func (sm *StorageMiddleware) head(key string) (string, error) {
+	if sm.meta[key].Expired(time.Now()) {
+		return "", storage.ErrKeyNotFound
+	}
+	return sm.storage.Get(key)
+}
+
+// length returns the length of the value of a key. Called with sm.mu held.
+func (sm *StorageMiddleware) length(key string) (int, error) {
+	head, err := sm.head(key)
+	if err != nil {
+		return 0, err
+	}
+	if seg := sm.segments[key]; seg != nil {
+		return len(head) + seg.length, nil
+	}
+	return len(head), nil
+}
+
+// join puts the value of a key together from the part the storage holds and
+// the segments appended to it. Called with sm.mu held.
+func (sm *StorageMiddleware) join(key, head string) string {
+	seg := sm.segments[key]
+	if seg == nil {
+		return head
+	}
+	var b strings.Builder
+	b.Grow(len(head) + seg.length)
+	b.WriteString(head)
+	for _, part := range seg.parts {
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// appendSegment appends a chunk to the value of a key, storing it as the
+// value if the key doesn't exist. Called with sm.mu held.
+func (sm *StorageMiddleware) appendSegment(key, chunk string) error {
+	if _, err := sm.storage.Get(key); errors.Is(err, storage.ErrKeyNotFound) {
+		delete(sm.segments, key)
+		return sm.storage.Set(key, chunk)
+	} else if err != nil {
+		return err
+	}
+
+	seg := sm.segments[key]
+	if seg == nil {
+		seg = &segments{}
+		sm.segments[key] = seg
+	}
+	seg.parts = append(seg.parts, chunk)
+	seg.length += len(chunk)
+	return nil
+}
+
+// getAll returns every key with its whole value. Called with sm.mu held.
+func (sm *StorageMiddleware) getAll() (map[string]string, error) {
+	data, err := sm.storage.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for key := range sm.segments {
+		if head, ok := data[key]; ok {
+			data[key] = sm.join(key, head)
+		}
+	}
+	return data, nil
+}
@@ -1,31 +1,317 @@
 package middleware
 
 import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	wal "github.com/sk25469/kv/internal/persistence"
 	"github.com/sk25469/kv/internal/storage"
+	"github.com/sk25469/kv/utils"
 )
 
+// ErrReadOnly is returned for writes on a node recovered to a point in time.
+var ErrReadOnly = utils.NewError(utils.ERROR_READONLY, "node is read-only")
+
 type StorageMiddleware struct {
-	storage storage.IStorage
-	wal     wal.WAL
+	storage        storage.IStorage
+	wal            wal.WAL
+	mu             sync.RWMutex  // keeps WAL order and storage order in step
+	checkpointMu   sync.Mutex    // serializes checkpoints
+	stopCheckpoint chan struct{} // closed to stop the background checkpoints and expiry
+	readOnly       bool
+	versions       map[string]uint64      // WAL sequence of the last write to each key
+	meta           map[string]wal.KeyMeta // flags and expiry of the keys that have any
+	segments       map[string]*segments   // chunks appended to the keys after their stored values
 }
 
-func NewStorageMiddleware(storage storage.IStorage, walPath string) (*StorageMiddleware, error) {
-	w, err := wal.NewFileWAL(walPath)
+func NewStorageMiddleware(storage storage.IStorage, dataDir string) (*StorageMiddleware, error) {
+	// checkpoints snapshot what GetAll returns and truncate the WAL behind
+	// it, a storage that can't list its contents would lose everything
+	if _, err := storage.GetAll(); err != nil {
+		return nil, fmt.Errorf("storage can't list its contents: %v", err)
+	}
+
+	w, err := wal.NewFileWAL(dataDir)
 	if err != nil {
 		return nil, err
 	}
+	return newStorageMiddleware(storage, w), nil
+}
 
+// NewReadOnlyStorageMiddleware opens the log in dataDir without writing to
+// it, for recovering to a point in time. Every write is refused.
+func NewReadOnlyStorageMiddleware(storage storage.IStorage, dataDir string) (*StorageMiddleware, error) {
+	w, err := wal.NewReadOnlyFileWAL(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	sm := newStorageMiddleware(storage, w)
+	sm.readOnly = true
+	return sm, nil
+}
+
+func newStorageMiddleware(storage storage.IStorage, w wal.WAL) *StorageMiddleware {
 	return &StorageMiddleware{
-		storage: storage,
-		wal:     w,
-	}, nil
+		storage:        storage,
+		wal:            w,
+		stopCheckpoint: make(chan struct{}),
+		versions:       make(map[string]uint64),
+		meta:           make(map[string]wal.KeyMeta),
+		segments:       make(map[string]*segments),
+	}
 }
 
 func (sm *StorageMiddleware) Set(key string, value string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.set(key, value)
+}
+
+func (sm *StorageMiddleware) Get(key string) (string, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.get(key)
+}
+
+// get reads a key, hiding it once it expired. Called with sm.mu held.
+func (sm *StorageMiddleware) get(key string) (string, error) {
+	head, err := sm.head(key)
+	if err != nil {
+		return "", err
+	}
+	return sm.join(key, head), nil
+}
+
+// GetMany returns the values of the keys that exist, read together so no
+// write lands in between.
+func (sm *StorageMiddleware) GetMany(keys []string) (map[string]string, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := sm.get(key)
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Delete deletes the key and reports whether it existed. Nothing is logged
+// for a key that doesn't.
+func (sm *StorageMiddleware) Delete(key string) (bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, err := sm.get(key); errors.Is(err, storage.ErrKeyNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, sm.delete(key)
+}
+
+// KeyValue is a key and its value, as returned by Scan.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Scan returns up to limit pairs whose key starts with prefix and sorts
+// after the given key, in key order. It reports whether more are left.
+// Storages that keep their keys in order are read from the first key
+// returned; the others are read whole, keeping only the first limit pairs.
+func (sm *StorageMiddleware) Scan(prefix, after string, limit int) ([]KeyValue, bool, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	now := time.Now()
+	page := newScanPage(limit)
+	match := func(key, value string) {
+		if strings.HasPrefix(key, prefix) && key > after && !sm.meta[key].Expired(now) {
+			page.add(KeyValue{Key: key, Value: sm.join(key, value)})
+		}
+	}
+
+	if ranger, ok := sm.storage.(storage.IRangeStorage); ok {
+		from := max(prefix, after)
+		err := ranger.Range(from, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				// past the keys holding the prefix
+				return false
+			}
+			match(key, value)
+			return !page.full()
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		pairs, more := page.pairs()
+		return pairs, more, nil
+	}
+
+	all, err := sm.storage.GetAll()
+	if err != nil {
+		return nil, false, err
+	}
+	for key, value := range all {
+		match(key, value)
+	}
+	pairs, more := page.pairs()
+	return pairs, more, nil
+}
+
+// scanPage keeps the limit+1 smallest pairs it is given, in a max-heap, so
+// a scan over unordered keys sorts no more than the page it returns. The
+// extra pair tells whether more are left. Without a limit it keeps them all.
+type scanPage struct {
+	limit int
+	heap  scanHeap
+}
+
+func newScanPage(limit int) *scanPage {
+	return &scanPage{limit: limit}
+}
+
+// full reports whether the page holds more pairs than it returns, for
+// scans that get the pairs in order and can stop there.
+func (p *scanPage) full() bool {
+	return p.limit > 0 && len(p.heap) > p.limit
+}
+
+func (p *scanPage) add(pair KeyValue) {
+	switch {
+	case p.limit <= 0:
+		p.heap = append(p.heap, pair)
+	case len(p.heap) <= p.limit:
+		heap.Push(&p.heap, pair)
+	case pair.Key < p.heap[0].Key:
+		p.heap[0] = pair
+		heap.Fix(&p.heap, 0)
+	}
+}
+
+// pairs returns the page in key order and whether more pairs are left.
+func (p *scanPage) pairs() ([]KeyValue, bool) {
+	sort.Slice(p.heap, func(i, j int) bool {
+		return p.heap[i].Key < p.heap[j].Key
+	})
+	if p.full() {
+		return p.heap[:p.limit], true
+	}
+	return p.heap, false
+}
+
+// scanHeap is a max-heap of pairs by key.
+type scanHeap []KeyValue
+
+func (h scanHeap) Len() int           { return len(h) }
+func (h scanHeap) Less(i, j int) bool { return h[i].Key > h[j].Key }
+func (h scanHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *scanHeap) Push(x any) {
+	*h = append(*h, x.(KeyValue))
+}
+
+func (h *scanHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// ApplyBatch appends the writes to the WAL as a single BATCH entry and then
+// applies them together, so neither readers nor recovery ever see part of
+// the batch.
+func (sm *StorageMiddleware) ApplyBatch(entries []wal.LogEntry) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.applyBatch(entries)
+}
+
+// applyBatch logs and applies a batch. Called with sm.mu held.
+func (sm *StorageMiddleware) applyBatch(entries []wal.LogEntry) error {
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+
+	for _, entry := range entries {
+		if entry.Operation != wal.SET && entry.Operation != wal.DELETE && entry.Operation != wal.APPEND {
+			return utils.NewError(utils.ERROR_SYNTAX, "unsupported operation in batch: %s", entry.Operation)
+		}
+	}
+
+	batch := wal.LogEntry{
+		Operation: wal.BATCH,
+		Entries:   entries,
+	}
+	if err := sm.wal.AppendLog(batch); err != nil {
+		return err
+	}
+	batch.Sequence = sm.wal.LastSequence()
+
+	return sm.applyEntry(batch)
+}
+
+// Version returns the WAL sequence of the last write to the key, or 0 if it
+// was not written since the node started.
+func (sm *StorageMiddleware) Version(key string) uint64 {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.versions[key]
+}
+
+// Exec runs fn with the storage locked, reads and writes alike, unless one of
+// the watched keys was written since its version was read. It reports
+// whether fn ran.
+func (sm *StorageMiddleware) Exec(watched map[string]uint64, fn func(tx *Tx) error) (bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for key, version := range watched {
+		if sm.versions[key] != version {
+			return false, nil
+		}
+	}
+	return true, fn(&Tx{sm: sm})
+}
+
+// Tx gives access to the storage while Exec holds the lock.
+type Tx struct {
+	sm *StorageMiddleware
+}
+
+func (tx *Tx) Get(key string) (string, error) {
+	return tx.sm.get(key)
+}
+
+// ApplyBatch logs the writes as one BATCH entry and applies them.
+func (tx *Tx) ApplyBatch(entries []wal.LogEntry) error {
+	return tx.sm.applyBatch(entries)
+}
+
+// set appends the write to the WAL and applies it. Called with sm.mu held.
+func (sm *StorageMiddleware) set(key, value string) error {
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+
 	// First append to WAL
 	err := sm.wal.AppendLog(wal.LogEntry{
 		Operation: wal.SET,
@@ -35,16 +321,20 @@ func (sm *StorageMiddleware) Set(key string, value string) error {
 	if err != nil {
 		return err
 	}
+	sm.versions[key] = sm.wal.LastSequence()
+	delete(sm.meta, key)
+	delete(sm.segments, key)
 
 	// Then perform the actual storage operation
 	return sm.storage.Set(key, value)
 }
 
-func (sm *StorageMiddleware) Get(key string) (string, error) {
-	return sm.storage.Get(key)
-}
+// delete appends the delete to the WAL and applies it. Called with sm.mu held.
+func (sm *StorageMiddleware) delete(key string) error {
+	if sm.readOnly {
+		return ErrReadOnly
+	}
 
-func (sm *StorageMiddleware) Delete(key string) error {
 	err := sm.wal.AppendLog(wal.LogEntry{
 		Operation: wal.DELETE,
 		Key:       key,
@@ -52,32 +342,216 @@ func (sm *StorageMiddleware) Delete(key string) error {
 	if err != nil {
 		return err
 	}
+	sm.versions[key] = sm.wal.LastSequence()
+	delete(sm.meta, key)
+	delete(sm.segments, key)
 
 	return sm.storage.Delete(key)
 }
 
-func (sm *StorageMiddleware) Recover() error {
+// Recover loads the newest snapshot, replays the WAL entries written after
+// it and then starts periodic checkpointing. When a target is given, the
+// state is rebuilt as of that point from archived snapshots and segments and
+// the node becomes read-only. Open the log with NewReadOnlyStorageMiddleware
+// for that, NewStorageMiddleware cuts a torn tail off the log as it opens it.
+func (sm *StorageMiddleware) Recover(target wal.RecoveryTarget) error {
 	starTime := time.Now()
 
-	entries, err := sm.wal.Recover()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	snapshot, entries, err := sm.wal.Recover(target)
 	if err != nil {
 		return err
 	}
 
-	for _, entry := range entries {
-		switch entry.Operation {
-		case wal.SET:
-			if err := sm.storage.Set(entry.Key, entry.Value); err != nil {
+	if snapshot != nil {
+		for key, value := range snapshot.Data {
+			if err := sm.storage.Set(key, value); err != nil {
 				return err
 			}
-		case wal.DELETE:
-			if err := sm.storage.Delete(entry.Key); err != nil {
+			sm.versions[key] = snapshot.Sequence
+		}
+		for key, meta := range snapshot.Meta {
+			sm.meta[key] = meta
+		}
+		log.Printf("Loaded snapshot at sequence %d with %d keys", snapshot.Sequence, len(snapshot.Data))
+	}
+
+	for _, entry := range entries {
+		if err := sm.applyEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	if target.IsSet() {
+		sm.readOnly = true
+		var sequence uint64
+		if len(entries) > 0 {
+			sequence = entries[len(entries)-1].Sequence
+		} else if snapshot != nil {
+			sequence = snapshot.Sequence
+		}
+		log.Printf("Recovered %d entries up to sequence %d in %v, node is read-only", len(entries), sequence, time.Since(starTime))
+		return nil
+	}
+
+	log.Printf("Recovered %d entries up to sequence %d in %v", len(entries), sm.wal.LastSequence(), time.Since(starTime))
+
+	go sm.periodicCheckpoint()
+	go sm.periodicExpiry()
+
+	return nil
+}
+
+// Checkpoint writes a snapshot of the storage tagged with the last applied
+// WAL sequence and truncates the segments it covers. Writes are only blocked
+// while the storage is copied and the WAL is rotated.
+func (sm *StorageMiddleware) Checkpoint() error {
+	sm.checkpointMu.Lock()
+	defer sm.checkpointMu.Unlock()
+
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+
+	sm.mu.Lock()
+	startTime := time.Now()
+	data, err := sm.getAll()
+	if err != nil {
+		sm.mu.Unlock()
+		return err
+	}
+	meta := sm.copyMeta()
+	segment, sequence, err := sm.wal.Rotate()
+	sm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = sm.wal.Checkpoint(&wal.Snapshot{
+		Sequence:  sequence,
+		Segment:   segment,
+		CreatedAt: startTime,
+		Data:      data,
+		Meta:      meta,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Checkpoint at sequence %d with %d keys written in %v", sequence, len(data), time.Since(startTime))
+	return nil
+}
+
+// Backup writes a consistent copy of the storage plus the WAL tail written
+// while it was being saved to the backup with the given name, under the
+// backups directory of the data dir. Writes are only blocked while the
+// storage is copied.
+func (sm *StorageMiddleware) Backup(name string) (*wal.BackupManifest, error) {
+	if err := wal.ValidateBackupName(name); err != nil {
+		return nil, err
+	}
+
+	sm.mu.Lock()
+	createdAt := time.Now()
+	data, err := sm.getAll()
+	meta := sm.copyMeta()
+	sequence := sm.wal.LastSequence()
+	sm.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := sm.wal.Backup(name, &wal.Snapshot{
+		Sequence:  sequence,
+		CreatedAt: createdAt,
+		Data:      data,
+		Meta:      meta,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Backup %s written up to sequence %d", name, manifest.Sequence)
+	return manifest, nil
+}
+
+// LastSequence returns the WAL sequence of the last applied write. It is
+// monotonic across restarts and can be used as a global offset.
+func (sm *StorageMiddleware) LastSequence() uint64 {
+	return sm.wal.LastSequence()
+}
+
+// Stream delivers every write with a sequence greater than from, in order,
+// until ctx is done or fn returns an error.
+func (sm *StorageMiddleware) Stream(ctx context.Context, from uint64, fn func(wal.LogEntry) error) error {
+	return sm.wal.Stream(ctx, from, fn)
+}
+
+// IsReadOnly reports whether the node was recovered to a point in time.
+func (sm *StorageMiddleware) IsReadOnly() bool {
+	return sm.readOnly
+}
+
+func (sm *StorageMiddleware) Close() error {
+	close(sm.stopCheckpoint)
+	return sm.wal.Close()
+}
+
+// applyEntry applies a logged entry to the storage and records the key
+// versions. Called with sm.mu held.
+func (sm *StorageMiddleware) applyEntry(entry wal.LogEntry) error {
+	switch entry.Operation {
+	case wal.SET:
+		sm.versions[entry.Key] = entry.Sequence
+		if entry.KeyMeta.IsZero() {
+			delete(sm.meta, entry.Key)
+		} else {
+			sm.meta[entry.Key] = entry.KeyMeta
+		}
+		delete(sm.segments, entry.Key)
+		return sm.storage.Set(entry.Key, entry.Value)
+	case wal.DELETE:
+		sm.versions[entry.Key] = entry.Sequence
+		delete(sm.meta, entry.Key)
+		delete(sm.segments, entry.Key)
+		return sm.storage.Delete(entry.Key)
+	case wal.APPEND:
+		// the flags and expiry of the key stay as they are
+		sm.versions[entry.Key] = entry.Sequence
+		return sm.appendSegment(entry.Key, entry.Value)
+	case wal.BATCH:
+		for _, write := range entry.Entries {
+			write.Sequence = entry.Sequence
+			if err := sm.applyEntry(write); err != nil {
 				return err
 			}
 		}
 	}
+	return nil
+}
 
-	log.Printf("Recovered %d entries in %v", len(entries), time.Since(starTime))
+func (sm *StorageMiddleware) periodicCheckpoint() {
+	ticker := time.NewTicker(wal.CHECKPOINT_INTERVAL)
+	defer ticker.Stop()
 
-	return nil
+	for {
+		select {
+		case <-ticker.C:
+			size, err := sm.wal.Size()
+			if err != nil {
+				continue
+			}
+
+			// Checkpoint once enough WAL has piled up since the last one
+			if size > wal.CHECKPOINT_THRESHOLD {
+				if err := sm.Checkpoint(); err != nil {
+					log.Printf("WAL checkpoint failed: %v", err)
+				}
+			}
+		case <-sm.stopCheckpoint:
+			return
+		}
+	}
 }
@@ -0,0 +1,238 @@
+package middleware_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sk25469/kv/internal/middleware"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/internal/storage"
+	storage_model "github.com/sk25469/kv/internal/storage/model"
+)
+
+func TestCheckpointAndRecoverEveryBackend(t *testing.T) {
+	for _, tc := range []struct {
+		typ       storage_model.StorageType
+		structure storage_model.StorageStructure
+		listable  bool
+	}{
+		{storage_model.InMemory, storage_model.HashMap, true},
+		{storage_model.InMemory, storage_model.BPlusTree, true},
+		{storage_model.FileBase, storage_model.HashMap, true},
+		{storage_model.FileBase, storage_model.BPlusTree, false},
+	} {
+		t.Run(fmt.Sprintf("%s-%s", tc.typ, tc.structure), func(t *testing.T) {
+			dataDir, storageDir := t.TempDir(), t.TempDir()
+			open := func(file string) (*middleware.StorageMiddleware, error) {
+				s, err := storage.NewStorage(storage.StorageServiceParams{
+					Type:      tc.typ,
+					Structure: tc.structure,
+					FilePath:  filepath.Join(storageDir, file),
+					MaxSize:   3, // small nodes, so the tree splits
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return middleware.NewStorageMiddleware(s, dataDir)
+			}
+
+			sm, err := open("first")
+			if !tc.listable {
+				if err == nil {
+					t.Fatal("a storage that can't list its contents was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sm.Recover(wal.RecoveryTarget{}); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]string{}
+			for i := 0; i < 200; i++ {
+				key, value := fmt.Sprintf("key-%03d", (i*37)%200), fmt.Sprint(i)
+				if err := sm.Set(key, value); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = value
+			}
+			for i := 0; i < 200; i += 3 {
+				key := fmt.Sprintf("key-%03d", i)
+				if _, err := sm.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, key)
+			}
+			if err := sm.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			// written after the snapshot, recovered from the WAL
+			for _, key := range []string{"key-000", "key-001", "after"} {
+				if err := sm.Set(key, "late"); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = "late"
+			}
+			if err := sm.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, err := open("second")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer recovered.Close()
+			if err := recovered.Recover(wal.RecoveryTarget{}); err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := recovered.Scan("", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotMap := map[string]string{}
+			for _, pair := range got {
+				gotMap[pair.Key] = pair.Value
+			}
+			if !reflect.DeepEqual(gotMap, want) {
+				t.Fatalf("recovered %d keys, want %d: %v", len(gotMap), len(want), gotMap)
+			}
+			for key, value := range want {
+				if got, err := recovered.Get(key); err != nil || got != value {
+					t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, value)
+				}
+			}
+		})
+	}
+}
+
+func TestScanPagesInKeyOrder(t *testing.T) {
+	for _, structure := range []storage_model.StorageStructure{storage_model.HashMap, storage_model.BPlusTree} {
+		t.Run(string(structure), func(t *testing.T) {
+			s, err := storage.NewStorage(storage.StorageServiceParams{
+				Type:      storage_model.InMemory,
+				Structure: structure,
+				MaxSize:   3,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sm, err := middleware.NewStorageMiddleware(s, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sm.Close()
+			if err := sm.Recover(wal.RecoveryTarget{}); err != nil {
+				t.Fatal(err)
+			}
+
+			var want []string
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("user:%02d", (i*7)%50)
+				if err := sm.Set(key, "v"); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, fmt.Sprintf("user:%02d", i))
+			}
+			for _, key := range []string{"a", "user", "users:1", "zzz"} {
+				if err := sm.Set(key, "other"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			after := ""
+			for {
+				page, more, err := sm.Scan("user:", after, 8)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) > 8 {
+					t.Fatalf("page of %d pairs, limit 8", len(page))
+				}
+				for _, pair := range page {
+					got = append(got, pair.Key)
+				}
+				if !more {
+					break
+				}
+				after = page[len(page)-1].Key
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("scanned %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAppendedChunksReadAsOneValue(t *testing.T) {
+	dataDir := t.TempDir()
+	open := func() *middleware.StorageMiddleware {
+		sm, err := middleware.NewStorageMiddleware(storage.NewInMemoryHashMap(), dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.Recover(wal.RecoveryTarget{}); err != nil {
+			t.Fatal(err)
+		}
+		return sm
+	}
+
+	sm := open()
+	chunks := []wal.LogEntry{{Operation: wal.SET, Key: "big", Value: "0123"}}
+	for _, chunk := range []string{"456", "7", "89"} {
+		chunks = append(chunks, wal.LogEntry{Operation: wal.APPEND, Key: "big", Value: chunk})
+	}
+	for _, entry := range chunks {
+		if err := sm.ApplyBatch([]wal.LogEntry{entry}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if length, err := sm.Length("big"); err != nil || length != 10 {
+		t.Errorf("Length = %d, %v", length, err)
+	}
+	for _, r := range []struct {
+		start, end int
+		want       string
+	}{
+		{0, -1, "0123456789"},
+		{2, 5, "2345"},
+		{7, 7, "7"},
+		{-3, 100, "789"},
+		{6, 2, ""},
+	} {
+		if got, err := sm.GetRange("big", r.start, r.end); err != nil || got != r.want {
+			t.Errorf("GetRange(%d, %d) = %q, %v, want %q", r.start, r.end, got, err, r.want)
+		}
+	}
+	if page, _, err := sm.Scan("big", "", 0); err != nil || len(page) != 1 || page[0].Value != "0123456789" {
+		t.Errorf("Scan = %v, %v", page, err)
+	}
+
+	// a checkpoint and a restart keep the whole value
+	if err := sm.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ApplyBatch([]wal.LogEntry{{Operation: wal.APPEND, Key: "big", Value: "ab"}}); err != nil {
+		t.Fatal(err)
+	}
+	sm.Close()
+
+	sm = open()
+	defer sm.Close()
+	if got, err := sm.Get("big"); err != nil || got != "0123456789ab" {
+		t.Errorf("Get after restart = %q, %v", got, err)
+	}
+
+	// a SET replaces the value with its segments
+	if err := sm.Set("big", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sm.GetRange("big", 0, -1); err != nil || got != "new" {
+		t.Errorf("GetRange after SET = %q, %v", got, err)
+	}
+}
@@ -9,15 +9,27 @@ import (
 
 type ClientConfig struct {
 	ClientID    string
+	Name        string // set with HELLO SETNAME
 	IPAddress   string
 	ConnectTime time.Time
 	ClientState *ClientState
 	Connection  *net.Conn
+	Transaction *TransactionalKeyValueStore // open transaction, nil outside BEGIN/COMMIT
+	Watched     map[WatchedKey]uint64       // key versions recorded by WATCH
+	Queue       []QueuedCommand             // commands queued by MULTI
+}
+
+// QueuedCommand is a command queued between MULTI and EXEC.
+type QueuedCommand struct {
+	Name       string
+	Collection string
+	Args       []string
 }
 
 // state can be 1 of the following:
 // - transactional
 // - active
+// - queuing (between MULTI and EXEC)
 
 type ClientState struct {
 	State           int
@@ -4,20 +4,33 @@ import (
 	"log"
 	"sync"
 	"time"
+
+	"github.com/sk25469/kv/utils"
 )
 
 // CollectionStore represents a collection with a key-value store
 type CollectionStore struct {
 	KeyValueStore *KeyValueStore
+	Prepared      *PreparedStore            // transactions prepared for a two-phase commit
 	collections   map[string]*KeyValueStore // Map to store collections
+	versions      map[WatchedKey]uint64     // version of the last write to each key
+	clock         uint64                    // last version handed out
 	mu            sync.RWMutex              // Mutex for thread-safe access to collections map
 }
 
+// WatchedKey identifies a key watched by a client with WATCH.
+type WatchedKey struct {
+	Collection string
+	Key        string
+}
+
 // NewCollectionStore creates a new CollectionStore instance
 func NewCollectionStore() *CollectionStore {
 	return &CollectionStore{
 		KeyValueStore: NewKeyValueStore(),
+		Prepared:      NewPreparedStore(),
 		collections:   make(map[string]*KeyValueStore),
+		versions:      make(map[WatchedKey]uint64),
 	}
 }
 
@@ -31,6 +44,10 @@ func (cs *CollectionStore) UpdateKeyInCollectionWithTTL(collectionName, key stri
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	cs.updateKeyWithTTL(collectionName, key, ttl)
+}
+
+func (cs *CollectionStore) updateKeyWithTTL(collectionName, key string, ttl time.Duration) {
 	// Check if the collection exists
 	coll, ok := cs.collections[collectionName]
 	if !ok {
@@ -40,6 +57,7 @@ func (cs *CollectionStore) UpdateKeyInCollectionWithTTL(collectionName, key stri
 
 	// Set the key-value pair in the collection
 	coll.UpdateKeyWithTTL(key, ttl)
+	cs.bumpVersion(collectionName, key)
 }
 
 // SetKeyInCollection sets a key-value pair in the specified collection
@@ -47,6 +65,10 @@ func (cs *CollectionStore) SetKeyInCollection(collectionName, key, value string)
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	cs.setKey(collectionName, key, value)
+}
+
+func (cs *CollectionStore) setKey(collectionName, key, value string) {
 	// Check if the collection exists
 	coll, ok := cs.collections[collectionName]
 	if !ok {
@@ -58,6 +80,18 @@ func (cs *CollectionStore) SetKeyInCollection(collectionName, key, value string)
 
 	// Set the key-value pair in the collection
 	coll.Set(key, value)
+	cs.bumpVersion(collectionName, key)
+}
+
+// ApplyTransaction sets all the writes of a committed transaction while
+// holding the store lock, so readers see either none or all of them.
+func (cs *CollectionStore) ApplyTransaction(writes []TransactionWrite) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, write := range writes {
+		cs.setKey(write.Collection, write.Key, write.Value)
+	}
 }
 
 // GetKeyInCollection retrieves the value for a key in the specified collection
@@ -65,11 +99,15 @@ func (cs *CollectionStore) GetKeyInCollection(collectionName, key string) string
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
 
+	return cs.getKey(collectionName, key)
+}
+
+func (cs *CollectionStore) getKey(collectionName, key string) string {
 	// Check if the collection exists
 	coll, ok := cs.collections[collectionName]
 	if !ok {
 		log.Printf("collection with %v not found", collectionName)
-		return "ERROR: collection doesn't exist" // Collection not found
+		return utils.ErrorReply(utils.ERROR_NOTFOUND, "collection doesn't exist") // Collection not found
 	}
 
 	// Get the value from the collection
@@ -81,6 +119,10 @@ func (cs *CollectionStore) DeleteKeyInCollection(collectionName, key string) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	cs.deleteKey(collectionName, key)
+}
+
+func (cs *CollectionStore) deleteKey(collectionName, key string) {
 	// Check if the collection exists
 	coll, ok := cs.collections[collectionName]
 	if !ok {
@@ -89,6 +131,7 @@ func (cs *CollectionStore) DeleteKeyInCollection(collectionName, key string) {
 
 	// Delete the key from the collection
 	coll.Delete(key)
+	cs.bumpVersion(collectionName, key)
 }
 
 // CollectionExists checks if a collection exists
@@ -146,3 +189,54 @@ func (cs *CollectionStore) GetAllKeyValuesInCollection(collectionName string) ma
 
 	return result
 }
+
+// KeyVersion returns the version of the last write to the key, or 0 if it
+// was never written.
+func (cs *CollectionStore) KeyVersion(collectionName, key string) uint64 {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	return cs.versions[WatchedKey{Collection: collectionName, Key: key}]
+}
+
+// Exec runs fn with the store locked, unless one of the watched keys was
+// written since its version was read. It reports whether fn ran.
+func (cs *CollectionStore) Exec(watched map[WatchedKey]uint64, fn func(tx *CollectionTx)) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for key, version := range watched {
+		if cs.versions[key] != version {
+			return false
+		}
+	}
+	fn(&CollectionTx{cs: cs})
+	return true
+}
+
+// CollectionTx gives access to the store while Exec holds its lock.
+type CollectionTx struct {
+	cs *CollectionStore
+}
+
+func (tx *CollectionTx) Set(collectionName, key, value string) {
+	tx.cs.setKey(collectionName, key, value)
+}
+
+func (tx *CollectionTx) Get(collectionName, key string) string {
+	return tx.cs.getKey(collectionName, key)
+}
+
+func (tx *CollectionTx) Delete(collectionName, key string) {
+	tx.cs.deleteKey(collectionName, key)
+}
+
+func (tx *CollectionTx) UpdateTTL(collectionName, key string, ttl time.Duration) {
+	tx.cs.updateKeyWithTTL(collectionName, key, ttl)
+}
+
+// bumpVersion records a write to the key. Called with cs.mu held.
+func (cs *CollectionStore) bumpVersion(collectionName, key string) {
+	cs.clock++
+	cs.versions[WatchedKey{Collection: collectionName, Key: key}] = cs.clock
+}
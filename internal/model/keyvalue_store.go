@@ -4,6 +4,8 @@ import (
 	"log"
 	"sync"
 	"time"
+
+	"github.com/sk25469/kv/utils"
 )
 
 // KeyValueStore represents the in-memory key-value store
@@ -51,7 +53,7 @@ func (kv *KeyValueStore) Get(key string) string {
 	log.Printf("key: %v", key)
 	if _, ok := kv.store[key]; !ok {
 		log.Printf("no value for key: %v", key)
-		return "ERROR: key doesn't exist"
+		return utils.ErrorReply(utils.ERROR_NOTFOUND, "key doesn't exist")
 	}
 	log.Printf("value for key: %v = %v", key, kv.store[key])
 	return kv.store[key].Value
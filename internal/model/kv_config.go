@@ -17,6 +17,7 @@ type Auth struct {
 // KVServer represents the key-value server
 type KVServer struct {
 	Config  *Config
+	Locks   *LockManager // key locks taken with LOCK, released on disconnect
 	auth    *Auth
 	clients map[string]*ClientConfig // Map to store client configurations
 	mu      sync.Mutex               // Mutex for thread-safe access to clients map
@@ -26,6 +27,7 @@ type KVServer struct {
 func NewKVServer(config *Config) *KVServer {
 	return &KVServer{
 		Config:  config,
+		Locks:   NewLockManager(),
 		clients: make(map[string]*ClientConfig),
 		auth: &Auth{
 			Username: config.Username,
@@ -60,6 +62,9 @@ func (s *KVServer) HandleClientDisconnect(clientID string, conn *net.Conn) {
 
 	if _, ok := s.clients[clientID]; ok {
 		delete(s.clients, clientID)
+		if s.Locks != nil {
+			s.Locks.ReleaseAll(clientID)
+		}
 		// fmt.Printf("Client disconnected: ID=%s\n", clientID)
 	}
 }
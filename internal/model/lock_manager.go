@@ -0,0 +1,223 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sk25469/kv/utils"
+)
+
+type LockMode int
+
+const (
+	SharedLock LockMode = iota
+	ExclusiveLock
+)
+
+var (
+	// ErrDeadlock is returned to the client whose lock request would close a
+	// cycle in the wait-for graph. It is chosen as the victim.
+	ErrDeadlock = utils.NewError(utils.ERROR_DEADLOCK, "deadlock detected")
+	// ErrLockTimeout is returned when a lock is not granted in time.
+	ErrLockTimeout = utils.NewError(utils.ERROR_TIMEOUT, "timed out waiting for lock")
+)
+
+// LockManager hands out shared and exclusive locks on keys to clients. A
+// client blocked on a lock is recorded in a wait-for graph, which is checked
+// for cycles before every wait.
+type LockManager struct {
+	locks   map[WatchedKey]*keyLock
+	held    map[string]map[WatchedKey]struct{} // client -> keys it holds
+	waiting map[string]WatchedKey              // client -> key it waits for
+	mu      sync.Mutex
+}
+
+type keyLock struct {
+	exclusive string              // client holding the exclusive lock
+	shared    map[string]struct{} // clients holding a shared lock
+	released  chan struct{}       // closed whenever a holder lets go
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		locks:   make(map[WatchedKey]*keyLock),
+		held:    make(map[string]map[WatchedKey]struct{}),
+		waiting: make(map[string]WatchedKey),
+	}
+}
+
+// Lock blocks until the client holds the key in the given mode, the timeout
+// passes or waiting would deadlock. A shared lock held alone by the client
+// is upgraded in place.
+func (lm *LockManager) Lock(client string, key WatchedKey, mode LockMode, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	lm.mu.Lock()
+	for {
+		lock := lm.lockFor(key)
+		if lock.grantable(client, mode) {
+			lm.grant(client, key, lock, mode)
+			delete(lm.waiting, client)
+			lm.mu.Unlock()
+			return nil
+		}
+
+		lm.waiting[client] = key
+		if lm.waitsFor(client, client, make(map[string]bool)) {
+			delete(lm.waiting, client)
+			lm.mu.Unlock()
+			return ErrDeadlock
+		}
+		released := lock.released
+		lm.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			lm.mu.Lock()
+			delete(lm.waiting, client)
+			lm.mu.Unlock()
+			return ErrLockTimeout
+		}
+		lm.mu.Lock()
+	}
+}
+
+// Unlock releases the client's lock on the key. It reports false if the
+// client did not hold it.
+func (lm *LockManager) Unlock(client string, key WatchedKey) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if _, ok := lm.held[client][key]; !ok {
+		return false
+	}
+	lm.release(client, key)
+	return true
+}
+
+// ReleaseAll releases every lock held by the client.
+func (lm *LockManager) ReleaseAll(client string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for key := range lm.held[client] {
+		lm.release(client, key)
+	}
+	delete(lm.waiting, client)
+}
+
+// LockedByOther reports whether a client other than the given one holds a
+// lock on the key, shared or exclusive, so the client may not write it.
+func (lm *LockManager) LockedByOther(client string, key WatchedKey) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lock, ok := lm.locks[key]
+	if !ok {
+		return false
+	}
+	if lock.exclusive != "" && lock.exclusive != client {
+		return true
+	}
+	for holder := range lock.shared {
+		if holder != client {
+			return true
+		}
+	}
+	return false
+}
+
+func (lm *LockManager) lockFor(key WatchedKey) *keyLock {
+	lock, ok := lm.locks[key]
+	if !ok {
+		lock = &keyLock{shared: make(map[string]struct{}), released: make(chan struct{})}
+		lm.locks[key] = lock
+	}
+	return lock
+}
+
+func (lm *LockManager) grant(client string, key WatchedKey, lock *keyLock, mode LockMode) {
+	if mode == ExclusiveLock {
+		delete(lock.shared, client)
+		lock.exclusive = client
+	} else if lock.exclusive != client {
+		lock.shared[client] = struct{}{}
+	}
+	if lm.held[client] == nil {
+		lm.held[client] = make(map[WatchedKey]struct{})
+	}
+	lm.held[client][key] = struct{}{}
+}
+
+// release drops the client's lock on the key and wakes up its waiters.
+// Called with lm.mu held.
+func (lm *LockManager) release(client string, key WatchedKey) {
+	lock := lm.locks[key]
+	if lock.exclusive == client {
+		lock.exclusive = ""
+	}
+	delete(lock.shared, client)
+	delete(lm.held[client], key)
+	if len(lm.held[client]) == 0 {
+		delete(lm.held, client)
+	}
+
+	close(lock.released)
+	lock.released = make(chan struct{})
+	if lock.exclusive == "" && len(lock.shared) == 0 {
+		delete(lm.locks, key)
+	}
+}
+
+// waitsFor reports whether client, directly or through other waiting
+// clients, waits for a lock held by target. Called with lm.mu held.
+func (lm *LockManager) waitsFor(client, target string, visited map[string]bool) bool {
+	key, ok := lm.waiting[client]
+	if !ok || visited[client] {
+		return false
+	}
+	visited[client] = true
+
+	lock, ok := lm.locks[key]
+	if !ok {
+		// released, the client is about to be granted the lock
+		return false
+	}
+	for _, holder := range lock.holders() {
+		if holder == client {
+			continue
+		}
+		if holder == target || lm.waitsFor(holder, target, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+func (lock *keyLock) grantable(client string, mode LockMode) bool {
+	if lock.exclusive != "" && lock.exclusive != client {
+		return false
+	}
+	if mode == SharedLock {
+		return true
+	}
+	for holder := range lock.shared {
+		if holder != client {
+			return false
+		}
+	}
+	return true
+}
+
+func (lock *keyLock) holders() []string {
+	holders := make([]string, 0, len(lock.shared)+1)
+	if lock.exclusive != "" {
+		holders = append(holders, lock.exclusive)
+	}
+	for holder := range lock.shared {
+		holders = append(holders, holder)
+	}
+	return holders
+}
@@ -0,0 +1,88 @@
+package models_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+func TestLockManager_SharedAndExclusive(t *testing.T) {
+	lm := models.NewLockManager()
+	key := models.WatchedKey{Collection: "c", Key: "k"}
+
+	if err := lm.Lock("a", key, models.SharedLock, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.Lock("b", key, models.SharedLock, time.Second); err != nil {
+		t.Fatalf("shared locks should not conflict: %v", err)
+	}
+	if err := lm.Lock("c", key, models.ExclusiveLock, 20*time.Millisecond); !errors.Is(err, models.ErrLockTimeout) {
+		t.Fatalf("expected a timeout while shared locks are held, got %v", err)
+	}
+
+	// the exclusive lock is granted once the shared holders let go
+	granted := make(chan error)
+	go func() {
+		granted <- lm.Lock("c", key, models.ExclusiveLock, time.Second)
+	}()
+	lm.Unlock("a", key)
+	lm.ReleaseAll("b")
+	if err := <-granted; err != nil {
+		t.Fatal(err)
+	}
+	if !lm.LockedByOther("a", key) {
+		t.Error("expected c to hold the key exclusively")
+	}
+}
+
+func TestLockManager_Deadlock(t *testing.T) {
+	lm := models.NewLockManager()
+	x := models.WatchedKey{Collection: "c", Key: "x"}
+	y := models.WatchedKey{Collection: "c", Key: "y"}
+
+	if err := lm.Lock("a", x, models.ExclusiveLock, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.Lock("b", y, models.ExclusiveLock, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a waits for b
+	granted := make(chan error)
+	go func() {
+		granted <- lm.Lock("a", y, models.ExclusiveLock, 5*time.Second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// b waiting for a would close the cycle, so b is the victim
+	if err := lm.Lock("b", x, models.ExclusiveLock, 5*time.Second); !errors.Is(err, models.ErrDeadlock) {
+		t.Fatalf("expected a deadlock, got %v", err)
+	}
+	lm.ReleaseAll("b")
+	if err := <-granted; err != nil {
+		t.Fatalf("expected a to get the lock once the victim aborted, got %v", err)
+	}
+}
+
+func TestLockManager_SharedLockBlocksOtherWriters(t *testing.T) {
+	lm := models.NewLockManager()
+	key := models.WatchedKey{Collection: "c", Key: "k"}
+
+	if err := lm.Lock("a", key, models.SharedLock, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if lm.LockedByOther("a", key) {
+		t.Error("the only shared holder may write the key")
+	}
+	if !lm.LockedByOther("b", key) {
+		t.Error("a shared lock held by a did not keep b from writing")
+	}
+	if err := lm.Lock("b", key, models.SharedLock, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !lm.LockedByOther("a", key) {
+		t.Error("a may not write a key b holds a shared lock on")
+	}
+}
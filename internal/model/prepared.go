@@ -0,0 +1,99 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/sk25469/kv/utils"
+)
+
+// PreparedStore keeps the transactions a shard prepared for a two-phase
+// commit. The keys of a prepared transaction stay locked until the
+// coordinator commits or aborts it.
+type PreparedStore struct {
+	transactions map[string][]TransactionWrite
+	locks        map[WatchedKey]string // key -> id of the transaction holding it
+	mu           sync.Mutex
+}
+
+func NewPreparedStore() *PreparedStore {
+	return &PreparedStore{
+		transactions: make(map[string][]TransactionWrite),
+		locks:        make(map[WatchedKey]string),
+	}
+}
+
+// Prepare locks the keys of the writes for the transaction. It fails without
+// locking anything if one of the keys is held by another transaction.
+// Preparing the same transaction twice is a no-op.
+func (ps *PreparedStore) Prepare(txID string, writes []TransactionWrite) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, ok := ps.transactions[txID]; ok {
+		return nil
+	}
+	for _, write := range writes {
+		key := WatchedKey{Collection: write.Collection, Key: write.Key}
+		if holder, ok := ps.locks[key]; ok && holder != txID {
+			return utils.NewError(utils.ERROR_LOCKED, "key %s in %s is locked by transaction %s", write.Key, write.Collection, holder)
+		}
+	}
+
+	for _, write := range writes {
+		ps.locks[WatchedKey{Collection: write.Collection, Key: write.Key}] = txID
+	}
+	ps.transactions[txID] = writes
+	return nil
+}
+
+// Writes returns the writes of a prepared transaction.
+func (ps *PreparedStore) Writes(txID string) ([]TransactionWrite, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	writes, ok := ps.transactions[txID]
+	return writes, ok
+}
+
+// Finish releases the locks of the transaction and returns its writes. It
+// reports false if the transaction is not prepared.
+func (ps *PreparedStore) Finish(txID string) ([]TransactionWrite, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	writes, ok := ps.transactions[txID]
+	if !ok {
+		return nil, false
+	}
+	for _, write := range writes {
+		key := WatchedKey{Collection: write.Collection, Key: write.Key}
+		if ps.locks[key] == txID {
+			delete(ps.locks, key)
+		}
+	}
+	delete(ps.transactions, txID)
+	return writes, true
+}
+
+// LockedBy returns the transaction holding the key, if any.
+func (ps *PreparedStore) LockedBy(collectionName, key string) (string, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	txID, ok := ps.locks[WatchedKey{Collection: collectionName, Key: key}]
+	return txID, ok
+}
+
+// InDoubt returns the ids of the transactions prepared but not yet decided.
+func (ps *PreparedStore) InDoubt() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ids := make([]string, 0, len(ps.transactions))
+	for txID := range ps.transactions {
+		ids = append(ids, txID)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -57,6 +57,16 @@ func (ps *PubSub) Publish(topic, message string) {
 
 	if subscribers, ok := ps.topics[topic]; ok {
 		for _, ch := range subscribers {
+			if cap(ch) > 0 {
+				// a Listen channel is sent to in place, so its messages
+				// keep the order they were published in
+				select {
+				case ch <- message:
+				default:
+					log.Printf("Message not sent to listener of %s, its channel is full", topic)
+				}
+				continue
+			}
 			// Non-blocking send in case of slow consumers
 			go func(ch chan string) {
 				select {
@@ -69,3 +79,32 @@ func (ps *PubSub) Publish(topic, message string) {
 		}
 	}
 }
+
+// Listen subscribes a channel to the topic, for subscribers that aren't a
+// connection. Messages arrive in the order they were published and are
+// dropped while the channel is full. cancel removes the subscription, the
+// channel is not closed.
+func (ps *PubSub) Listen(topic string, size int) (<-chan string, func()) {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	ch := make(chan string, max(size, 1))
+	ps.topics[topic] = append(ps.topics[topic], ch)
+
+	cancel := func() {
+		ps.Mutex.Lock()
+		defer ps.Mutex.Unlock()
+
+		subscribers := ps.topics[topic]
+		for i, subscriber := range subscribers {
+			if subscriber == ch {
+				ps.topics[topic] = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(ps.topics[topic]) == 0 {
+			delete(ps.topics, topic)
+		}
+	}
+	return ch, cancel
+}
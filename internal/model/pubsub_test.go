@@ -0,0 +1,40 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+func TestPubSub_ListenReceivesMessagesInOrder(t *testing.T) {
+	ps := models.NewPubSub()
+	messages, cancel := ps.Listen("news", 100)
+	other, cancelOther := ps.Listen("sports", 1)
+	defer cancelOther()
+
+	for i := 0; i < 100; i++ {
+		ps.Publish("news", fmt.Sprint(i))
+	}
+	for i := 0; i < 100; i++ {
+		if got := <-messages; got != fmt.Sprint(i) {
+			t.Fatalf("message %d is %q", i, got)
+		}
+	}
+	if len(other) != 0 {
+		t.Errorf("a listener of another topic got %q", <-other)
+	}
+
+	// a full channel drops messages instead of blocking the publisher
+	ps.Publish("sports", "1")
+	ps.Publish("sports", "2")
+	if got := <-other; got != "1" || len(other) != 0 {
+		t.Errorf("got %q and %d more, want only the first message", got, len(other))
+	}
+
+	cancel()
+	ps.Publish("news", "after")
+	if len(messages) != 0 {
+		t.Errorf("got %q after cancel", <-messages)
+	}
+}
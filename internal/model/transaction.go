@@ -1,21 +1,52 @@
 package models
 
 import (
-	"errors"
-	"fmt"
-	"log"
-	"strings"
+	"sort"
 	"sync"
+
+	"github.com/sk25469/kv/utils"
 )
 
+// TransactionalKeyValueStore buffers the writes of a single client's
+// transaction until it is committed to the CollectionStore or rolled back.
 type TransactionalKeyValueStore struct {
 	data   map[string]*KeyValueStore
 	mutex  sync.Mutex
 	logger *TransactionLogger
 }
 
+// TransactionLogger is the undo log of a transaction. Every write records
+// the value it replaced in the transaction buffer, and savepoints are marked
+// in between, so a rollback to a savepoint undoes the writes after it.
 type TransactionLogger struct {
-	logs []string
+	logs []UndoEntry
+}
+
+// UndoEntry is either a savepoint marker or the undo record of a write.
+type UndoEntry struct {
+	Savepoint  string // name of the savepoint, empty for writes
+	Collection string
+	Key        string
+	PrevValue  string
+	Existed    bool // whether the key was written earlier in the transaction
+}
+
+// savepointIndex returns the position of the most recent savepoint with the
+// given name.
+func (tl *TransactionLogger) savepointIndex(name string) (int, bool) {
+	for i := len(tl.logs) - 1; i >= 0; i-- {
+		if tl.logs[i].Savepoint == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// TransactionWrite is a single buffered write of a transaction.
+type TransactionWrite struct {
+	Collection string
+	Key        string
+	Value      string
 }
 
 func NewTransactionalKeyValueStore() *TransactionalKeyValueStore {
@@ -26,31 +57,56 @@ func NewTransactionalKeyValueStore() *TransactionalKeyValueStore {
 }
 
 func (kv *TransactionalKeyValueStore) BeginTransaction() {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	kv.data = make(map[string]*KeyValueStore)
 	kv.logger.logs = nil // Clear transaction log
 }
 
-func (kv *TransactionalKeyValueStore) ExecTransaction() {
+// ExecTransaction returns the buffered writes and clears the transaction.
+func (kv *TransactionalKeyValueStore) ExecTransaction() []TransactionWrite {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	writes := kv.writes()
+	kv.data = make(map[string]*KeyValueStore)
 	kv.logger.logs = nil // Clear transaction log
+	return writes
 }
 
-func (kv *TransactionalKeyValueStore) RollbackTransaction() {
-	for i := len(kv.logger.logs) - 1; i >= 0; i-- {
-		log := kv.logger.logs[i]
-		parts := kv.parseLog(log)
-		if parts == nil {
-			continue
+// Writes returns the buffered writes, ordered by collection and key.
+func (kv *TransactionalKeyValueStore) Writes() []TransactionWrite {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	return kv.writes()
+}
+
+func (kv *TransactionalKeyValueStore) writes() []TransactionWrite {
+	var writes []TransactionWrite
+	for collection, kvStore := range kv.data {
+		for key, value := range kvStore.store {
+			writes = append(writes, TransactionWrite{Collection: collection, Key: key, Value: value.Value})
 		}
-		collection := parts[1]
-		key := parts[2]
-		prevValue := parts[4]
-		kvStore := kv.data[collection]
-		kvStore.store[key] = NewKeyValue(prevValue)
 	}
-	kv.logger.logs = nil // Clear transaction log
+	sort.Slice(writes, func(i, j int) bool {
+		if writes[i].Collection != writes[j].Collection {
+			return writes[i].Collection < writes[j].Collection
+		}
+		return writes[i].Key < writes[j].Key
+	})
+	return writes
 }
 
-func (kv *TransactionalKeyValueStore) parseLog(log string) []string {
-	return strings.Split(log, " ")
+// RollbackTransaction discards the buffered writes. Nothing reached the
+// CollectionStore, so there is nothing to undo there.
+func (kv *TransactionalKeyValueStore) RollbackTransaction() {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	kv.data = make(map[string]*KeyValueStore)
+	kv.logger.logs = nil // Clear transaction log
 }
 
 func (kv *TransactionalKeyValueStore) Set(collection, key, value string) {
@@ -58,43 +114,92 @@ func (kv *TransactionalKeyValueStore) Set(collection, key, value string) {
 	defer kv.mutex.Unlock()
 
 	/// get the previous value
-	prevKvStore, ok := kv.data[collection]
-	prevValue := ""
-	if ok {
-		log.Printf("prevKvStore: %v", prevKvStore.store)
-		kvStoreMap, ok := prevKvStore.store[key]
-		if ok {
-			prevValue = kvStoreMap.Value
-		}
+	undo := UndoEntry{Collection: collection, Key: key}
+	kvStore, ok := kv.data[collection]
+	if !ok {
+		kvStore = NewKeyValueStore()
+		kv.data[collection] = kvStore
+	} else if prev, ok := kvStore.store[key]; ok {
+		undo.PrevValue = prev.Value
+		undo.Existed = true
 	}
 
 	/// set the new value
-	kvStore, ok := kv.data[collection]
+	kvStore.store[key] = NewKeyValue(value)
+	kv.logger.logs = append(kv.logger.logs, undo)
+}
+
+// Savepoint marks the current state of the transaction under name. A name
+// can be reused, the most recent savepoint wins.
+func (kv *TransactionalKeyValueStore) Savepoint(name string) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	kv.logger.logs = append(kv.logger.logs, UndoEntry{Savepoint: name})
+}
+
+// RollbackToSavepoint undoes every write made after the savepoint, which
+// stays in place and can be rolled back to again.
+func (kv *TransactionalKeyValueStore) RollbackToSavepoint(name string) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	index, ok := kv.logger.savepointIndex(name)
 	if !ok {
-		log.Printf("creating new kvStore for collection: %s", collection)
-		kvStore = NewKeyValueStore()
-		kvStore.store[key] = NewKeyValue(value)
-	} else {
-		kvStore.store[key] = NewKeyValue(value)
+		return utils.NewError(utils.ERROR_NOTFOUND, "no such savepoint: %s", name)
+	}
+
+	for i := len(kv.logger.logs) - 1; i > index; i-- {
+		undo := kv.logger.logs[i]
+		if undo.Savepoint != "" {
+			continue
+		}
+		kvStore := kv.data[undo.Collection]
+		if undo.Existed {
+			kvStore.store[undo.Key] = NewKeyValue(undo.PrevValue)
+		} else {
+			// the key was not written before the savepoint
+			delete(kvStore.store, undo.Key)
+		}
+	}
+	kv.logger.logs = kv.logger.logs[:index+1]
+	return nil
+}
+
+// ReleaseSavepoint removes the savepoint and the ones set after it, keeping
+// their writes.
+func (kv *TransactionalKeyValueStore) ReleaseSavepoint(name string) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	index, ok := kv.logger.savepointIndex(name)
+	if !ok {
+		return utils.NewError(utils.ERROR_NOTFOUND, "no such savepoint: %s", name)
+	}
+
+	logs := kv.logger.logs[:index]
+	for _, undo := range kv.logger.logs[index+1:] {
+		if undo.Savepoint == "" {
+			logs = append(logs, undo)
+		}
 	}
-	kv.data[collection] = kvStore
-	log.Printf("kvStore: %v", kvStore.store)
-	kv.logger.logs = append(kv.logger.logs, fmt.Sprintf("SET %s %s %s %s", collection, key, value, prevValue))
+	kv.logger.logs = logs
+	return nil
 }
 
+// Get returns the value written to the key in this transaction.
 func (kv *TransactionalKeyValueStore) Get(collection, key string) (string, error) {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 
 	colKv, ok := kv.data[collection]
 	if !ok {
-		return "", errors.New("key not found in collection")
+		return "", utils.NewError(utils.ERROR_NOTFOUND, "key not found in collection")
 	}
-	log.Printf("colKv: %v", colKv)
 
 	value, ok := colKv.store[key]
 	if !ok {
-		return "", errors.New("key not found")
+		return "", utils.NewError(utils.ERROR_NOTFOUND, "key not found")
 	}
 	return value.Value, nil
 }
@@ -0,0 +1,81 @@
+package models_test
+
+import (
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+func TestTransaction_RollbackToSavepoint(t *testing.T) {
+	tx := models.NewTransactionalKeyValueStore()
+	tx.Set("users", "amy", "1")
+	tx.Savepoint("first")
+	tx.Set("users", "amy", "2") // existed before the savepoint
+	tx.Set("users", "pat", "1") // did not
+	tx.Set("users", "pat", "2")
+	tx.Savepoint("second")
+	tx.Set("orders", "o1", "x")
+
+	if err := tx.RollbackToSavepoint("second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Get("orders", "o1"); err == nil {
+		t.Error("a write after the savepoint survived the rollback")
+	}
+	if value, _ := tx.Get("users", "pat"); value != "2" {
+		t.Errorf("pat is %q after rolling back to second", value)
+	}
+
+	if err := tx.RollbackToSavepoint("first"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := tx.Get("users", "amy"); value != "1" {
+		t.Errorf("amy is %q, want the value written before the savepoint", value)
+	}
+	if _, err := tx.Get("users", "pat"); err == nil {
+		t.Error("a key first written after the savepoint survived the rollback")
+	}
+
+	// the savepoint stays and can be rolled back to again
+	tx.Set("users", "amy", "3")
+	if err := tx.RollbackToSavepoint("first"); err != nil {
+		t.Fatal(err)
+	}
+	writes := tx.Writes()
+	if len(writes) != 1 || writes[0] != (models.TransactionWrite{Collection: "users", Key: "amy", Value: "1"}) {
+		t.Errorf("unexpected writes: %+v", writes)
+	}
+	if err := tx.RollbackToSavepoint("second"); err == nil {
+		t.Error("a savepoint set after the one rolled back to is still there")
+	}
+}
+
+func TestTransaction_ReleaseSavepoint(t *testing.T) {
+	tx := models.NewTransactionalKeyValueStore()
+	tx.Savepoint("first")
+	tx.Set("users", "amy", "1")
+	tx.Savepoint("second")
+	tx.Set("users", "amy", "2")
+
+	if err := tx.ReleaseSavepoint("second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.RollbackToSavepoint("second"); err == nil {
+		t.Error("a released savepoint can still be rolled back to")
+	}
+	if value, _ := tx.Get("users", "amy"); value != "2" {
+		t.Errorf("releasing a savepoint dropped a write, amy is %q", value)
+	}
+
+	// the writes after the released savepoint are still undone by the one
+	// before it
+	if err := tx.RollbackToSavepoint("first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Get("users", "amy"); err == nil {
+		t.Error("rolling back to the first savepoint kept amy")
+	}
+	if err := tx.ReleaseSavepoint("missing"); err == nil {
+		t.Error("releasing an unknown savepoint succeeded")
+	}
+}
@@ -0,0 +1,187 @@
+package network_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sk25469/kv/internal/codec"
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	network_model "github.com/sk25469/kv/internal/network/model"
+)
+
+// newAuthNode starts a test node with the credentials admin/secret.
+func newAuthNode(t *testing.T) *testNode {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "node.conf")
+	if err := os.WriteFile(file, []byte("username admin\npassword secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return newTestNode(t, network_model.NewNodeConfig(file))
+}
+
+func TestReplicationLogsInToReplicas(t *testing.T) {
+	master, replica := newAuthNode(t), newAuthNode(t)
+	host, port, err := net.SplitHostPort(replica.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.comm.AddNode("replica", &network_model.NodeConfig{ID: "replica", IP: host, Port: port})
+
+	conn, reader := master.dial(t)
+	for _, command := range []string{"AUTH admin secret", "SET a 1"} {
+		if reply := send(t, conn, reader, command); strings.HasPrefix(reply, "ERROR ") {
+			t.Fatalf("%s replied %q", command, reply)
+		}
+	}
+	// a value with a space reaches replicas as a BATCH record
+	conn, reader = master.dial(t)
+	for _, args := range [][]string{{"AUTH", "admin", "secret"}, {"SET", "b", "x y"}} {
+		if _, err := conn.Write([]byte(respCommand(args...))); err != nil {
+			t.Fatal(err)
+		}
+		if reply, err := reader.ReadString('\n'); err != nil || reply != "+OK\r\n" {
+			t.Fatalf("%v replied %q, %v", args, reply, err)
+		}
+	}
+
+	// the messages to replicas are sent in the background
+	conn, reader = replica.dial(t)
+	send(t, conn, reader, "AUTH admin secret")
+	for _, want := range []struct{ key, value string }{{"a", "1"}, {"b", "x y"}} {
+		var got string
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if got = send(t, conn, reader, "GET "+want.key); got == want.value {
+				break
+			}
+		}
+		if got != want.value {
+			t.Errorf("%s on the replica is %q, want %q", want.key, got, want.value)
+		}
+	}
+}
+
+func TestClientsAreNoPeersBeforeLoggingIn(t *testing.T) {
+	node := newAuthNode(t)
+	conn, reader := node.dial(t)
+
+	batch := `BATCH [{"operation":"SET","key":"a","value":"1"}]`
+	if reply := send(t, conn, reader, batch); !strings.HasPrefix(reply, "ERROR NOAUTH ") {
+		t.Errorf("a BATCH from the same host replied %q before logging in", reply)
+	}
+	send(t, conn, reader, "AUTH admin secret")
+	if reply := send(t, conn, reader, batch); strings.HasPrefix(reply, "ERROR ") {
+		t.Errorf("a BATCH replied %q after logging in with the node credentials", reply)
+	}
+}
+
+func TestTextSessionsLogInBeforeRunningCommands(t *testing.T) {
+	node := newAuthNode(t)
+
+	conn, reader := node.dial(t)
+	for _, command := range []string{"GET a", "SET a 1", "MULTI", "AUTH admin", "AUTH admin wrong", "HELLO 1 AUTH admin wrong"} {
+		if reply := send(t, conn, reader, command); !strings.HasPrefix(reply, "ERROR ") {
+			t.Errorf("%s replied %q before logging in", command, reply)
+		}
+	}
+	if reply := send(t, conn, reader, "HELLO 1"); !strings.Contains(reply, `"password"`) {
+		t.Errorf("HELLO replied %q, want the password auth mode", reply)
+	}
+	if reply := send(t, conn, reader, "AUTH admin secret"); reply != "OK" {
+		t.Fatalf("AUTH replied %q", reply)
+	}
+	if reply := send(t, conn, reader, "SET a 1"); strings.HasPrefix(reply, "ERROR ") {
+		t.Errorf("SET replied %q after logging in", reply)
+	}
+
+	// HELLO logs in too, for this connection only
+	conn, reader = node.dial(t)
+	if reply := send(t, conn, reader, "HELLO 1 AUTH admin secret"); strings.HasPrefix(reply, "ERROR ") {
+		t.Fatalf("HELLO AUTH replied %q", reply)
+	}
+	if reply := send(t, conn, reader, "GET a"); reply != "1" {
+		t.Errorf("GET replied %q after HELLO AUTH", reply)
+	}
+	conn, reader = node.dial(t)
+	if reply := send(t, conn, reader, "GET a"); !strings.HasPrefix(reply, "ERROR NOAUTH ") {
+		t.Errorf("GET on a new connection replied %q", reply)
+	}
+}
+
+func TestRESPSessionsLogInBeforeRunningCommands(t *testing.T) {
+	node := newAuthNode(t)
+	conn, reader := node.dial(t)
+	run := func(args ...string) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(respCommand(args...))); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimRight(reply, "\r\n")
+	}
+
+	if reply := run("PING"); reply != "+PONG" {
+		t.Errorf("PING replied %q", reply)
+	}
+	if reply := run("SET", "a", "1"); !strings.HasPrefix(reply, "-NOAUTH ") {
+		t.Errorf("SET replied %q before logging in", reply)
+	}
+	if reply := run("HELLO", "2", "AUTH", "admin", "wrong"); !strings.HasPrefix(reply, "-NOAUTH ") {
+		t.Errorf("HELLO with a wrong password replied %q", reply)
+	}
+	if reply := run("AUTH", "admin", "secret"); reply != "+OK" {
+		t.Fatalf("AUTH replied %q", reply)
+	}
+	if reply := run("SET", "a", "1"); reply != "+OK" {
+		t.Errorf("SET replied %q after logging in", reply)
+	}
+}
+
+func TestBinarySessionsLogInWithHello(t *testing.T) {
+	node := newAuthNode(t)
+	conn, reader := node.dial(t)
+	var requestID uint64
+	run := func(args ...string) *codec_model.Frame {
+		t.Helper()
+		requestID++
+		fields := make([]codec_model.Field, len(args))
+		for i, arg := range args {
+			fields[i] = codec_model.Field{Type: codec_model.FieldString, Data: []byte(arg)}
+		}
+		request := &codec_model.Frame{Opcode: codec_model.OpCommand, RequestID: requestID, Fields: fields}
+		if _, err := conn.Write(codec.MarshalFrame(request)); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := codec.ReadFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	text := func(frame *codec_model.Frame) string {
+		if len(frame.Fields) != 1 {
+			return ""
+		}
+		return string(frame.Fields[0].Data)
+	}
+
+	if reply := run("GET", "a"); reply.Opcode != codec_model.OpError || !strings.HasPrefix(text(reply), "NOAUTH ") {
+		t.Errorf("GET replied %+v before logging in", reply)
+	}
+	if reply := run("HELLO", "1", "AUTH", "admin", "wrong"); reply.Opcode != codec_model.OpError || !strings.HasPrefix(text(reply), "NOAUTH ") {
+		t.Errorf("HELLO with a wrong password replied %+v", reply)
+	}
+	reply := run("HELLO", "1", "AUTH", "admin", "secret")
+	if reply.Opcode != codec_model.OpBulk || !strings.Contains(text(reply), `"binary"`) {
+		t.Fatalf("HELLO replied %+v", reply)
+	}
+	if reply := run("SET", "a", "1"); reply.Opcode == codec_model.OpError {
+		t.Errorf("SET replied %q after HELLO AUTH", text(reply))
+	}
+}
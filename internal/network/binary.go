@@ -0,0 +1,73 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/sk25469/kv/internal/codec"
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// handleBinary serves a connection speaking the binary protocol. Every reply
+// carries the request id of the frame it answers, so clients match replies
+// by id rather than by order.
+func (n *NetworkService) handleBinary(ctx context.Context, conn net.Conn, reader *bufio.Reader) {
+	session := n.newSession(conn)
+
+	for {
+		frame, err := codec.ReadFrameMax(reader, n.nodeConfig.RequestSizeLimit())
+		if err != nil {
+			if errors.Is(err, codec.ErrFrame) || errors.Is(err, utils.ErrTooLarge) {
+				// the stream can't be resynced past a broken header
+				var requestID uint64
+				if frame != nil {
+					requestID = frame.RequestID
+				}
+				n.writeFrame(conn, codec.ReplyFrame(requestID, codec_model.Error(string(utils.ErrorCodeOf(err))+" "+err.Error())))
+			} else if err != io.EOF {
+				log.Println("Error reading from connection:", err)
+			}
+			return
+		}
+
+		var reply codec_model.Reply
+		cmd, err := n.codecLayer.EncodeFrame(frame)
+		switch {
+		case err != nil:
+			reply = codec_model.Error("ERR " + err.Error())
+		case cmd.Name == "PING":
+			reply = codec_model.Status("PONG")
+		case cmd.Type == codec_model.Hello:
+			reply = n.binaryHello(cmd, session)
+		default:
+			reply = n.runTyped(cmd, session)
+		}
+		if err := n.writeFrame(conn, codec.ReplyFrame(frame.RequestID, reply)); err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Context cancelled, closing binary connection")
+			return
+		default:
+		}
+	}
+}
+
+func (n *NetworkService) writeFrame(conn net.Conn, frame *codec_model.Frame) error {
+	data, err := n.codecLayer.Decode(frame)
+	if err != nil {
+		log.Errorf("error decoding frame: %v", err)
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+		return err
+	}
+	return nil
+}
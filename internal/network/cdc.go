@@ -0,0 +1,55 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+)
+
+// streamChanges turns the connection into a change data capture stream.
+// After `CDC FROM <seq>` every SET and DELETE with a greater sequence is
+// written as one JSON line, until the client disconnects or falls behind.
+func (n *NetworkService) streamChanges(cmd *codec_model.Command, conn net.Conn) {
+	defer conn.Close()
+
+	if len(cmd.Args) != 2 || !strings.EqualFold(cmd.Args[0], "FROM") {
+		fmt.Fprintln(conn, utils.ErrorReply(utils.ERROR_SYNTAX, "usage: CDC FROM <sequence>"))
+		return
+	}
+	from, err := strconv.ParseUint(cmd.Args[1], 10, 64)
+	if err != nil {
+		fmt.Fprintln(conn, utils.ErrorReply(utils.ERROR_SYNTAX, "invalid sequence"))
+		return
+	}
+
+	// The connection only carries events from here on, so a read returning
+	// means the client went away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	log.Infof("CDC stream from sequence %d for %v", from, conn.RemoteAddr())
+	err = n.coreLayer.StreamChanges(ctx, from, func(entry wal.LogEntry) error {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("CDC stream for %v stopped: %v", conn.RemoteAddr(), err)
+		fmt.Fprintln(conn, utils.FormatError(err))
+	}
+}
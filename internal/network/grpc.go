@@ -0,0 +1,274 @@
+package network
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sk25469/kv/api/kvpb"
+	"github.com/sk25469/kv/internal/certs"
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/core"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type GRPCServiceParams struct {
+	Port       int
+	NodeConfig *network.NodeConfig
+	CoreLayer  core.ICore
+	Certs      *certs.Store // the listener serves TLS with it when set
+}
+
+// GRPCService serves the KV API of api/kv.proto. A call whose deadline passed
+// or that was cancelled before the core runs it fails with the matching
+// status; once running, a command is not interrupted. Watch stops when its
+// call ends. When the node has credentials, calls authenticate with them in
+// basic auth "authorization" metadata.
+type GRPCService struct {
+	kvpb.UnimplementedKVServer
+	port       int
+	nodeConfig *network.NodeConfig
+	coreLayer  *core.CoreService
+	certs      *certs.Store
+	server     *grpc.Server
+}
+
+func NewGRPCService(params GRPCServiceParams) *GRPCService {
+	g := &GRPCService{
+		port:       params.Port,
+		nodeConfig: params.NodeConfig,
+		coreLayer:  params.CoreLayer.(*core.CoreService),
+		certs:      params.Certs,
+	}
+	g.server = grpc.NewServer(
+		grpc.MaxRecvMsgSize(params.NodeConfig.RequestSizeLimit()),
+		grpc.UnaryInterceptor(g.authUnary),
+		grpc.StreamInterceptor(g.authStream),
+	)
+	kvpb.RegisterKVServer(g.server, g)
+	return g
+}
+
+// Start serves the API until Stop is called.
+func (g *GRPCService) Start() error {
+	listener, err := listen(fmt.Sprintf(":%d", g.port), g.nodeConfig, g.certs, "h2")
+	if err != nil {
+		return err
+	}
+	log.Infof("gRPC server is listening on port %d", g.port)
+	return g.Serve(listener)
+}
+
+// Serve serves the API on the listener until Stop is called.
+func (g *GRPCService) Serve(listener net.Listener) error {
+	return g.server.Serve(listener)
+}
+
+// Stop lets the calls in flight finish and stops the server.
+func (g *GRPCService) Stop() {
+	g.server.GracefulStop()
+}
+
+func (g *GRPCService) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+	res, err := g.coreLayer.RunCommandContext(ctx, codec_model.NewCommand([]string{"GET", req.Key}), g.nodeConfig)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.GetResponse{Value: string(res)}, nil
+}
+
+func (g *GRPCService) Set(ctx context.Context, req *kvpb.SetRequest) (*kvpb.SetResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+	_, err := g.coreLayer.RunCommandContext(ctx, codec_model.NewCommand([]string{"SET", req.Key, req.Value}), g.nodeConfig)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.SetResponse{}, nil
+}
+
+func (g *GRPCService) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+	_, err := g.coreLayer.RunCommandContext(ctx, codec_model.NewCommand([]string{"DEL", req.Key}), g.nodeConfig)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+func (g *GRPCService) Scan(ctx context.Context, req *kvpb.ScanRequest) (*kvpb.ScanResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "negative limit")
+	}
+	args := []string{"SCAN", "MATCH", req.Prefix}
+	if req.After != "" {
+		args = append(args, "AFTER", req.After)
+	}
+	if req.Limit > 0 {
+		args = append(args, "COUNT", strconv.Itoa(int(req.Limit)))
+	}
+
+	res, err := g.coreLayer.RunCommandContext(ctx, codec_model.NewCommand(args), g.nodeConfig)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	var result core.ScanResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		return nil, grpcError(err)
+	}
+
+	entries := make([]*kvpb.KeyValue, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		entries = append(entries, &kvpb.KeyValue{Key: entry.Key, Value: entry.Value})
+	}
+	return &kvpb.ScanResponse{Entries: entries, Next: result.Next}, nil
+}
+
+func (g *GRPCService) Watch(req *kvpb.WatchRequest, stream kvpb.KV_WatchServer) error {
+	from := g.coreLayer.LastSequence()
+	if req.FromSequence != nil {
+		from = *req.FromSequence
+	}
+
+	ctx := stream.Context()
+	err := g.coreLayer.StreamChanges(ctx, from, func(entry wal.LogEntry) error {
+		entries := []wal.LogEntry{entry}
+		if entry.Operation == wal.BATCH {
+			entries = entry.Entries
+		}
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Key, req.Prefix) {
+				continue
+			}
+			event := &kvpb.WatchEvent{Sequence: entry.Sequence, Key: e.Key, Value: e.Value, Operation: kvpb.Operation_OPERATION_SET}
+			switch e.Operation {
+			case wal.DELETE:
+				event.Operation = kvpb.Operation_OPERATION_DELETE
+			case wal.APPEND:
+				event.Operation = kvpb.Operation_OPERATION_APPEND
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+func (g *GRPCService) Batch(ctx context.Context, req *kvpb.BatchRequest) (*kvpb.BatchResponse, error) {
+	if len(req.Writes) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no writes")
+	}
+
+	writes := make([]wal.LogEntry, 0, len(req.Writes))
+	for i, write := range req.Writes {
+		if write.Key == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "write %d: missing key", i)
+		}
+		switch write.Operation {
+		case kvpb.Operation_OPERATION_SET:
+			writes = append(writes, wal.LogEntry{Operation: wal.SET, Key: write.Key, Value: write.Value})
+		case kvpb.Operation_OPERATION_DELETE:
+			writes = append(writes, wal.LogEntry{Operation: wal.DELETE, Key: write.Key})
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "write %d: unsupported operation %v", i, write.Operation)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := g.coreLayer.ApplyBatch(g.nodeConfig, writes); err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.BatchResponse{Applied: int32(len(writes))}, nil
+}
+
+func (g *GRPCService) authUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := g.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *GRPCService) authStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.authenticate(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func (g *GRPCService) authenticate(ctx context.Context) error {
+	if !g.nodeConfig.RequiresAuth() {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		encoded, ok := strings.CutPrefix(value, "Basic ")
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		if g.nodeConfig.Authenticate(username, password) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "authentication required")
+}
+
+// grpcCodes maps error codes to gRPC status codes.
+var grpcCodes = map[utils.ErrorCode]codes.Code{
+	utils.ERROR_SYNTAX:    codes.InvalidArgument,
+	utils.ERROR_UNKNOWN:   codes.Unimplemented,
+	utils.ERROR_NOTFOUND:  codes.NotFound,
+	utils.ERROR_WRONGTYPE: codes.FailedPrecondition,
+	utils.ERROR_NOAUTH:    codes.Unauthenticated,
+	utils.ERROR_READONLY:  codes.FailedPrecondition,
+	utils.ERROR_MOVED:     codes.FailedPrecondition,
+	utils.ERROR_TIMEOUT:   codes.DeadlineExceeded,
+	utils.ERROR_LOCKED:    codes.Aborted,
+	utils.ERROR_DEADLOCK:  codes.Aborted,
+	utils.ERROR_TOOLARGE:  codes.ResourceExhausted,
+}
+
+// grpcError turns an error of the core into a status with the matching code.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, wal.ErrSequenceTruncated):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, wal.ErrSubscriberLagged):
+		return status.Error(codes.Aborted, err.Error())
+	}
+	if code, ok := grpcCodes[utils.ErrorCodeOf(err)]; ok {
+		return status.Error(code, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
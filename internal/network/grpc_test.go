@@ -0,0 +1,199 @@
+package network_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sk25469/kv/api/kvpb"
+	"github.com/sk25469/kv/internal/network"
+	network_model "github.com/sk25469/kv/internal/network/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newGRPCClient serves the gRPC API of a test node and returns a client.
+func newGRPCClient(t *testing.T, config *network_model.NodeConfig) kvpb.KVClient {
+	t.Helper()
+	node := newTestNode(t, config)
+	g := network.NewGRPCService(network.GRPCServiceParams{NodeConfig: node.config, CoreLayer: node.core})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(listener)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kvpb.NewKVClient(conn)
+}
+
+func TestGRPCRequests(t *testing.T) {
+	client := newGRPCClient(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.Get(ctx, &kvpb.GetRequest{Key: "alice"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Get of a missing key: %v, want NotFound", err)
+	}
+	if _, err := client.Set(ctx, &kvpb.SetRequest{Key: "alice", Value: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := client.Get(ctx, &kvpb.GetRequest{Key: "alice"}); err != nil || res.Value != "admin" {
+		t.Fatalf("Get = %v, %v, want admin", res, err)
+	}
+
+	batch := &kvpb.BatchRequest{Writes: []*kvpb.Write{
+		{Operation: kvpb.Operation_OPERATION_SET, Key: "bob", Value: "user"},
+		{Operation: kvpb.Operation_OPERATION_SET, Key: "carol", Value: "user"},
+		{Operation: kvpb.Operation_OPERATION_DELETE, Key: "alice"},
+	}}
+	if res, err := client.Batch(ctx, batch); err != nil || res.Applied != 3 {
+		t.Fatalf("Batch = %v, %v, want 3 applied", res, err)
+	}
+	if _, err := client.Delete(ctx, &kvpb.DeleteRequest{Key: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.Scan(ctx, &kvpb.ScanRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Key != "bob" || res.Entries[0].Value != "user" {
+		t.Errorf("Scan = %v, want only bob", res.Entries)
+	}
+}
+
+func TestGRPCStatusCodes(t *testing.T) {
+	client := newGRPCClient(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tt := range []struct {
+		name string
+		call func(context.Context) error
+		code codes.Code
+	}{
+		{"Get without a key", func(ctx context.Context) error {
+			_, err := client.Get(ctx, &kvpb.GetRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{"Scan with a negative limit", func(ctx context.Context) error {
+			_, err := client.Scan(ctx, &kvpb.ScanRequest{Limit: -1})
+			return err
+		}, codes.InvalidArgument},
+		{"empty Batch", func(ctx context.Context) error {
+			_, err := client.Batch(ctx, &kvpb.BatchRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{"Batch with an append", func(ctx context.Context) error {
+			_, err := client.Batch(ctx, &kvpb.BatchRequest{Writes: []*kvpb.Write{{Operation: kvpb.Operation_OPERATION_APPEND, Key: "a"}}})
+			return err
+		}, codes.InvalidArgument},
+	} {
+		if err := tt.call(ctx); status.Code(err) != tt.code {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.code)
+		}
+	}
+
+	expired, cancelExpired := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancelExpired()
+	if _, err := client.Set(expired, &kvpb.SetRequest{Key: "late", Value: "1"}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Set after its deadline: %v, want DeadlineExceeded", err)
+	}
+	if _, err := client.Get(ctx, &kvpb.GetRequest{Key: "late"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Set after its deadline was applied: %v", err)
+	}
+}
+
+func TestGRPCWatchReplaysAndFiltersByPrefix(t *testing.T) {
+	client := newGRPCClient(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, key := range []string{"user:1", "order:1", "user:2"} {
+		if _, err := client.Set(ctx, &kvpb.SetRequest{Key: key, Value: "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Delete(ctx, &kvpb.DeleteRequest{Key: "user:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	from := uint64(0)
+	stream, err := client.Watch(ctx, &kvpb.WatchRequest{Prefix: "user:", FromSequence: &from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		op  kvpb.Operation
+		key string
+	}{
+		{kvpb.Operation_OPERATION_SET, "user:1"},
+		{kvpb.Operation_OPERATION_SET, "user:2"},
+		{kvpb.Operation_OPERATION_DELETE, "user:1"},
+	} {
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Operation != want.op || event.Key != want.key {
+			t.Errorf("got %v %s, want %v %s", event.Operation, event.Key, want.op, want.key)
+		}
+	}
+}
+
+func TestGRPCRequiresCredentialsOfTheNode(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "node.conf")
+	if err := os.WriteFile(file, []byte("username admin\npassword secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := newGRPCClient(t, network_model.NewNodeConfig(file))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	basic := func(username, password string) context.Context {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Basic "+auth)
+	}
+
+	if _, err := client.Set(ctx, &kvpb.SetRequest{Key: "a", Value: "1"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("without credentials: %v, want Unauthenticated", err)
+	}
+	if _, err := client.Set(basic("admin", "wrong"), &kvpb.SetRequest{Key: "a", Value: "1"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("with a wrong password: %v, want Unauthenticated", err)
+	}
+	stream, err := client.Watch(ctx, &kvpb.WatchRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Watch without credentials: %v, want Unauthenticated", err)
+	}
+	if _, err := client.Set(basic("admin", "secret"), &kvpb.SetRequest{Key: "a", Value: "1"}); err != nil {
+		t.Errorf("with credentials: %v", err)
+	}
+}
+
+func TestGRPCRefusesRequestsOverTheSizeLimit(t *testing.T) {
+	client := newGRPCClient(t, &network_model.NodeConfig{MaxRequestSize: 1024})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.Set(ctx, &kvpb.SetRequest{Key: "a", Value: string(make([]byte, 2048))}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Set over the limit: %v, want ResourceExhausted", err)
+	}
+	if _, err := client.Set(ctx, &kvpb.SetRequest{Key: "a", Value: string(make([]byte, 512))}); err != nil {
+		t.Errorf("Set within the limit: %v", err)
+	}
+}
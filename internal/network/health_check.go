@@ -33,11 +33,21 @@ func NewHealthCheckService(params HealthCheckServiceParams) *HealthCheckService
 }
 
 func (h *HealthCheckService) StartHealthCheck() {
-	http.HandleFunc("/health", h.healthCheck)
+	// a mux of our own, so nothing else in the process that registers on
+	// http.DefaultServeMux (pprof, expvar) ends up on this port
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", h.healthCheck)
+	h.networkService.RegisterREST(mux)
+	h.networkService.RegisterWebSocket(mux)
 
 	go func() {
-		log.Infof("Starting health check server on port %d", h.port)
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", h.port), nil); err != nil {
+		log.Infof("Starting health check and REST server on port %d", h.port)
+		n := h.networkService
+		listener, err := listen(fmt.Sprintf(":%d", h.port), n.nodeConfig, n.certs, "http/1.1")
+		if err != nil {
+			log.Fatalf("Health check server failed: %v", err)
+		}
+		if err := http.Serve(listener, mux); err != nil {
 			log.Fatalf("Health check server failed: %v", err)
 		}
 	}()
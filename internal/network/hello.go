@@ -0,0 +1,74 @@
+package network
+
+import (
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/core"
+	"github.com/sk25469/kv/utils"
+)
+
+// nodeCodecs are the protocols a node tells apart on its port, and
+// nodeFeatures what it offers over them. HELLO reports both.
+var nodeCodecs = []string{"text", "resp2", "resp3", "binary"}
+
+var nodeFeatures = []string{"multi", "watch", "transactions", "savepoints", "scan", "mget", "batch", "cdc", "pipelining", "chunks", "scripting"}
+
+// textHello answers HELLO on the text protocol. AUTH logs the session in and
+// SETNAME names it.
+func (n *NetworkService) textHello(cmd *codec_model.Command, session *core.Session) string {
+	reply, err := n.runHello(cmd, session)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	return reply
+}
+
+// binaryHello answers HELLO on the binary protocol, with the reply of the
+// text protocol as a bulk string.
+func (n *NetworkService) binaryHello(cmd *codec_model.Command, session *core.Session) codec_model.Reply {
+	reply, err := n.runHello(cmd, session)
+	if err != nil {
+		return errorReply(cmd, err)
+	}
+	return codec_model.Bulk(reply)
+}
+
+// runHello runs the HELLO of the text and binary protocols and returns its
+// JSON reply.
+func (n *NetworkService) runHello(cmd *codec_model.Command, session *core.Session) (string, error) {
+	hello, err := utils.ParseHello(cmd.Args)
+	if err != nil {
+		return "", err
+	}
+	if hello.Auth {
+		if err := n.login(session, hello.Username, hello.Password); err != nil {
+			return "", err
+		}
+	}
+	if hello.Name != "" {
+		session.SetName(hello.Name)
+	}
+
+	auth := "none"
+	if n.nodeConfig.RequiresAuth() {
+		auth = "password"
+	}
+	return utils.HelloReply{
+		Server:     "kv",
+		Version:    utils.SERVER_VERSION,
+		Proto:      utils.PROTOCOL_VERSION,
+		ID:         n.nodeConfig.ID,
+		Role:       n.role(),
+		Auth:       auth,
+		Codecs:     nodeCodecs,
+		Features:   nodeFeatures,
+		ClientName: session.Name(),
+	}.String(), nil
+}
+
+// role returns master or replica.
+func (n *NetworkService) role() string {
+	if n.nodeConfig.IsMaster {
+		return "master"
+	}
+	return "replica"
+}
@@ -0,0 +1,423 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sk25469/kv/internal/certs"
+	"github.com/sk25469/kv/internal/core"
+	"github.com/sk25469/kv/internal/middleware"
+	network "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+)
+
+const (
+	MEMCACHED_MAX_KEY_LENGTH = 250
+	MEMCACHED_MAX_ITEM_SIZE  = 1024 * 1024
+	// exptimes up to 30 days are relative, larger ones are unix timestamps
+	MEMCACHED_MAX_RELATIVE_EXPTIME = 60 * 60 * 24 * 30
+)
+
+type MemcachedServiceParams struct {
+	Port       int
+	NodeConfig *network.NodeConfig
+	CoreLayer  core.ICore
+	Certs      *certs.Store // the listener serves TLS with it when set
+}
+
+// MemcachedService speaks the memcached ASCII protocol on top of the node's
+// storage, so memcached clients can move over unchanged:
+//
+//	get|gets <key>*
+//	set|add|replace|append|prepend <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//	delete <key> [noreply]
+//	incr|decr <key> <delta> [noreply]
+//	touch <key> <exptime> [noreply]
+//	version
+//	quit
+//
+// Flags and expiry are stored with the key and the cas unique of a key is
+// the WAL sequence of its last write. The protocol has no authentication,
+// the listener belongs on a trusted network.
+type MemcachedService struct {
+	port       int
+	nodeConfig *network.NodeConfig
+	coreLayer  *core.CoreService
+	certs      *certs.Store
+	listener   net.Listener
+}
+
+func NewMemcachedService(params MemcachedServiceParams) *MemcachedService {
+	return &MemcachedService{
+		port:       params.Port,
+		nodeConfig: params.NodeConfig,
+		coreLayer:  params.CoreLayer.(*core.CoreService),
+		certs:      params.Certs,
+	}
+}
+
+// Start serves the protocol until Stop is called.
+func (m *MemcachedService) Start() error {
+	listener, err := listen(fmt.Sprintf(":%d", m.port), m.nodeConfig, m.certs)
+	if err != nil {
+		return err
+	}
+	if m.nodeConfig.RequiresAuth() {
+		log.Warnf("memcached listener on port %d does not authenticate clients", m.port)
+	}
+	log.Infof("memcached listener is listening on port %d", m.port)
+	return m.Serve(listener)
+}
+
+// Serve serves the protocol on the listener until Stop is called.
+func (m *MemcachedService) Serve(listener net.Listener) error {
+	m.listener = listener
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Errorf("Error accepting memcached connection: %v", err)
+			continue
+		}
+		go m.handleConnection(conn)
+	}
+}
+
+// Stop closes the listener. Connections end when their client leaves.
+func (m *MemcachedService) Stop() {
+	if m.listener != nil {
+		m.listener.Close()
+	}
+}
+
+func (m *MemcachedService) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			writer.WriteString("CLIENT_ERROR line too long\r\n")
+			writer.Flush()
+			return
+		}
+		if err != nil {
+			writer.Flush()
+			return
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			writer.WriteString("ERROR\r\n")
+		} else if fields[0] == "quit" {
+			writer.Flush()
+			return
+		} else if err := m.run(fields, reader, writer); err != nil {
+			// the data block could not be read, the stream is out of step
+			writer.Flush()
+			return
+		}
+
+		if !hasBufferedLine(reader) {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run runs one command and writes its reply. It only returns an error when
+// the connection can't be used any more.
+func (m *MemcachedService) run(fields []string, reader *bufio.Reader, writer *bufio.Writer) error {
+	name, args := fields[0], fields[1:]
+	switch name {
+	case "get", "gets":
+		m.get(args, name == "gets", writer)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return m.store(name, args, reader, writer)
+	case "delete":
+		m.delete(args, writer)
+	case "incr", "decr":
+		m.incr(name == "incr", args, writer)
+	case "touch":
+		m.touch(args, writer)
+	case "version":
+		writer.WriteString("VERSION " + utils.SERVER_VERSION + "\r\n")
+	default:
+		writer.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+func (m *MemcachedService) get(keys []string, withCas bool, writer *bufio.Writer) {
+	if len(keys) == 0 {
+		writer.WriteString("ERROR\r\n")
+		return
+	}
+	for _, key := range keys {
+		if !validMemcachedKey(key) {
+			writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+
+	items, err := m.coreLayer.GetItems(keys)
+	if err != nil {
+		writer.WriteString(serverError(err) + "\r\n")
+		return
+	}
+	for _, key := range keys {
+		item, ok := items[key]
+		if !ok {
+			continue
+		}
+		if withCas {
+			fmt.Fprintf(writer, "VALUE %s %d %d %d\r\n", key, item.Meta.Flags, len(item.Value), item.Version)
+		} else {
+			fmt.Fprintf(writer, "VALUE %s %d %d\r\n", key, item.Meta.Flags, len(item.Value))
+		}
+		writer.WriteString(item.Value + "\r\n")
+	}
+	writer.WriteString("END\r\n")
+}
+
+func (m *MemcachedService) store(name string, args []string, reader *bufio.Reader, writer *bufio.Writer) error {
+	argCount := 4
+	if name == "cas" {
+		argCount = 5
+	}
+	noreply := len(args) == argCount+1 && args[argCount] == "noreply"
+	if len(args) != argCount && !noreply {
+		writer.WriteString("ERROR\r\n")
+		return nil
+	}
+
+	key := args[0]
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	size, sizeErr := strconv.Atoi(args[3])
+	var casUnique uint64
+	var casErr error
+	if name == "cas" {
+		casUnique, casErr = strconv.ParseUint(args[4], 10, 64)
+	}
+	if sizeErr != nil || size < 0 {
+		// without a size the data block can't be skipped
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		writer.Flush()
+		return errors.New("bad data size")
+	}
+
+	if size > m.nodeConfig.RequestSizeLimit() {
+		// not worth reading through, the connection is dropped
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		writer.Flush()
+		return errors.New("data block too large")
+	}
+	// the data block is read even when the command is rejected, to stay in
+	// step with the client
+	if size > MEMCACHED_MAX_ITEM_SIZE {
+		if _, err := io.CopyN(io.Discard, reader, int64(size)+2); err != nil {
+			return err
+		}
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+	if !validMemcachedKey(key) || flagsErr != nil || exptimeErr != nil || casErr != nil {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	value := string(data[:size])
+	meta := wal.KeyMeta{Flags: uint32(flags), ExpiresAt: memcachedExpiry(exptime, time.Now())}
+
+	reply := "STORED"
+	_, err := m.coreLayer.UpdateItem(m.nodeConfig, key, func(item *middleware.Item) (*core.ItemUpdate, error) {
+		switch {
+		case name == "cas" && item == nil:
+			reply = "NOT_FOUND"
+			return nil, nil
+		case name == "cas" && item.Version != casUnique:
+			reply = "EXISTS"
+			return nil, nil
+		case name == "add" && item != nil,
+			(name == "replace" || name == "append" || name == "prepend") && item == nil:
+			reply = "NOT_STORED"
+			return nil, nil
+		case name == "append":
+			// appending keeps the flags and expiry of the item
+			return &core.ItemUpdate{Value: item.Value + value, Meta: item.Meta}, nil
+		case name == "prepend":
+			return &core.ItemUpdate{Value: value + item.Value, Meta: item.Meta}, nil
+		}
+		return &core.ItemUpdate{Value: value, Meta: meta}, nil
+	})
+	if err != nil {
+		reply = serverError(err)
+	}
+	if !noreply {
+		writer.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+func (m *MemcachedService) delete(args []string, writer *bufio.Writer) {
+	// old clients send a hold time, only 0 is accepted like memcached does
+	if len(args) > 1 && args[1] == "0" {
+		args = append(args[:1:1], args[2:]...)
+	}
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		writer.WriteString("CLIENT_ERROR bad command line format. Usage: delete <key> [noreply]\r\n")
+		return
+	}
+	if !validMemcachedKey(args[0]) {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	reply := "DELETED"
+	_, err := m.coreLayer.UpdateItem(m.nodeConfig, args[0], func(item *middleware.Item) (*core.ItemUpdate, error) {
+		if item == nil {
+			reply = "NOT_FOUND"
+			return nil, nil
+		}
+		return &core.ItemUpdate{Delete: true}, nil
+	})
+	if err != nil {
+		reply = serverError(err)
+	}
+	if !noreply {
+		writer.WriteString(reply + "\r\n")
+	}
+}
+
+func (m *MemcachedService) incr(incr bool, args []string, writer *bufio.Writer) {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		writer.WriteString("ERROR\r\n")
+		return
+	}
+	if !validMemcachedKey(args[0]) {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		writer.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+
+	var reply string
+	_, err = m.coreLayer.UpdateItem(m.nodeConfig, args[0], func(item *middleware.Item) (*core.ItemUpdate, error) {
+		if item == nil {
+			reply = "NOT_FOUND"
+			return nil, nil
+		}
+		current, err := strconv.ParseUint(strings.TrimSpace(item.Value), 10, 64)
+		if err != nil {
+			reply = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+			return nil, nil
+		}
+		// incr wraps around at 64 bits, decr stops at 0
+		switch {
+		case incr:
+			current += delta
+		case delta > current:
+			current = 0
+		default:
+			current -= delta
+		}
+		reply = strconv.FormatUint(current, 10)
+		return &core.ItemUpdate{Value: reply, Meta: item.Meta}, nil
+	})
+	if err != nil {
+		reply = serverError(err)
+	}
+	if !noreply {
+		writer.WriteString(reply + "\r\n")
+	}
+}
+
+func (m *MemcachedService) touch(args []string, writer *bufio.Writer) {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		writer.WriteString("ERROR\r\n")
+		return
+	}
+	if !validMemcachedKey(args[0]) {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writer.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+		return
+	}
+
+	reply := "TOUCHED"
+	_, err = m.coreLayer.UpdateItem(m.nodeConfig, args[0], func(item *middleware.Item) (*core.ItemUpdate, error) {
+		if item == nil {
+			reply = "NOT_FOUND"
+			return nil, nil
+		}
+		meta := item.Meta
+		meta.ExpiresAt = memcachedExpiry(exptime, time.Now())
+		return &core.ItemUpdate{Value: item.Value, Meta: meta}, nil
+	})
+	if err != nil {
+		reply = serverError(err)
+	}
+	if !noreply {
+		writer.WriteString(reply + "\r\n")
+	}
+}
+
+// memcachedExpiry converts an exptime to the unix milliseconds the key
+// expires at, 0 for never. A negative exptime expires the key right away.
+func memcachedExpiry(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return now.UnixMilli()
+	case exptime <= MEMCACHED_MAX_RELATIVE_EXPTIME:
+		return now.Add(time.Duration(exptime) * time.Second).UnixMilli()
+	}
+	return exptime * 1000
+}
+
+func validMemcachedKey(key string) bool {
+	if key == "" || len(key) > MEMCACHED_MAX_KEY_LENGTH {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func serverError(err error) string {
+	log.Errorf("memcached command failed: %v", err)
+	return "SERVER_ERROR " + err.Error()
+}
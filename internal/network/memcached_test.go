@@ -0,0 +1,157 @@
+package network_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sk25469/kv/internal/network"
+)
+
+// memcachedClient talks to the memcached listener of a test node.
+type memcachedClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newMemcachedClient(t *testing.T) *memcachedClient {
+	t.Helper()
+	node := newTestNode(t, nil)
+	m := network.NewMemcachedService(network.MemcachedServiceParams{NodeConfig: node.config, CoreLayer: node.core})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go m.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &memcachedClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends the request and reads reply lines up to and including the one
+// that ends it: END when the request ends with a retrieval, any line
+// otherwise.
+func (c *memcachedClient) do(request string) string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatal(err)
+	}
+	commands := strings.Split(strings.TrimSuffix(request, "\r\n"), "\r\n")
+	retrieval := strings.HasPrefix(commands[len(commands)-1], "get")
+	var lines []string
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%q: %v after %q", request, err, lines)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if !retrieval || line == "END" || strings.HasSuffix(line, "ERROR") || strings.HasPrefix(line, "CLIENT_ERROR") {
+			return strings.Join(lines, "|")
+		}
+	}
+}
+
+func (c *memcachedClient) expect(request, want string) {
+	c.t.Helper()
+	if got := c.do(request); got != want {
+		c.t.Errorf("%q replied %q, want %q", request, got, want)
+	}
+}
+
+func TestMemcachedStorageCommands(t *testing.T) {
+	c := newMemcachedClient(t)
+
+	c.expect("get a\r\n", "END")
+	c.expect("replace a 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.expect("add a 5 0 3\r\none\r\n", "STORED")
+	c.expect("add a 0 0 3\r\ntwo\r\n", "NOT_STORED")
+	c.expect("get a\r\n", "VALUE a 5 3|one|END")
+	c.expect("replace a 7 0 3\r\ntwo\r\n", "STORED")
+	c.expect("append a 0 0 1\r\n!\r\n", "STORED")
+	c.expect("prepend a 0 0 1\r\n<\r\n", "STORED")
+	c.expect("get a b\r\n", "VALUE a 7 5|<two!|END")
+	c.expect("set b 0 0 0\r\n\r\n", "STORED")
+	c.expect("get a b\r\n", "VALUE a 7 5|<two!|VALUE b 0 0||END")
+	c.expect("set c 0 0 2\r\nabcd", "CLIENT_ERROR bad data chunk")
+	c.expect("delete a\r\n", "DELETED")
+	c.expect("delete a\r\n", "NOT_FOUND")
+}
+
+func TestMemcachedCas(t *testing.T) {
+	c := newMemcachedClient(t)
+
+	c.expect("cas a 0 0 1 1\r\nx\r\n", "NOT_FOUND")
+	c.expect("set a 0 0 1\r\nx\r\n", "STORED")
+	reply := c.do("gets a\r\n")
+	var flags, size int
+	var unique uint64
+	if _, err := fmt.Sscanf(reply, "VALUE a %d %d %d|x|END", &flags, &size, &unique); err != nil {
+		t.Fatalf("gets replied %q: %v", reply, err)
+	}
+	c.expect(fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", unique+1), "EXISTS")
+	c.expect(fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", unique), "STORED")
+	c.expect(fmt.Sprintf("cas a 0 0 1 %d\r\nz\r\n", unique), "EXISTS")
+	c.expect("get a\r\n", "VALUE a 0 1|y|END")
+}
+
+func TestMemcachedIncrDecr(t *testing.T) {
+	c := newMemcachedClient(t)
+
+	c.expect("incr n 1\r\n", "NOT_FOUND")
+	c.expect("set n 3 0 2\r\n10\r\n", "STORED")
+	c.expect("incr n 5\r\n", "15")
+	c.expect("decr n 20\r\n", "0")
+	c.expect("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument")
+	c.expect("set n 0 0 20\r\n18446744073709551615\r\n", "STORED")
+	c.expect("incr n 2\r\n", "1")
+	c.expect("set s 0 0 3\r\nabc\r\n", "STORED")
+	c.expect("incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+}
+
+func TestMemcachedExptime(t *testing.T) {
+	c := newMemcachedClient(t)
+
+	c.expect("set gone 0 -1 1\r\nx\r\n", "STORED")
+	c.expect(fmt.Sprintf("set past 0 %d 1\r\nx\r\n", time.Now().Add(-time.Hour).Unix()), "STORED")
+	c.expect("set later 0 3600 1\r\nx\r\n", "STORED")
+	c.expect("get gone past later\r\n", "VALUE later 0 1|x|END")
+	c.expect("touch later -1\r\n", "TOUCHED")
+	c.expect("get later\r\n", "END")
+	c.expect("touch later 10\r\n", "NOT_FOUND")
+}
+
+func TestMemcachedNoreply(t *testing.T) {
+	c := newMemcachedClient(t)
+
+	// only the get after them is answered
+	c.expect("set a 0 0 1 noreply\r\n1\r\nadd a 0 0 1 noreply\r\n2\r\nincr a 4 noreply\r\n"+
+		"set b 0 0 1 noreply\r\nx\r\ndelete b noreply\r\ntouch a 100 noreply\r\nget a b\r\n", "VALUE a 0 1|5|END")
+}
+
+func TestMemcachedRefusesBadKeysAndSizes(t *testing.T) {
+	c := newMemcachedClient(t)
+	long := strings.Repeat("k", 251)
+
+	c.expect("set "+long+" 0 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format")
+	for _, request := range []string{"get " + long, "delete " + long, "incr " + long + " 1", "touch " + long + " 10"} {
+		c.expect(request+"\r\n", "CLIENT_ERROR bad command line format")
+	}
+	c.expect("set a 0 0 -1\r\n", "CLIENT_ERROR bad command line format")
+
+	c = newMemcachedClient(t)
+	c.expect("set a 0 0 9223372036854775807\r\n", "SERVER_ERROR object too large for cache")
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Error("the connection is still open after a data block too large to read")
+	}
+}
@@ -3,12 +3,14 @@ package network
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/sk25469/kv/utils"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type NodeConfig struct {
@@ -18,9 +20,22 @@ type NodeConfig struct {
 	MaxConnections  int    `json:"max_connections"`
 	username        string `json:"username"`
 	password        string `json:"password"`
+	loginPassword   string // the password in clear, for logging in to other nodes
 	IsMaster        bool   `json:"is_master"`
 	HealthCheckPort int    `json:"health_check_port"`
+	GRPCPort        int    `json:"grpc_port"`
+	MemcachedPort   int    `json:"memcached_port"`
+	MaxRequestSize  int    `json:"max_request_size"` // bytes, utils.DEFAULT_MAX_REQUEST_SIZE if 0
 	LogPath         string `json:"log_file_path"`
+	DataDir         string `json:"data_dir"`
+	// origins allowed to open WebSocket connections besides the node's own,
+	// "*" for any
+	WSAllowedOrigins []string `json:"-"`
+	// TLS files are local to the node and stay out of the registration
+	TLSCertFile string `json:"-"`
+	TLSKeyFile  string `json:"-"`
+	TLSCAFile   string `json:"-"` // verifies client certificates and the certificates of other nodes
+	TLSRequired bool   `json:"-"` // refuse plaintext connections and COMM messages without a verified certificate
 }
 
 func NewNodeConfig(filename string) *NodeConfig {
@@ -66,6 +81,49 @@ func loadConfig(filename string) (*NodeConfig, error) {
 				return &NodeConfig{}, err
 			}
 			config.HealthCheckPort = port
+		case "grpc_port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				log.Printf("error converting grpc_port to int: %v", err)
+				return &NodeConfig{}, err
+			}
+			config.GRPCPort = port
+		case "memcached_port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				log.Printf("error converting memcached_port to int: %v", err)
+				return &NodeConfig{}, err
+			}
+			config.MemcachedPort = port
+		case "max_request_size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				log.Printf("error converting max_request_size to a size: %v", value)
+				return &NodeConfig{}, fmt.Errorf("invalid max_request_size %q", value)
+			}
+			config.MaxRequestSize = size
+		case "ws_allowed_origins":
+			for _, origin := range strings.Split(value, ",") {
+				if origin = strings.TrimSpace(origin); origin != "" {
+					config.WSAllowedOrigins = append(config.WSAllowedOrigins, origin)
+				}
+			}
+		case "tls_cert_file":
+			config.TLSCertFile = value
+		case "tls_key_file":
+			config.TLSKeyFile = value
+		case "tls_ca_file":
+			config.TLSCAFile = value
+		case "tls_required":
+			switch strings.ToLower(value) {
+			case "yes", "true":
+				config.TLSRequired = true
+			case "no", "false":
+				config.TLSRequired = false
+			default:
+				log.Printf("error converting tls_required to a boolean: %v", value)
+				return &NodeConfig{}, fmt.Errorf("invalid tls_required %q", value)
+			}
 		case "password":
 			hashedPassword, err := utils.CreateHashedPassword(value)
 			if err != nil {
@@ -73,8 +131,11 @@ func loadConfig(filename string) (*NodeConfig, error) {
 				return &NodeConfig{}, err
 			}
 			config.password = hashedPassword
+			config.loginPassword = value
 		case "log_file":
 			config.LogPath = value
+		case "data_dir":
+			config.DataDir = value
 		}
 	}
 
@@ -85,6 +146,38 @@ func loadConfig(filename string) (*NodeConfig, error) {
 	return &config, nil
 }
 
+// RequestSizeLimit returns the largest request the node reads, in bytes.
+func (n *NodeConfig) RequestSizeLimit() int {
+	if n.MaxRequestSize > 0 {
+		return n.MaxRequestSize
+	}
+	return utils.DEFAULT_MAX_REQUEST_SIZE
+}
+
+// HasTLS reports whether the node has a certificate to serve TLS with.
+func (n *NodeConfig) HasTLS() bool {
+	return n.TLSCertFile != "" && n.TLSKeyFile != ""
+}
+
+// RequiresAuth reports whether the node has credentials configured.
+func (n *NodeConfig) RequiresAuth() bool {
+	return n.username != "" || n.password != ""
+}
+
+// Authenticate checks the credentials against the ones of the node.
+func (n *NodeConfig) Authenticate(username, password string) bool {
+	if n.username != username {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(n.password), []byte(password)) == nil
+}
+
+// Credentials returns the username and password the node logs in to other
+// nodes with. The nodes of a cluster share their credentials.
+func (n *NodeConfig) Credentials() (string, string) {
+	return n.username, n.loginPassword
+}
+
 func setNodeID() string {
 	return utils.GenerateBase64ClientID()
 }
@@ -2,16 +2,21 @@ package network
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"net"
 
+	"github.com/sk25469/kv/internal/certs"
 	"github.com/sk25469/kv/internal/codec"
+	codec_model "github.com/sk25469/kv/internal/codec/model"
 	"github.com/sk25469/kv/internal/comm"
 	"github.com/sk25469/kv/internal/core"
+	models "github.com/sk25469/kv/internal/model"
 	network "github.com/sk25469/kv/internal/network/model"
 	"github.com/sk25469/kv/logger"
+	"github.com/sk25469/kv/utils"
 )
 
 var log = logger.NewPackageLogger("network")
@@ -27,6 +32,8 @@ type NetworkServiceParams struct {
 	CoreLayer          core.ICore
 	CodecLayer         codec.ICodec
 	CommunicationLayer comm.ICommunication
+	PubSub             *models.PubSub // topics of the WebSocket endpoint, a new one if nil
+	Certs              *certs.Store   // listeners serve TLS with it when set
 }
 
 // NetworkService represents the network service
@@ -37,15 +44,23 @@ type NetworkService struct {
 	coreLayer          *core.CoreService
 	codecLayer         *codec.CodecLayerService
 	communicationLayer *comm.CommunicationService
+	pubSub             *models.PubSub
+	certs              *certs.Store
 	listener           net.Listener
 }
 
 func NewNetworkService(params NetworkServiceParams) *NetworkService {
+	pubSub := params.PubSub
+	if pubSub == nil {
+		pubSub = models.NewPubSub()
+	}
 	return &NetworkService{
 		nodeConfig:         params.NodeConfig,
 		coreLayer:          params.CoreLayer.(*core.CoreService),
 		codecLayer:         params.CodecLayer.(*codec.CodecLayerService),
 		communicationLayer: params.CommunicationLayer.(*comm.CommunicationService),
+		pubSub:             pubSub,
+		certs:              params.Certs,
 	}
 }
 
@@ -53,7 +68,7 @@ func (n *NetworkService) Start() error {
 	// Start TCP server
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", n.nodeConfig.Port))
+	listener, err := listen(fmt.Sprintf(":%v", n.nodeConfig.Port), n.nodeConfig, n.certs)
 	if err != nil {
 		log.Error("Error starting server:", err)
 		return err
@@ -91,8 +106,24 @@ func (n *NetworkService) Start() error {
 	masterNode, _ := n.communicationLayer.GetMasterNode()
 	log.Infof("Master node: %v\n", masterNode.ID)
 
+	return n.serve(ctx, listener)
+}
+
+// Serve serves client connections accepted on listener until it is closed,
+// without registering the node with the cluster.
+func (n *NetworkService) Serve(listener net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	return n.serve(ctx, listener)
+}
+
+func (n *NetworkService) serve(ctx context.Context, listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("Server on port %v shutting down", n.nodeConfig.Port)
+			return errors.New("server shutting down")
+		}
 		if err != nil {
 			select {
 			case <-ctx.Done():
@@ -126,44 +157,183 @@ func (n *NetworkService) handleConnection(ctx context.Context, conn net.Conn) {
 	log.Infof("Connection from %v\n", conn.RemoteAddr().String())
 	reader := bufio.NewReader(conn)
 
+	// RESP clients open with an array and binary clients with the frame
+	// magic, everything else is a text line
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	switch {
+	case codec.IsRESP(first[0]):
+		n.handleRESP(ctx, conn, reader)
+		return
+	case codec.IsBinary(first[0]):
+		n.handleBinary(ctx, conn, reader)
+		return
+	}
+	session := n.newSession(conn)
+	// replies to pipelined commands are written together, once the client
+	// has no complete command left in the buffer
+	writer := bufio.NewWriter(conn)
+
 	for {
 		// Read the next line from the connection
-		command, err := reader.ReadString('\n')
+		command, err := utils.ReadLine(reader, n.nodeConfig.RequestSizeLimit())
+		if errors.Is(err, utils.ErrTooLarge) {
+			// the line was skipped, the connection can go on
+			fmt.Fprintln(writer, utils.FormatError(err))
+			if !hasBufferedLine(reader) {
+				writer.Flush()
+			}
+			continue
+		}
 		// log.Printf("parsed command: %v", command)
 		if err != nil || command == "" {
 			log.Println("Error reading from connection:", err)
+			writer.Flush()
 			return
 		}
 		select {
 		case <-ctx.Done():
 			log.Println("Context cancelled, finishing last command")
 			// Process the last command before shutting down
-			n.ProcessCommand(command, conn)
+			n.ProcessCommand(command, conn, writer, session)
+			writer.Flush()
 			return
 		default:
-			n.ProcessCommand(command, conn)
+			n.ProcessCommand(command, conn, writer, session)
 		}
+
+		if !hasBufferedLine(reader) {
+			if err := writer.Flush(); err != nil {
+				log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+				return
+			}
+		}
+	}
+}
+
+// newSession starts the session of a client connection. When the node has
+// credentials, only nodes presenting a certificate we trust run commands
+// before logging in.
+func (n *NetworkService) newSession(conn net.Conn) *core.Session {
+	peer := certs.VerifiedPeer(conn)
+	session := core.NewSession()
+	session.SetPeer(peer)
+	session.SetAuthenticated(peer || !n.nodeConfig.RequiresAuth())
+	return session
+}
+
+// login checks the credentials against the node's and lets the session run
+// commands when they match. Nodes log in to each other with the credentials
+// they share, so a session logged in with them is taken for a node and may
+// send the BATCH records replication carries.
+func (n *NetworkService) login(session *core.Session, username, password string) error {
+	if n.nodeConfig.RequiresAuth() && !n.nodeConfig.Authenticate(username, password) {
+		return utils.NewError(utils.ERROR_NOAUTH, "invalid username or password")
 	}
+	session.SetAuthenticated(true)
+	if n.nodeConfig.RequiresAuth() {
+		session.SetPeer(true)
+	}
+	return nil
 }
 
-func (n *NetworkService) ProcessCommand(command string, conn net.Conn) {
+// checkSession handles AUTH and refuses the commands of a session that has
+// not logged in, except the HELLO it can log in with. It reports whether the
+// command goes no further, with the error to reply with if any.
+func (n *NetworkService) checkSession(cmd *codec_model.Command, session *core.Session) (bool, error) {
+	switch {
+	case cmd.Type == codec_model.Auth:
+		if len(cmd.Args) != 2 {
+			return true, utils.NewError(utils.ERROR_SYNTAX, "usage: AUTH <username> <password>")
+		}
+		return true, n.login(session, cmd.Args[0], cmd.Args[1])
+	case cmd.Type == codec_model.Hello || session.Authenticated():
+		return false, nil
+	}
+	return true, utils.NewError(utils.ERROR_NOAUTH, "authentication required")
+}
+
+// hasBufferedLine reports whether a whole command is already buffered, so
+// reading it won't block.
+func hasBufferedLine(reader *bufio.Reader) bool {
+	buffered, _ := reader.Peek(reader.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// ProcessCommand runs a command and writes its reply to w. The caller flushes
+// w.
+func (n *NetworkService) ProcessCommand(command string, conn net.Conn, w *bufio.Writer, session *core.Session) {
 	cmd, err := n.codecLayer.Encode(command, n.nodeConfig, nil)
 	if err != nil {
 		log.Printf("error encoding command: %v", err)
+		if _, err := fmt.Fprintln(w, utils.FormatError(err)); err != nil {
+			log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+		}
 		return
 	}
 	log.Infof("encoded command: %v", cmd)
-	res, err := n.coreLayer.RunCommand(cmd, n.nodeConfig)
+	if command, ok := cmd.(*codec_model.Command); ok && command != nil {
+		if done, err := n.checkSession(command, session); done {
+			reply := "OK"
+			if err != nil {
+				reply = utils.FormatError(err)
+			}
+			if _, err := fmt.Fprintln(w, reply); err != nil {
+				log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+			}
+			return
+		}
+	}
+	if command, ok := cmd.(*codec_model.Command); ok && command != nil && command.Type == codec_model.Cdc {
+		// the stream takes over the connection, replies owed go out first
+		if err := w.Flush(); err != nil {
+			log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+			return
+		}
+		n.streamChanges(command, conn)
+		return
+	}
+	if _, ok := cmd.(*codec_model.CommunicationModel); ok && n.nodeConfig.TLSRequired && !certs.VerifiedPeer(conn) {
+		// nodes talk over mutual TLS, a COMM message without a certificate
+		// we trust could come from anyone
+		log.Errorf("Refusing COMM message from %v without a verified certificate", conn.RemoteAddr())
+		if _, err := fmt.Fprintln(w, utils.ErrorReply(utils.ERROR_NOAUTH, "COMM messages require a verified node certificate")); err != nil {
+			log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+		}
+		return
+	}
+	if command, ok := cmd.(*codec_model.Command); ok && command != nil && command.Type == codec_model.Hello {
+		if _, err := fmt.Fprintln(w, n.textHello(command, session)); err != nil {
+			log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+		}
+		return
+	}
+	res, err := n.coreLayer.RunSessionCommand(cmd, n.nodeConfig, session)
 	if err != nil {
 		log.Errorf("error running command: %v", err)
-		return
+		res = []byte(utils.FormatError(err))
 	}
-	_, err = fmt.Fprintln(conn, string(res))
+	_, err = fmt.Fprintln(w, string(res))
 	if err != nil {
 		log.Errorf("error writing to the connection: %v : [%v]", conn, err)
 	}
 }
 
+// listen opens a TCP listener on address, serving TLS when the node has a
+// certificate. nextProtos are the ALPN protocols the listener speaks.
+func listen(address string, nodeConfig *network.NodeConfig, store *certs.Store, nextProtos ...string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return listener, nil
+	}
+	return certs.NewListener(listener, store, nodeConfig.TLSRequired, nextProtos...), nil
+}
+
 func (n *NetworkService) IsListenerActive() bool {
 	return n.listener != nil
 }
@@ -0,0 +1,89 @@
+package network_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sk25469/kv/internal/codec"
+	"github.com/sk25469/kv/internal/comm"
+	"github.com/sk25469/kv/internal/core"
+	"github.com/sk25469/kv/internal/middleware"
+	"github.com/sk25469/kv/internal/network"
+	network_model "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/internal/replication"
+	"github.com/sk25469/kv/internal/storage"
+)
+
+// testNode is a node serving the client protocols on a local port, without
+// a cluster around it.
+type testNode struct {
+	*network.NetworkService
+	core    *core.CoreService
+	comm    *comm.CommunicationService
+	config  *network_model.NodeConfig
+	address string
+}
+
+func newTestNode(t *testing.T, config *network_model.NodeConfig) *testNode {
+	t.Helper()
+	if config == nil {
+		config = &network_model.NodeConfig{}
+	}
+	if config.ID == "" {
+		config.ID = "test"
+	}
+	sm, err := middleware.NewStorageMiddleware(storage.NewInMemoryHashMap(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Recover(wal.RecoveryTarget{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sm.Close() })
+	cs := comm.NewCommunicationService(comm.CommunicationServiceParams{NodeConfig: config})
+	rs := replication.NewReplicationService(replication.ReplicationServiceParams{CommunicationLayer: cs})
+	c := core.NewCoreService(core.CoreServiceParams{StorageLayer: sm, CommunicationLayer: cs, ReplicationLayer: rs})
+	n := network.NewNetworkService(network.NetworkServiceParams{
+		NodeConfig:         config,
+		CoreLayer:          c,
+		CodecLayer:         codec.NewCodecLayerService(),
+		CommunicationLayer: cs,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go n.Serve(listener)
+	return &testNode{NetworkService: n, core: c, comm: cs, config: config, address: listener.Addr().String()}
+}
+
+// dial opens a client connection to the node.
+func (tn *testNode) dial(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", tn.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// send writes the text command and returns the reply line.
+func send(t *testing.T, conn net.Conn, reader *bufio.Reader, command string) string {
+	t.Helper()
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	return strings.TrimRight(reply, "\n")
+}
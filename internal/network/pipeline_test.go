@@ -0,0 +1,37 @@
+package network_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTextCommandsArePipelined(t *testing.T) {
+	node := newTestNode(t, nil)
+	conn, reader := node.dial(t)
+
+	// a burst of commands in one write, the last one cut in the middle
+	if _, err := conn.Write([]byte("SET a 1\nGET a\nSET b 2\nDEL a\nGET a\nGET b\nSET c")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"write successfull", "1", "write successfull", "delete successfull", "ERROR NOTFOUND key not found", "2"}
+	var got []string
+	for range want {
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %q: %v", got, err)
+		}
+		got = append(got, strings.TrimRight(reply, "\n"))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replies %q, want %q", got, want)
+	}
+
+	// the rest of the cut command is run once it arrives
+	if reply := send(t, conn, reader, " 3"); reply != "write successfull" {
+		t.Errorf("SET c 3 = %q", reply)
+	}
+	if reply := send(t, conn, reader, "GET c"); reply != "3" {
+		t.Errorf("GET c = %q, want 3", reply)
+	}
+}
@@ -0,0 +1,269 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sk25469/kv/internal/codec"
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/core"
+	"github.com/sk25469/kv/internal/storage"
+	"github.com/sk25469/kv/utils"
+)
+
+// respClientID numbers the RESP connections, HELLO reports it as the id
+var respClientID atomic.Int64
+
+// respConn is the state of a connection speaking RESP.
+type respConn struct {
+	id      int64
+	proto   int
+	session *core.Session
+}
+
+// handleRESP serves a connection whose client speaks RESP, so redis-cli and
+// the redis client libraries can talk to the node. Replies come back as RESP
+// types instead of text lines.
+func (n *NetworkService) handleRESP(ctx context.Context, conn net.Conn, reader *bufio.Reader) {
+	client := &respConn{id: respClientID.Add(1), proto: codec.RESP2, session: n.newSession(conn)}
+
+	for {
+		args, err := codec.ReadRESPCommandMax(reader, n.nodeConfig.RequestSizeLimit())
+		if err != nil {
+			if errors.Is(err, utils.ErrTooLarge) {
+				// the rest of the command is still unread, the connection
+				// can't go on
+				conn.Write(codec.EncodeReply(codec_model.Error(string(utils.ErrorCodeOf(err))+" "+err.Error()), client.proto))
+			} else if errors.Is(err, codec.ErrProtocol) {
+				conn.Write(codec.EncodeReply(codec_model.Error("ERR "+err.Error()), client.proto))
+			} else if err != io.EOF {
+				log.Println("Error reading from connection:", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		reply, quit := n.runRESP(args, client)
+		if _, err := conn.Write(codec.EncodeReply(reply, client.proto)); err != nil {
+			log.Errorf("error writing to the connection: %v : [%v]", conn, err)
+			return
+		}
+		if quit {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("Context cancelled, closing RESP connection")
+			return
+		default:
+		}
+	}
+}
+
+// runRESP runs a single command. It reports whether the client asked to
+// close the connection.
+func (n *NetworkService) runRESP(args []string, client *respConn) (codec_model.Reply, bool) {
+	name := strings.ToUpper(args[0])
+
+	// connection commands the client libraries send on their own
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			return codec_model.Bulk(args[1]), false
+		}
+		return codec_model.Status("PONG"), false
+	case "ECHO":
+		if len(args) != 2 {
+			return wrongArgs(name), false
+		}
+		return codec_model.Bulk(args[1]), false
+	case "QUIT":
+		return codec_model.Status("OK"), true
+	case "HELLO":
+		return n.hello(args, client), false
+	case "SELECT":
+		if len(args) != 2 || args[1] != "0" {
+			return codec_model.Error("ERR only database 0 is supported"), false
+		}
+		return codec_model.Status("OK"), false
+	case "COMMAND":
+		return codec_model.Array(), false
+	case "CONFIG":
+		return configGet(args), false
+	case "CLIENT":
+		return codec_model.Status("OK"), false
+	}
+
+	cmd, err := n.codecLayer.EncodeRESP(args)
+	if err != nil {
+		return codec_model.Error("ERR " + err.Error()), false
+	}
+	return n.runTyped(cmd, client.session), false
+}
+
+// runTyped runs a command for a protocol with typed replies.
+func (n *NetworkService) runTyped(cmd *codec_model.Command, session *core.Session) codec_model.Reply {
+	if cmd.Type == "" || cmd.Type == codec_model.Cdc || cmd.Type == codec_model.Batch {
+		return codec_model.Error("ERR unknown command '" + cmd.Name + "'")
+	}
+
+	if done, err := n.checkSession(cmd, session); done {
+		if err != nil {
+			return errorReply(cmd, err)
+		}
+		return codec_model.Status("OK")
+	}
+
+	res, err := n.coreLayer.RunSessionCommand(cmd, n.nodeConfig, session)
+	if err != nil {
+		return errorReply(cmd, err)
+	}
+	return commandReply(cmd, string(res))
+}
+
+// hello switches the protocol version of the connection and describes the
+// server, like redis' HELLO [protover [AUTH username password] [SETNAME name]].
+func (n *NetworkService) hello(args []string, client *respConn) codec_model.Reply {
+	if len(args) > 1 {
+		proto, err := strconv.Atoi(args[1])
+		if err != nil || (proto != codec.RESP2 && proto != codec.RESP3) {
+			return codec_model.Error("NOPROTO unsupported protocol version")
+		}
+		for rest := args[2:]; len(rest) > 0; {
+			switch {
+			case strings.EqualFold(rest[0], "AUTH") && len(rest) >= 3:
+				if err := n.login(client.session, rest[1], rest[2]); err != nil {
+					return codec_model.Error(string(utils.ErrorCodeOf(err)) + " " + err.Error())
+				}
+				rest = rest[3:]
+			case strings.EqualFold(rest[0], "SETNAME") && len(rest) >= 2:
+				client.session.SetName(rest[1])
+				rest = rest[2:]
+			default:
+				return codec_model.Error("ERR syntax error in HELLO option '" + rest[0] + "'")
+			}
+		}
+		client.proto = proto
+	}
+
+	return codec_model.Map(
+		codec_model.Bulk("server"), codec_model.Bulk("kv"),
+		codec_model.Bulk("version"), codec_model.Bulk(utils.SERVER_VERSION),
+		codec_model.Bulk("proto"), codec_model.Integer(int64(client.proto)),
+		codec_model.Bulk("id"), codec_model.Integer(client.id),
+		codec_model.Bulk("mode"), codec_model.Bulk("standalone"),
+		codec_model.Bulk("role"), codec_model.Bulk(n.role()),
+		codec_model.Bulk("modules"), codec_model.Array(),
+	)
+}
+
+// configGet answers the CONFIG GET calls clients make on connect. There is
+// nothing to configure, every parameter reads as empty.
+func configGet(args []string) codec_model.Reply {
+	if len(args) < 3 || !strings.EqualFold(args[1], "GET") {
+		return codec_model.Error("ERR only CONFIG GET is supported")
+	}
+	return codec_model.Map(codec_model.Bulk(args[2]), codec_model.Bulk(""))
+}
+
+// commandReply turns the text reply of the core into the reply type the
+// command has in redis.
+func commandReply(cmd *codec_model.Command, res string) codec_model.Reply {
+	if res == "QUEUED" {
+		return codec_model.Status(res)
+	}
+
+	switch cmd.Type {
+	case codec_model.Get:
+		return codec_model.Bulk(res)
+	case codec_model.Exec:
+		return execReply(res)
+	case codec_model.MGet:
+		return mgetReply(res)
+	case codec_model.GetRange:
+		return codec_model.Bulk(res)
+	case codec_model.Eval, codec_model.EvalSha:
+		if res == utils.NIL_REPLY {
+			return codec_model.Nil()
+		}
+		return codec_model.Bulk(res)
+	case codec_model.MDel, codec_model.SetChunk, codec_model.StrLen:
+		if n, err := strconv.ParseInt(res, 10, 64); err == nil {
+			return codec_model.Integer(n)
+		}
+	}
+	return textReply(res)
+}
+
+// mgetReply turns the JSON values of MGET into an array of bulk strings, nil
+// for the missing keys.
+func mgetReply(res string) codec_model.Reply {
+	var values []*string
+	if err := json.Unmarshal([]byte(res), &values); err != nil {
+		return codec_model.Bulk(res)
+	}
+	elems := make([]codec_model.Reply, 0, len(values))
+	for _, value := range values {
+		if value == nil {
+			elems = append(elems, codec_model.Nil())
+			continue
+		}
+		elems = append(elems, codec_model.Bulk(*value))
+	}
+	return codec_model.Array(elems...)
+}
+
+// execReply turns the JSON results of EXEC into an array, or a nil array if
+// the transaction was aborted.
+func execReply(res string) codec_model.Reply {
+	if res == utils.NIL_REPLY {
+		return codec_model.NilArray()
+	}
+	var results []string
+	if err := json.Unmarshal([]byte(res), &results); err != nil {
+		return codec_model.Bulk(res)
+	}
+
+	elems := make([]codec_model.Reply, 0, len(results))
+	for _, result := range results {
+		if kvErr, ok := utils.ParseErrorReply(result); ok {
+			elems = append(elems, codec_model.Error(string(kvErr.Code)+" "+kvErr.Message))
+			continue
+		}
+		elems = append(elems, textReply(result))
+	}
+	return codec_model.Array(elems...)
+}
+
+func textReply(res string) codec_model.Reply {
+	switch res {
+	case "", "OK", "write successfull":
+		return codec_model.Status("OK")
+	case "delete successfull":
+		return codec_model.Integer(1)
+	case "nothing to delete":
+		return codec_model.Integer(0)
+	}
+	return codec_model.Bulk(res)
+}
+
+func errorReply(cmd *codec_model.Command, err error) codec_model.Reply {
+	switch {
+	case errors.Is(err, storage.ErrKeyNotFound) && cmd.Type == codec_model.Get:
+		return codec_model.Nil()
+	}
+	return codec_model.Error(string(utils.ErrorCodeOf(err)) + " " + err.Error())
+}
+
+func wrongArgs(name string) codec_model.Reply {
+	return codec_model.Error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+}
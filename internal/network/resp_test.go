@@ -0,0 +1,69 @@
+package network_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// respCommand encodes the arguments as a RESP array of bulk strings.
+func respCommand(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func TestRESPKeyAndValueArePositional(t *testing.T) {
+	node := newTestNode(t, nil)
+	conn, reader := node.dial(t)
+	run := func(args ...string) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(respCommand(args...))); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(reply, "$") && reply != "$-1\r\n" {
+			value, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply += value
+		}
+		return reply
+	}
+
+	if reply := run("SET", "k", "v", "EX", "10"); !strings.HasPrefix(reply, "-SYNTAX ") {
+		t.Errorf("SET with options replied %q", reply)
+	}
+	if reply := run("GET", "EX"); reply != "$-1\r\n" {
+		t.Errorf("SET with options stored key EX: %q", reply)
+	}
+	if reply := run("SET", "k", "v"); reply != "+OK\r\n" {
+		t.Fatalf("SET replied %q", reply)
+	}
+	if reply := run("GET", "k"); reply != "$1\r\nv\r\n" {
+		t.Errorf("GET replied %q", reply)
+	}
+	if reply := run("DEL", "k"); reply != ":1\r\n" {
+		t.Errorf("DEL of a key replied %q", reply)
+	}
+	if reply := run("DEL", "k"); reply != ":0\r\n" {
+		t.Errorf("DEL of a missing key replied %q", reply)
+	}
+
+	// the text protocol tells the two apart too
+	text, textReader := node.dial(t)
+	send(t, text, textReader, "SET k v")
+	if reply := send(t, text, textReader, "DEL k"); reply != "delete successfull" {
+		t.Errorf("DEL of a key replied %q", reply)
+	}
+	if reply := send(t, text, textReader, "DEL k"); reply != "nothing to delete" {
+		t.Errorf("DEL of a missing key replied %q", reply)
+	}
+}
@@ -0,0 +1,288 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	codec_model "github.com/sk25469/kv/internal/codec/model"
+	"github.com/sk25469/kv/internal/core"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+)
+
+var errBadRequest = utils.NewError(utils.ERROR_SYNTAX, "bad request")
+
+// REST gateway, for clients that can't hold a TCP connection:
+//
+//	GET    /v1/kv/{collection}/{key}                        read a key
+//	PUT    /v1/kv/{collection}/{key}  {"value": "..."}      write a key
+//	DELETE /v1/kv/{collection}/{key}                        delete a key
+//	GET    /v1/kv/{collection}?prefix=&after=&limit=        list keys in order
+//	POST   /v1/batch                  {"ops": [...]}        apply writes atomically
+//
+// A key of a collection is stored as "<collection>:<key>". When the node has
+// credentials, requests authenticate with them over basic auth. Bodies are
+// limited to the request size limit of the node.
+
+type restEntry struct {
+	Collection string `json:"collection,omitempty"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+}
+
+type restList struct {
+	Entries []restEntry `json:"entries"`
+	Next    string      `json:"next,omitempty"`
+}
+
+type restBatch struct {
+	Ops []restBatchOp `json:"ops"`
+}
+
+type restBatchOp struct {
+	Op         string `json:"op"` // "set" or "delete"
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Value      string `json:"value,omitempty"`
+}
+
+// RegisterREST adds the REST gateway to the mux.
+func (n *NetworkService) RegisterREST(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/kv/{collection}/{key...}", n.restAuth(n.restGet))
+	mux.HandleFunc("PUT /v1/kv/{collection}/{key...}", n.restAuth(n.restSet))
+	mux.HandleFunc("DELETE /v1/kv/{collection}/{key...}", n.restAuth(n.restDelete))
+	mux.HandleFunc("GET /v1/kv/{collection}", n.restAuth(n.restList))
+	mux.HandleFunc("POST /v1/batch", n.restAuth(n.restBatch))
+}
+
+func (n *NetworkService) restAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if n.nodeConfig.RequiresAuth() {
+			username, password, ok := r.BasicAuth()
+			if !ok || !n.nodeConfig.Authenticate(username, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="kv"`)
+				restError(w, http.StatusUnauthorized, utils.NewError(utils.ERROR_NOAUTH, "authentication required"))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (n *NetworkService) restGet(w http.ResponseWriter, r *http.Request) {
+	collection, key, err := restKey(r)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+
+	res, err := n.coreLayer.RunCommand(codec_model.NewCommand([]string{"GET", storageKey(collection, key)}), n.nodeConfig)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	restJSON(w, http.StatusOK, restEntry{Collection: collection, Key: key, Value: string(res)})
+}
+
+func (n *NetworkService) restSet(w http.ResponseWriter, r *http.Request) {
+	collection, key, err := restKey(r)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := n.restDecode(w, r, &body); err != nil {
+		restFail(w, err)
+		return
+	}
+	if body.Value == nil {
+		restFail(w, fmt.Errorf("%w: missing value", errBadRequest))
+		return
+	}
+
+	_, err = n.coreLayer.RunCommand(codec_model.NewCommand([]string{"SET", storageKey(collection, key), *body.Value}), n.nodeConfig)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (n *NetworkService) restDelete(w http.ResponseWriter, r *http.Request) {
+	collection, key, err := restKey(r)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+
+	_, err = n.coreLayer.RunCommand(codec_model.NewCommand([]string{"DEL", storageKey(collection, key)}), n.nodeConfig)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (n *NetworkService) restList(w http.ResponseWriter, r *http.Request) {
+	collection := r.PathValue("collection")
+	if err := validCollection(collection); err != nil {
+		restFail(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	args := []string{"SCAN", "MATCH", storageKey(collection, query.Get("prefix"))}
+	if after := query.Get("after"); after != "" {
+		args = append(args, "AFTER", storageKey(collection, after))
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if n, err := strconv.Atoi(limit); err != nil || n <= 0 {
+			restFail(w, fmt.Errorf("%w: invalid limit %q", errBadRequest, limit))
+			return
+		}
+		args = append(args, "COUNT", limit)
+	}
+
+	res, err := n.coreLayer.RunCommand(codec_model.NewCommand(args), n.nodeConfig)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	var result core.ScanResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		restFail(w, err)
+		return
+	}
+
+	list := restList{Entries: make([]restEntry, 0, len(result.Entries))}
+	for _, entry := range result.Entries {
+		list.Entries = append(list.Entries, restEntry{Key: strings.TrimPrefix(entry.Key, collection+":"), Value: entry.Value})
+	}
+	if result.Next != "" {
+		list.Next = strings.TrimPrefix(result.Next, collection+":")
+	}
+	restJSON(w, http.StatusOK, list)
+}
+
+func (n *NetworkService) restBatch(w http.ResponseWriter, r *http.Request) {
+	var batch restBatch
+	if err := n.restDecode(w, r, &batch); err != nil {
+		restFail(w, err)
+		return
+	}
+	if len(batch.Ops) == 0 {
+		restFail(w, fmt.Errorf("%w: batch has no ops", errBadRequest))
+		return
+	}
+
+	writes := make([]wal.LogEntry, 0, len(batch.Ops))
+	for i, op := range batch.Ops {
+		if err := validCollection(op.Collection); err != nil {
+			restFail(w, fmt.Errorf("op %d: %w", i, err))
+			return
+		}
+		if op.Key == "" {
+			restFail(w, fmt.Errorf("%w: op %d: missing key", errBadRequest, i))
+			return
+		}
+		switch strings.ToLower(op.Op) {
+		case "set":
+			writes = append(writes, wal.LogEntry{Operation: wal.SET, Key: storageKey(op.Collection, op.Key), Value: op.Value})
+		case "delete":
+			writes = append(writes, wal.LogEntry{Operation: wal.DELETE, Key: storageKey(op.Collection, op.Key)})
+		default:
+			restFail(w, fmt.Errorf("%w: op %d: unknown op %q", errBadRequest, i, op.Op))
+			return
+		}
+	}
+
+	if err := n.coreLayer.ApplyBatch(n.nodeConfig, writes); err != nil {
+		restFail(w, err)
+		return
+	}
+	restJSON(w, http.StatusOK, map[string]int{"applied": len(writes)})
+}
+
+func restKey(r *http.Request) (string, string, error) {
+	collection, key := r.PathValue("collection"), r.PathValue("key")
+	if err := validCollection(collection); err != nil {
+		return "", "", err
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("%w: missing key", errBadRequest)
+	}
+	return collection, key, nil
+}
+
+func validCollection(collection string) error {
+	if collection == "" || strings.Contains(collection, ":") {
+		return fmt.Errorf("%w: invalid collection %q", errBadRequest, collection)
+	}
+	return nil
+}
+
+func storageKey(collection, key string) string {
+	return collection + ":" + key
+}
+
+func (n *NetworkService) restDecode(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(n.nodeConfig.RequestSizeLimit()))
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+// restStatus maps error codes to HTTP status codes.
+var restStatus = map[utils.ErrorCode]int{
+	utils.ERROR_SYNTAX:    http.StatusBadRequest,
+	utils.ERROR_UNKNOWN:   http.StatusBadRequest,
+	utils.ERROR_NOTFOUND:  http.StatusNotFound,
+	utils.ERROR_WRONGTYPE: http.StatusConflict,
+	utils.ERROR_NOAUTH:    http.StatusUnauthorized,
+	utils.ERROR_READONLY:  http.StatusServiceUnavailable,
+	utils.ERROR_MOVED:     http.StatusMisdirectedRequest,
+	utils.ERROR_TIMEOUT:   http.StatusGatewayTimeout,
+	utils.ERROR_LOCKED:    http.StatusConflict,
+	utils.ERROR_DEADLOCK:  http.StatusConflict,
+	utils.ERROR_NOPROTO:   http.StatusBadRequest,
+	utils.ERROR_TOOLARGE:  http.StatusRequestEntityTooLarge,
+}
+
+// restFail writes the error with the status code matching it.
+func restFail(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		restError(w, http.StatusRequestEntityTooLarge, utils.NewError(utils.ERROR_TOOLARGE, "%v", err))
+		return
+	}
+
+	status, ok := restStatus[utils.ErrorCodeOf(err)]
+	if !ok {
+		log.Errorf("REST request failed: %v", err)
+		status = http.StatusInternalServerError
+	}
+	restError(w, status, err)
+}
+
+func restError(w http.ResponseWriter, status int, err error) {
+	restJSON(w, status, map[string]string{"code": string(utils.ErrorCodeOf(err)), "error": err.Error()})
+}
+
+func restJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("error writing REST response: %v", err)
+	}
+}
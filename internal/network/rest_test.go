@@ -0,0 +1,147 @@
+package network_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	network_model "github.com/sk25469/kv/internal/network/model"
+)
+
+// newRESTServer serves the REST gateway of a test node.
+func newRESTServer(t *testing.T, config *network_model.NodeConfig) *httptest.Server {
+	t.Helper()
+	node := newTestNode(t, config)
+	mux := http.NewServeMux()
+	node.RegisterREST(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// restDo sends the request and returns the status code and the body.
+func restDo(t *testing.T, server *httptest.Server, method, path, payload string, auth ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth) == 2 {
+		req.SetBasicAuth(auth[0], auth[1])
+	}
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestRESTRoutesAndStatusCodes(t *testing.T) {
+	server := newRESTServer(t, nil)
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+		contains           string
+	}{
+		{"GET", "/v1/kv/users/alice", "", http.StatusNotFound, `"code":"NOTFOUND"`},
+		{"PUT", "/v1/kv/users/alice", `{"value": "admin"}`, http.StatusNoContent, ""},
+		{"GET", "/v1/kv/users/alice", "", http.StatusOK, `"value":"admin"`},
+		{"PUT", "/v1/kv/users/bob", `{"value": ""}`, http.StatusNoContent, ""},
+		{"PUT", "/v1/kv/users/carol", `{}`, http.StatusBadRequest, "missing value"},
+		{"PUT", "/v1/kv/users/carol", `{"value":`, http.StatusBadRequest, `"code":"SYNTAX"`},
+		{"GET", "/v1/kv/us:ers/alice", "", http.StatusBadRequest, "invalid collection"},
+		{"GET", "/v1/kv/users?limit=0", "", http.StatusBadRequest, "invalid limit"},
+		{"POST", "/v1/batch", `{"ops": []}`, http.StatusBadRequest, "no ops"},
+		{"POST", "/v1/batch", `{"ops": [{"op": "rename", "collection": "users", "key": "alice"}]}`, http.StatusBadRequest, "unknown op"},
+		{"POST", "/v1/batch", `{"ops": [{"op": "set", "collection": "users", "key": "dave", "value": "1"}, {"op": "delete", "collection": "users", "key": "bob"}]}`, http.StatusOK, `"applied":2`},
+		{"GET", "/v1/kv/users/bob", "", http.StatusNotFound, ""},
+		{"DELETE", "/v1/kv/users/alice", "", http.StatusNoContent, ""},
+		{"GET", "/v1/kv/users/alice", "", http.StatusNotFound, ""},
+		{"PATCH", "/v1/kv/users/alice", "", http.StatusMethodNotAllowed, ""},
+	} {
+		status, body := restDo(t, server, tt.method, tt.path, tt.body)
+		if status != tt.status || !strings.Contains(body, tt.contains) {
+			t.Errorf("%s %s: got %d %q, want %d containing %q", tt.method, tt.path, status, body, tt.status, tt.contains)
+		}
+	}
+}
+
+func TestRESTListPagesInKeyOrder(t *testing.T) {
+	server := newRESTServer(t, nil)
+	for _, key := range []string{"c", "a", "e", "b", "d"} {
+		if status, body := restDo(t, server, "PUT", "/v1/kv/letters/"+key, `{"value": "`+key+`"}`); status != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", key, status, body)
+		}
+	}
+	restDo(t, server, "PUT", "/v1/kv/other/a", `{"value": "x"}`)
+
+	var keys []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("listing does not end, got %v", keys)
+		}
+		status, body := restDo(t, server, "GET", "/v1/kv/letters?limit=2&after="+after, "")
+		if status != http.StatusOK {
+			t.Fatalf("list: %d %s", status, body)
+		}
+		var list struct {
+			Entries []struct{ Key, Value string }
+			Next    string
+		}
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range list.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if list.Next == "" {
+			break
+		}
+		after = list.Next
+	}
+	if got := strings.Join(keys, ","); got != "a,b,c,d,e" {
+		t.Errorf("listed %s, want a,b,c,d,e", got)
+	}
+}
+
+func TestRESTRequiresCredentialsOfTheNode(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "node.conf")
+	if err := os.WriteFile(file, []byte("username admin\npassword secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newRESTServer(t, network_model.NewNodeConfig(file))
+
+	if status, _ := restDo(t, server, "GET", "/v1/kv/users/alice", ""); status != http.StatusUnauthorized {
+		t.Errorf("without credentials: got %d, want 401", status)
+	}
+	if status, _ := restDo(t, server, "GET", "/v1/kv/users/alice", "", "admin", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("with a wrong password: got %d, want 401", status)
+	}
+	if status, body := restDo(t, server, "PUT", "/v1/kv/users/alice", `{"value": "1"}`, "admin", "secret"); status != http.StatusNoContent {
+		t.Errorf("with credentials: got %d %s, want 204", status, body)
+	}
+}
+
+func TestRESTRefusesBodiesOverTheSizeLimit(t *testing.T) {
+	server := newRESTServer(t, &network_model.NodeConfig{MaxRequestSize: 64})
+
+	big := `{"value": "` + strings.Repeat("x", 100) + `"}`
+	if status, body := restDo(t, server, "PUT", "/v1/kv/users/alice", big); status != http.StatusRequestEntityTooLarge || !strings.Contains(body, `"code":"TOOLARGE"`) {
+		t.Errorf("PUT over the limit: got %d %s, want 413", status, body)
+	}
+	if status, body := restDo(t, server, "PUT", "/v1/kv/users/alice", `{"value": "x"}`); status != http.StatusNoContent {
+		t.Errorf("PUT within the limit: got %d %s, want 204", status, body)
+	}
+}
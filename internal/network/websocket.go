@@ -0,0 +1,313 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+)
+
+const (
+	WS_WRITE_WAIT     = 10 * time.Second
+	WS_PONG_WAIT      = 60 * time.Second
+	WS_PING_INTERVAL  = WS_PONG_WAIT * 9 / 10 // pings go out before the pong wait runs out
+	WS_MAX_MESSAGE    = 64 * 1024
+	WS_SEND_QUEUE     = 256 // messages queued for a client before it counts as too slow
+	WS_TOPIC_BUFFER   = 64
+	WS_CLOSE_TOO_SLOW = "client too slow"
+)
+
+// WebSocket endpoint for live updates, served at /v1/ws. Every frame is a
+// JSON message. Clients send:
+//
+//	{"op": "subscribe",   "topic": "t"}
+//	{"op": "unsubscribe", "topic": "t"}
+//	{"op": "publish",     "topic": "t", "message": "m"}
+//	{"op": "watch",       "prefix": "p", "from_sequence": 10}   from_sequence is optional
+//	{"op": "unwatch",     "prefix": "p"}
+//
+// and get {"type": "ok"} or {"type": "error", "code": .., "error": ..} back,
+// with the "id" of the request if it had one. Updates arrive as
+//
+//	{"type": "message", "topic": "t", "message": "m"}
+//	{"type": "change", "sequence": 11, "operation": "SET", "key": "k", "value": "v"}
+//
+// The server pings every WS_PING_INTERVAL and drops clients that don't pong.
+// When the node has credentials, the handshake authenticates with them over
+// basic auth. Browsers connect from pages of the node or of the origins in
+// ws_allowed_origins.
+
+type wsRequest struct {
+	ID           string  `json:"id,omitempty"`
+	Op           string  `json:"op"`
+	Topic        string  `json:"topic,omitempty"`
+	Message      string  `json:"message,omitempty"`
+	Prefix       string  `json:"prefix"`
+	FromSequence *uint64 `json:"from_sequence,omitempty"`
+}
+
+type wsMessage struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Sequence  uint64 `json:"sequence,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// wsClient is a WebSocket connection with its subscriptions and watches.
+// Only the write loop writes to the connection.
+type wsClient struct {
+	conn    *websocket.Conn
+	send    chan wsMessage
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	topics  map[string]func() // cancels the subscription of each topic
+	watches map[string]func() // cancels the watch of each prefix
+}
+
+// RegisterWebSocket adds the WebSocket endpoint to the mux.
+func (n *NetworkService) RegisterWebSocket(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/ws", n.restAuth(n.serveWebSocket))
+}
+
+func (n *NetworkService) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := wsUpgrader
+	upgrader.CheckOrigin = n.wsCheckOrigin
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied
+		log.Errorf("WebSocket handshake failed: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &wsClient{
+		conn:    conn,
+		send:    make(chan wsMessage, WS_SEND_QUEUE),
+		ctx:     ctx,
+		cancel:  cancel,
+		topics:  make(map[string]func()),
+		watches: make(map[string]func()),
+	}
+	log.Infof("WebSocket connection from %v", r.RemoteAddr)
+
+	go client.writeLoop()
+	n.wsReadLoop(client)
+	client.close()
+}
+
+// wsCheckOrigin accepts clients that aren't browsers, which send no Origin,
+// pages of the node itself and the configured origins.
+func (n *NetworkService) wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range n.nodeConfig.WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (n *NetworkService) wsReadLoop(client *wsClient) {
+	conn := client.conn
+	conn.SetReadLimit(WS_MAX_MESSAGE)
+	conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	})
+
+	for {
+		var req wsRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				client.reply(req.ID, utils.NewError(utils.ERROR_SYNTAX, "invalid request: %v", err))
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Errorf("WebSocket read failed: %v", err)
+			}
+			return
+		}
+		client.reply(req.ID, n.wsRun(client, req))
+	}
+}
+
+// wsRun runs a request of the client.
+func (n *NetworkService) wsRun(client *wsClient, req wsRequest) error {
+	switch strings.ToLower(req.Op) {
+	case "subscribe":
+		if req.Topic == "" {
+			return utils.NewError(utils.ERROR_SYNTAX, "missing topic")
+		}
+		client.subscribe(n, req.Topic)
+	case "unsubscribe":
+		client.stop(client.topics, req.Topic)
+	case "publish":
+		if req.Topic == "" {
+			return utils.NewError(utils.ERROR_SYNTAX, "missing topic")
+		}
+		n.pubSub.Publish(req.Topic, req.Message)
+	case "watch":
+		from := n.coreLayer.LastSequence()
+		if req.FromSequence != nil {
+			from = *req.FromSequence
+		}
+		client.watch(n, req.Prefix, from)
+	case "unwatch":
+		client.stop(client.watches, req.Prefix)
+	default:
+		return utils.NewError(utils.ERROR_UNKNOWN, "unknown op: %q", req.Op)
+	}
+	return nil
+}
+
+func (c *wsClient) subscribe(n *NetworkService, topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.topics[topic]; ok {
+		return
+	}
+
+	messages, unsubscribe := n.pubSub.Listen(topic, WS_TOPIC_BUFFER)
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.topics[topic] = func() {
+		cancel()
+		unsubscribe()
+	}
+	go func() {
+		for {
+			select {
+			case message := <-messages:
+				c.push(wsMessage{Type: "message", Topic: topic, Message: message})
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// watch streams the changes to keys starting with prefix, from the given WAL
+// sequence on.
+func (c *wsClient) watch(n *NetworkService, prefix string, from uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.watches[prefix]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.watches[prefix] = cancel
+	go func() {
+		err := n.coreLayer.StreamChanges(ctx, from, func(entry wal.LogEntry) error {
+			entries := []wal.LogEntry{entry}
+			if entry.Operation == wal.BATCH {
+				entries = entry.Entries
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Key, prefix) {
+					c.push(wsMessage{Type: "change", Sequence: entry.Sequence, Operation: string(e.Operation), Key: e.Key, Value: e.Value})
+				}
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			// the watch ended on its own, the client can start it again
+			c.mu.Lock()
+			delete(c.watches, prefix)
+			c.mu.Unlock()
+			c.push(wsMessage{Type: "error", Code: string(utils.ErrorCodeOf(err)), Error: "watch of " + prefix + " stopped: " + err.Error()})
+		}
+	}()
+}
+
+// stop cancels the subscription or watch with the given name.
+func (c *wsClient) stop(cancels map[string]func(), name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := cancels[name]; ok {
+		cancel()
+		delete(cancels, name)
+	}
+}
+
+func (c *wsClient) reply(id string, err error) {
+	if err != nil {
+		c.push(wsMessage{Type: "error", ID: id, Code: string(utils.ErrorCodeOf(err)), Error: err.Error()})
+		return
+	}
+	c.push(wsMessage{Type: "ok", ID: id})
+}
+
+// push queues a message for the client. A client that doesn't keep up is
+// disconnected rather than slowing down the node.
+func (c *wsClient) push(message wsMessage) {
+	select {
+	case c.send <- message:
+	case <-c.ctx.Done():
+	default:
+		log.Errorf("WebSocket client %v is too slow, disconnecting", c.conn.RemoteAddr())
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, WS_CLOSE_TOO_SLOW), time.Now().Add(WS_WRITE_WAIT))
+		c.cancel()
+		c.conn.Close()
+	}
+}
+
+func (c *wsClient) writeLoop() {
+	ticker := time.NewTicker(WS_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			if err := c.conn.WriteJSON(message); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_WAIT)); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// close ends the subscriptions of the client. Cancelling its context ends
+// the watches.
+func (c *wsClient) close() {
+	c.cancel()
+	c.mu.Lock()
+	for _, cancel := range c.topics {
+		cancel()
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
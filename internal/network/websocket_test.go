@@ -0,0 +1,133 @@
+package network_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	network_model "github.com/sk25469/kv/internal/network/model"
+)
+
+type wsMessage struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Code      string `json:"code"`
+	Topic     string `json:"topic"`
+	Message   string `json:"message"`
+	Operation string `json:"operation"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+}
+
+// newWSServer serves the WebSocket endpoint of a test node.
+func newWSServer(t *testing.T, config *network_model.NodeConfig) (*testNode, string) {
+	t.Helper()
+	node := newTestNode(t, config)
+	mux := http.NewServeMux()
+	node.RegisterWebSocket(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return node, "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/ws"
+}
+
+func wsDial(t *testing.T, url string, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, res, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		t.Fatalf("dial: %v (%d)", err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// wsDo sends the request and returns the reply to it.
+func wsDo(t *testing.T, conn *websocket.Conn, request string) wsMessage {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	var reply wsMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestWebSocketTopicMessagesArriveInOrder(t *testing.T) {
+	_, url := newWSServer(t, nil)
+	subscriber, publisher := wsDial(t, url, nil), wsDial(t, url, nil)
+
+	if reply := wsDo(t, subscriber, `{"id": "1", "op": "subscribe", "topic": "news"}`); reply.Type != "ok" || reply.ID != "1" {
+		t.Fatalf("subscribe replied %+v", reply)
+	}
+	for i := 0; i < 50; i++ {
+		if reply := wsDo(t, publisher, fmt.Sprintf(`{"op": "publish", "topic": "news", "message": "%d"}`, i)); reply.Type != "ok" {
+			t.Fatalf("publish replied %+v", reply)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		var message wsMessage
+		if err := subscriber.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Type != "message" || message.Topic != "news" || message.Message != fmt.Sprint(i) {
+			t.Fatalf("message %d is %+v", i, message)
+		}
+	}
+}
+
+func TestWebSocketWatchStreamsChanges(t *testing.T) {
+	node, url := newWSServer(t, nil)
+	text, reader := node.dial(t)
+	send(t, text, reader, "SET user:1 a")
+	send(t, text, reader, "SET order:1 b")
+
+	conn := wsDial(t, url, nil)
+	if reply := wsDo(t, conn, `{"op": "watch", "prefix": "user:", "from_sequence": 0}`); reply.Type != "ok" {
+		t.Fatalf("watch replied %+v", reply)
+	}
+	send(t, text, reader, "DEL user:1")
+	for _, want := range []wsMessage{
+		{Type: "change", Operation: "SET", Key: "user:1", Value: "a"},
+		{Type: "change", Operation: "DELETE", Key: "user:1"},
+	} {
+		var message wsMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		if message != want {
+			t.Errorf("got %+v, want %+v", message, want)
+		}
+	}
+
+	if reply := wsDo(t, conn, `{"op": "rename"}`); reply.Type != "error" || reply.Code != "UNKNOWN" {
+		t.Errorf("unknown op replied %+v", reply)
+	}
+	if reply := wsDo(t, conn, `{"op": "subscribe"}`); reply.Type != "error" || reply.Code != "SYNTAX" {
+		t.Errorf("subscribe without a topic replied %+v", reply)
+	}
+}
+
+func TestWebSocketAllowedOrigins(t *testing.T) {
+	_, url := newWSServer(t, &network_model.NodeConfig{WSAllowedOrigins: []string{"https://dashboard.example.com"}})
+	origin := func(origin string) http.Header {
+		return http.Header{"Origin": {origin}}
+	}
+
+	wsDial(t, url, nil)
+	wsDial(t, url, origin("https://dashboard.example.com"))
+	wsDial(t, url, origin("http://"+strings.TrimPrefix(strings.TrimSuffix(url, "/v1/ws"), "ws://")))
+	_, res, err := websocket.DefaultDialer.Dial(url, origin("https://evil.example.com"))
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("a page of another origin connected: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sk25469/kv/utils"
+)
+
+const (
+	BACKUP_MANIFEST = "manifest.json"
+	BACKUP_DIR      = "backups" // under the data dir, the only place BACKUP writes to
+)
+
+// BackupPath returns the directory the backup with the given name is written
+// to, inside the backups directory of dataDir.
+func BackupPath(dataDir, name string) (string, error) {
+	if err := ValidateBackupName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, BACKUP_DIR, name), nil
+}
+
+// ValidateBackupName accepts relative paths that stay inside the backups
+// directory, so clients can't have the node write anywhere else.
+func ValidateBackupName(name string) error {
+	if !filepath.IsLocal(name) || filepath.Clean(name) == "." || slices.Contains(strings.Split(filepath.ToSlash(name), "/"), "..") {
+		return utils.NewError(utils.ERROR_SYNTAX, "invalid backup name %q, expected a relative path without ..", name)
+	}
+	return nil
+}
+
+// BackupManifest describes the files of a backup. A backup directory is laid
+// out like a data directory holding a single snapshot and segment, so a
+// restore only has to verify and copy it.
+type BackupManifest struct {
+	CreatedAt        time.Time    `json:"created_at"`
+	SnapshotSequence uint64       `json:"snapshot_sequence"`
+	Sequence         uint64       `json:"sequence"` // last sequence in the WAL tail
+	Files            []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup writes the snapshot and every entry appended after it to the backup
+// with the given name. The log is only locked while the flushed tail
+// position is read, so writes carry on while the backup is taken.
+func (w *FileWAL) Backup(name string, snapshot *Snapshot) (*BackupManifest, error) {
+	dir, err := BackupPath(w.dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareEmptyDir(dir); err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	if err := w.flush(); err != nil {
+		w.mu.Unlock()
+		return nil, err
+	}
+	last := w.sequence
+	w.mu.Unlock()
+
+	backupSnapshot := *snapshot
+	backupSnapshot.Segment = 1
+	if err := writeSnapshot(dir, &backupSnapshot); err != nil {
+		return nil, err
+	}
+
+	tailPath := filepath.Join(dir, segmentName(1))
+	tailFile, err := os.Create(tailPath)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(tailFile)
+	err = w.streamRetained(context.Background(), snapshot.Sequence, last, func(entry LogEntry) error {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(append(data, '\n'))
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tailFile.Sync()
+	}
+	tailFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{
+		CreatedAt:        time.Now(),
+		SnapshotSequence: snapshot.Sequence,
+		Sequence:         last,
+	}
+	for _, name := range []string{snapshotName(1), segmentName(1)} {
+		file, err := describeFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, *file)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, BACKUP_MANIFEST), data, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// VerifyBackup checks every file listed in the manifest of the backup in
+// dir against its size and checksum.
+func VerifyBackup(dir string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, BACKUP_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("decoding backup manifest: %v", err)
+	}
+	if len(manifest.Files) == 0 {
+		return nil, fmt.Errorf("backup manifest lists no files")
+	}
+
+	for _, expected := range manifest.Files {
+		if filepath.Base(expected.Name) != expected.Name {
+			return nil, fmt.Errorf("backup manifest lists invalid file name %q", expected.Name)
+		}
+		actual, err := describeFile(filepath.Join(dir, expected.Name))
+		if err != nil {
+			return nil, err
+		}
+		if actual.Size != expected.Size || actual.SHA256 != expected.SHA256 {
+			return nil, fmt.Errorf("backup file %s does not match its checksum", expected.Name)
+		}
+	}
+	return &manifest, nil
+}
+
+// RestoreBackup verifies the backup in backupDir and copies it into dataDir,
+// which must not hold any segments or snapshots yet.
+func RestoreBackup(backupDir, dataDir string) (*BackupManifest, error) {
+	manifest, err := VerifyBackup(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, prefix := range [][2]string{{SEGMENT_PREFIX, SEGMENT_SUFFIX}, {SNAPSHOT_PREFIX, SNAPSHOT_SUFFIX}} {
+		existing, err := listIndexed(dataDir, prefix[0], prefix[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 {
+			return nil, fmt.Errorf("data dir %s already holds WAL data", dataDir)
+		}
+	}
+
+	for _, file := range manifest.Files {
+		if err := copyFile(filepath.Join(backupDir, file.Name), filepath.Join(dataDir, file.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+func describeFile(path string) (*BackupFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupFile{
+		Name:   filepath.Base(path),
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// prepareEmptyDir creates dir, refusing to write into one that has files.
+func prepareEmptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("backup dir %s is not empty", dir)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package wal_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	wal "github.com/sk25469/kv/internal/persistence"
+)
+
+// backup takes a backup named nightly of a log holding a snapshot of a=1
+// and b=2 followed by two writes.
+func backup(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"},
+		wal.LogEntry{Operation: wal.SET, Key: "b", Value: "2"},
+	)
+	snapshot := &wal.Snapshot{Sequence: 2, CreatedAt: time.Now(), Data: map[string]string{"a": "1", "b": "2"}}
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.DELETE, Key: "a"},
+		wal.LogEntry{Operation: wal.SET, Key: "c", Value: "3"},
+	)
+
+	manifest, err := w.Backup("nightly", snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SnapshotSequence != 2 || manifest.Sequence != 4 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	path, err := wal.BackupPath(dir, "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBackupRestore(t *testing.T) {
+	backupDir := backup(t)
+
+	dataDir := t.TempDir()
+	if _, err := wal.RestoreBackup(backupDir, dataDir); err != nil {
+		t.Fatal(err)
+	}
+	w, err := wal.NewFileWAL(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	snapshot, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || snapshot.Sequence != 2 || snapshot.Data["a"] != "1" || snapshot.Data["b"] != "2" {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	if len(entries) != 2 || entries[0].Operation != wal.DELETE || entries[1].Key != "c" {
+		t.Fatalf("expected the two writes after the snapshot, got %+v", entries)
+	}
+	if w.LastSequence() != 4 {
+		t.Errorf("expected the restored log to go on from sequence 4, got %d", w.LastSequence())
+	}
+
+	// a data dir that already holds a log is not overwritten
+	if _, err := wal.RestoreBackup(backupDir, dataDir); err == nil {
+		t.Error("expected restoring over existing WAL data to fail")
+	}
+}
+
+func TestRestoreRejectsChecksumMismatch(t *testing.T) {
+	backupDir := backup(t)
+
+	segment := filepath.Join(backupDir, "wal-000001.log")
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same size, different content
+	data[len(data)-3] ^= 0x01
+	if err := os.WriteFile(segment, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := t.TempDir()
+	_, err = wal.RestoreBackup(backupDir, dataDir)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	if files, _ := os.ReadDir(dataDir); len(files) > 0 {
+		t.Errorf("expected nothing restored from a corrupt backup, found %d files", len(files))
+	}
+}
+
+func TestBackupStaysInBackupDir(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, name := range []string{"", "/tmp/stolen", "../stolen", "nightly/../../stolen", "."} {
+		if _, err := w.Backup(name, &wal.Snapshot{}); err == nil {
+			t.Errorf("Backup(%q) was accepted", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "stolen")); !os.IsNotExist(err) {
+		t.Error("a backup was written outside the data dir")
+	}
+	if _, err := w.Backup("daily/monday", &wal.Snapshot{}); err != nil {
+		t.Errorf("expected a nested backup name to be accepted: %v", err)
+	}
+}
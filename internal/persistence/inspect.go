@@ -0,0 +1,100 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// SegmentReport describes a segment as found on disk, for offline
+// inspection of a data directory.
+type SegmentReport struct {
+	Index     uint64
+	Path      string
+	Entries   []LogEntry
+	Unchecked int    // entries without a checksum
+	Size      int64  // size of the file
+	ValidSize int64  // size of the valid prefix
+	Problem   string // first framing or checksum problem, empty if valid
+}
+
+// SnapshotReport describes a snapshot as found on disk.
+type SnapshotReport struct {
+	Index    uint64
+	Path     string
+	Sequence uint64
+	Keys     int
+	Problem  string
+}
+
+// InspectSegments decodes every segment in dir, in order, without opening
+// the log for writing.
+func InspectSegments(dir string) ([]SegmentReport, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]SegmentReport, 0, len(segments))
+	for _, segment := range segments {
+		path := filepath.Join(dir, segmentName(segment))
+		scan, err := scanSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, SegmentReport{
+			Index:     segment,
+			Path:      path,
+			Entries:   scan.entries,
+			Unchecked: scan.unchecked,
+			Size:      scan.total,
+			ValidSize: scan.size,
+			Problem:   scan.problem,
+		})
+	}
+	return reports, nil
+}
+
+// InspectSnapshots reads and verifies every snapshot in dir.
+func InspectSnapshots(dir string) ([]SnapshotReport, error) {
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]SnapshotReport, 0, len(snapshots))
+	for _, index := range snapshots {
+		path := filepath.Join(dir, snapshotName(index))
+		report := SnapshotReport{Index: index, Path: path}
+		snapshot, err := readSnapshot(path)
+		if err != nil {
+			report.Problem = err.Error()
+		} else {
+			report.Sequence = snapshot.Sequence
+			report.Keys = len(snapshot.Data)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// RepairSegments truncates every segment in dir at its first invalid entry
+// and returns the reports of the segments it changed. The log must not be
+// open while it runs.
+func RepairSegments(dir string) ([]SegmentReport, error) {
+	reports, err := InspectSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var repaired []SegmentReport
+	for _, report := range reports {
+		if report.Problem == "" {
+			continue
+		}
+		if err := os.Truncate(report.Path, report.ValidSize); err != nil {
+			return nil, err
+		}
+		repaired = append(repaired, report)
+	}
+	return repaired, nil
+}
@@ -0,0 +1,128 @@
+package wal_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wal "github.com/sk25469/kv/internal/persistence"
+)
+
+// writeSegment writes three entries to a fresh log and returns its dir and
+// the path of the segment.
+func writeSegment(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "one", Value: "first"},
+		wal.LogEntry{Operation: wal.SET, Key: "two", Value: "second"},
+		wal.LogEntry{Operation: wal.SET, Key: "three", Value: "third"},
+	)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, filepath.Join(dir, "wal-000001.log")
+}
+
+func TestInspectSegmentsDetectsCorruptEntry(t *testing.T) {
+	dir, path := writeSegment(t)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstLine := bytes.IndexByte(data, '\n') + 1
+	// still valid JSON, only the checksum tells
+	corrupted := bytes.Replace(data, []byte(`"second"`), []byte(`"secund"`), 1)
+	if err := os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := wal.InspectSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("expected one segment, got %d", len(reports))
+	}
+	report := reports[0]
+	if report.Problem == "" {
+		t.Fatal("expected the corrupt entry to be reported")
+	}
+	if len(report.Entries) != 1 || report.Entries[0].Key != "one" {
+		t.Errorf("expected only the entry before the corrupt one, got %+v", report.Entries)
+	}
+	if report.ValidSize != int64(firstLine) || report.Size != int64(len(corrupted)) {
+		t.Errorf("expected %d valid bytes of %d, got %d of %d", firstLine, len(corrupted), report.ValidSize, report.Size)
+	}
+}
+
+func TestRepairSegmentsTruncatesAtFirstInvalidEntry(t *testing.T) {
+	dir, path := writeSegment(t)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Replace(data, []byte(`"second"`), []byte(`"secund"`), 1)
+	if err := os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err := wal.RepairSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 1 || repaired[0].Path != path {
+		t.Fatalf("expected the segment to be repaired, got %+v", repaired)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != repaired[0].ValidSize {
+		t.Errorf("expected the segment truncated to %d bytes, got %d", repaired[0].ValidSize, info.Size())
+	}
+
+	reports, err := wal.InspectSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports[0].Problem != "" || len(reports[0].Entries) != 1 {
+		t.Fatalf("expected a valid segment with one entry after the repair, got %+v", reports[0])
+	}
+	// nothing left to repair
+	if repaired, err := wal.RepairSegments(dir); err != nil || len(repaired) != 0 {
+		t.Errorf("expected a second repair to change nothing, got %+v, %v", repaired, err)
+	}
+
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "one" {
+		t.Fatalf("expected the entry before the corruption, got %+v", entries)
+	}
+}
+
+func TestInspectSnapshotsDetectsCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "snapshot-000002.snap"), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reports, err := wal.InspectSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Problem == "" {
+		t.Fatalf("expected the corrupt snapshot to be reported, got %+v", reports)
+	}
+}
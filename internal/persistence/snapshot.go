@@ -0,0 +1,195 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	SNAPSHOT_PREFIX  = "snapshot-"
+	SNAPSHOT_SUFFIX  = ".snap"
+	SNAPSHOT_VERSION = 1
+	SNAPSHOT_RETAIN  = 2 // number of snapshots kept on disk
+)
+
+// Snapshot is a point-in-time copy of the storage contents. It covers every
+// WAL entry up to and including Sequence, which are all stored in segments
+// older than Segment.
+type Snapshot struct {
+	Sequence  uint64             `json:"sequence"`
+	Segment   uint64             `json:"segment"`
+	CreatedAt time.Time          `json:"created_at"`
+	Data      map[string]string  `json:"-"`
+	Meta      map[string]KeyMeta `json:"-"` // keys with flags or an expiry
+}
+
+// snapshotHeader is the first line of a snapshot file. It describes the
+// JSON encoded data on the second line so a torn or corrupted file can be
+// detected before it is loaded.
+type snapshotHeader struct {
+	Version  int    `json:"version"`
+	Size     int    `json:"size"`
+	Checksum uint32 `json:"checksum"`
+	// the metadata of the keys follows the data on a third line, if any key
+	// has some
+	MetaSize     int    `json:"meta_size,omitempty"`
+	MetaChecksum uint32 `json:"meta_checksum,omitempty"`
+	Snapshot
+}
+
+func snapshotName(segment uint64) string {
+	return fmt.Sprintf("%s%06d%s", SNAPSHOT_PREFIX, segment, SNAPSHOT_SUFFIX)
+}
+
+// listSnapshots returns the segment indexes of the snapshots in dir in
+// ascending order.
+func listSnapshots(dir string) ([]uint64, error) {
+	return listIndexed(dir, SNAPSHOT_PREFIX, SNAPSHOT_SUFFIX)
+}
+
+// writeSnapshot writes the snapshot to a temporary file and renames it into
+// place, so readers only ever see complete snapshots.
+func writeSnapshot(dir string, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot.Data)
+	if err != nil {
+		return err
+	}
+
+	var meta []byte
+	if len(snapshot.Meta) > 0 {
+		if meta, err = json.Marshal(snapshot.Meta); err != nil {
+			return err
+		}
+	}
+
+	header, err := json.Marshal(snapshotHeader{
+		Version:      SNAPSHOT_VERSION,
+		Size:         len(data),
+		Checksum:     crc32.ChecksumIEEE(data),
+		MetaSize:     len(meta),
+		MetaChecksum: crc32.ChecksumIEEE(meta),
+		Snapshot:     *snapshot,
+	})
+	if err != nil {
+		return err
+	}
+	parts := [][]byte{header, data}
+	if meta != nil {
+		parts = append(parts, meta)
+	}
+
+	path := filepath.Join(dir, snapshotName(snapshot.Segment))
+	tempPath := path + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tempFile)
+	for _, part := range parts {
+		if _, err := writer.Write(append(part, '\n')); err != nil {
+			tempFile.Close()
+			os.Remove(tempPath)
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+func readSnapshot(path string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	headerLine, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot header: %v", err)
+	}
+
+	var header snapshotHeader
+	if err := json.Unmarshal(headerLine, &header); err != nil {
+		return nil, fmt.Errorf("decoding snapshot header: %v", err)
+	}
+	if header.Version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	data := make([]byte, header.Size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("reading snapshot data: %v", err)
+	}
+	if crc32.ChecksumIEEE(data) != header.Checksum {
+		return nil, fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	snapshot := header.Snapshot
+	if err := json.Unmarshal(data, &snapshot.Data); err != nil {
+		return nil, fmt.Errorf("decoding snapshot data: %v", err)
+	}
+	if snapshot.Data == nil {
+		snapshot.Data = make(map[string]string)
+	}
+
+	if header.MetaSize > 0 {
+		// skip the newline ending the data
+		if _, err := reader.Discard(1); err != nil {
+			return nil, fmt.Errorf("reading snapshot metadata: %v", err)
+		}
+		meta := make([]byte, header.MetaSize)
+		if _, err := io.ReadFull(reader, meta); err != nil {
+			return nil, fmt.Errorf("reading snapshot metadata: %v", err)
+		}
+		if crc32.ChecksumIEEE(meta) != header.MetaChecksum {
+			return nil, fmt.Errorf("snapshot metadata checksum mismatch")
+		}
+		if err := json.Unmarshal(meta, &snapshot.Meta); err != nil {
+			return nil, fmt.Errorf("decoding snapshot metadata: %v", err)
+		}
+	}
+	return &snapshot, nil
+}
+
+// loadLatestSnapshot returns the newest snapshot in dir that can be read and
+// passes its checksum, or nil if there is none.
+func loadLatestSnapshot(dir string) (*Snapshot, error) {
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, snapshotName(snapshots[i]))
+		snapshot, err := readSnapshot(path)
+		if err != nil {
+			log.Printf("skipping invalid snapshot %s: %v", path, err)
+			continue
+		}
+		return snapshot, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const STREAM_BUFFER_SIZE = 4096 // live entries buffered per subscriber
+
+var (
+	// ErrSequenceTruncated is returned when the requested sequence is older
+	// than anything left in the live and archived segments.
+	ErrSequenceTruncated = errors.New("requested sequence is no longer retained")
+	// ErrSubscriberLagged is returned when a subscriber does not keep up with
+	// the write rate and its live buffer overflows.
+	ErrSubscriberLagged = errors.New("subscriber fell behind the log")
+)
+
+type subscriber struct {
+	entries chan LogEntry
+}
+
+// Stream calls fn for every entry with a sequence greater than from, in log
+// order. Retained entries are read from disk first, then new entries are
+// delivered as they are appended. It blocks until ctx is done, fn returns an
+// error or the subscriber falls behind.
+func (w *FileWAL) Stream(ctx context.Context, from uint64, fn func(LogEntry) error) error {
+	w.mu.Lock()
+	if err := w.flush(); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	last := w.sequence
+	sub := &subscriber{entries: make(chan LogEntry, STREAM_BUFFER_SIZE)}
+	if w.subscribers == nil {
+		w.subscribers = make(map[*subscriber]struct{})
+	}
+	w.subscribers[sub] = struct{}{}
+	w.mu.Unlock()
+
+	defer w.unsubscribe(sub)
+
+	if from < last {
+		if err := w.streamRetained(ctx, from, last, fn); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case entry, ok := <-sub.entries:
+			if !ok {
+				return ErrSubscriberLagged
+			}
+			if entry.Sequence <= from {
+				continue
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// OldestSequence returns the oldest sequence still available to Stream.
+func (w *FileWAL) OldestSequence() (uint64, error) {
+	w.mu.Lock()
+	last := w.sequence
+	w.mu.Unlock()
+
+	segments, err := w.retainedSegments()
+	if err != nil {
+		return 0, err
+	}
+	for _, segment := range segments {
+		entries, _, err := readSegmentFile(w.dir, segment)
+		if err != nil {
+			return 0, err
+		}
+		if len(entries) > 0 {
+			return entries[0].Sequence, nil
+		}
+	}
+	return last + 1, nil
+}
+
+// publish hands a freshly appended entry to the live subscribers. A
+// subscriber whose buffer is full is dropped. Called with w.mu held.
+func (w *FileWAL) publish(entry LogEntry) {
+	for sub := range w.subscribers {
+		select {
+		case sub.entries <- entry:
+		default:
+			close(sub.entries)
+			delete(w.subscribers, sub)
+		}
+	}
+}
+
+func (w *FileWAL) unsubscribe(sub *subscriber) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.subscribers[sub]; ok {
+		delete(w.subscribers, sub)
+		close(sub.entries)
+	}
+}
+
+// streamRetained replays the entries in (from, last] from the live and
+// archived segments.
+func (w *FileWAL) streamRetained(ctx context.Context, from, last uint64, fn func(LogEntry) error) error {
+	oldest, err := w.OldestSequence()
+	if err != nil {
+		return err
+	}
+	if from+1 < oldest {
+		return ErrSequenceTruncated
+	}
+
+	segments, err := w.retainedSegments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		entries, _, err := readSegmentFile(w.dir, segment)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Sequence <= from {
+				continue
+			}
+			if entry.Sequence > last {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// retainedSegments returns the contiguous run of live and archived segments
+// that ends with the active segment.
+func (w *FileWAL) retainedSegments() ([]uint64, error) {
+	paths, err := listWithArchive(w.dir, filepath.Join(w.dir, ARCHIVE_DIR), SEGMENT_PREFIX, SEGMENT_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := sortedKeys(paths)
+	start := 0
+	for i := len(indexes) - 1; i > 0; i-- {
+		if indexes[i-1] != indexes[i]-1 {
+			start = i
+			break
+		}
+	}
+	return indexes[start:], nil
+}
+
+// readSegmentFile reads a segment from the live directory, falling back to
+// the archive in case a checkpoint moved it in the meantime.
+func readSegmentFile(dir string, segment uint64) ([]LogEntry, int64, error) {
+	entries, size, err := readSegment(filepath.Join(dir, segmentName(segment)))
+	if os.IsNotExist(err) {
+		return readSegment(filepath.Join(dir, ARCHIVE_DIR, segmentName(segment)))
+	}
+	return entries, size, err
+}
@@ -2,10 +2,18 @@ package wal
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,122 +25,445 @@ type Operation string
 const (
 	SET              Operation = utils.SET
 	DELETE           Operation = utils.DEL
+	BATCH            Operation = "BATCH"  // entries of a transaction, applied together
+	APPEND           Operation = "APPEND" // Value is appended to the value of the key, logged per SETCHUNK
 	DEFAULT_LOG_DIR            = "/var/lib/kvstore/"
 	DEFAULT_LOG_FILE           = "wal.log"
 )
 
 const (
-	FLUSH_INTERVAL    = 1 * time.Second
-	COMPACT_INTERVAL  = 1 * time.Second // Adjust based on your needs
-	COMPACT_THRESHOLD = 1024 * 1024 * 1 // 0.01MB threshold
+	FLUSH_INTERVAL       = 1 * time.Second
+	CHECKPOINT_INTERVAL  = 30 * time.Second // Adjust based on your needs
+	CHECKPOINT_THRESHOLD = 1024 * 1024 * 1  // 1MB of WAL since the last checkpoint
+	SEGMENT_PREFIX       = "wal-"
+	SEGMENT_SUFFIX       = ".log"
+	ARCHIVE_DIR          = "archive"
+	ARCHIVE_RETENTION    = 7 * 24 * time.Hour // how long truncated segments are kept for point-in-time recovery
 )
 
 type LogEntry struct {
-	Operation Operation `json:"operation"`
-	Key       string    `json:"key"`
-	Value     string    `json:"value,omitempty"`
-	Sequence  uint64    `json:"sequence"`
+	Operation Operation  `json:"operation"`
+	Key       string     `json:"key"`
+	Value     string     `json:"value,omitempty"`
+	KeyMeta              // flags and expiry of a SET
+	Sequence  uint64     `json:"sequence"`
+	Timestamp time.Time  `json:"timestamp"`
+	Checksum  uint32     `json:"checksum,omitempty"` // CRC32 of the entry encoded without its checksum
+	Entries   []LogEntry `json:"entries,omitempty"`  // writes of a BATCH entry, without sequences of their own
 }
 
+// KeyMeta is what a key holds besides its value. Most keys have none.
+type KeyMeta struct {
+	Flags     uint32 `json:"flags,omitempty"`      // opaque to the server, kept for memcached clients
+	ExpiresAt int64  `json:"expires_at,omitempty"` // unix milliseconds, 0 if the key does not expire
+}
+
+func (m KeyMeta) IsZero() bool {
+	return m == KeyMeta{}
+}
+
+// Expired reports whether the key expired by now.
+func (m KeyMeta) Expired(now time.Time) bool {
+	return m.ExpiresAt != 0 && now.UnixMilli() >= m.ExpiresAt
+}
+
+func (e LogEntry) computeChecksum() uint32 {
+	e.Checksum = 0
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0
+	}
+	return crc32.ChecksumIEEE(data)
+}
+
+// RecoveryTarget bounds how far recovery replays the log. The zero value
+// replays everything.
+type RecoveryTarget struct {
+	Sequence uint64    // last sequence to apply, 0 for no limit
+	Time     time.Time // entries written after this time are not applied, zero for no limit
+}
+
+func (t RecoveryTarget) IsSet() bool {
+	return t.Sequence != 0 || !t.Time.IsZero()
+}
+
+func (t RecoveryTarget) includesEntry(entry LogEntry) bool {
+	if t.Sequence != 0 && entry.Sequence > t.Sequence {
+		return false
+	}
+	if !t.Time.IsZero() && entry.Timestamp.After(t.Time) {
+		return false
+	}
+	return true
+}
+
+func (t RecoveryTarget) includesSnapshot(snapshot *Snapshot) bool {
+	if t.Sequence != 0 && snapshot.Sequence > t.Sequence {
+		return false
+	}
+	if !t.Time.IsZero() && snapshot.CreatedAt.After(t.Time) {
+		return false
+	}
+	return true
+}
+
+// ErrReadOnly is returned by the writes of a log opened with
+// NewReadOnlyFileWAL.
+var ErrReadOnly = errors.New("log is opened read-only")
+
 type WAL interface {
 	AppendLog(entry LogEntry) error
-	Recover() ([]LogEntry, error)
+	// Recover returns the newest valid snapshot (nil if there is none) and
+	// every entry written after it, in log order. When the target is set,
+	// archived snapshots and segments are used as well and only the state
+	// up to the target is returned.
+	Recover(target RecoveryTarget) (*Snapshot, []LogEntry, error)
+	// Rotate closes the active segment and starts a new one. It returns the
+	// index of the new segment and the last sequence written before it.
+	Rotate() (uint64, uint64, error)
+	// Checkpoint persists the snapshot and truncates the segments it covers.
+	Checkpoint(snapshot *Snapshot) error
+	// Size returns the size of the active segment in bytes.
+	Size() (int64, error)
+	// LastSequence returns the sequence of the last entry written to the log.
+	// Sequences are strictly increasing across restarts.
+	LastSequence() uint64
+	// Stream calls fn for every entry after from, first from disk and then
+	// live as entries are appended, until ctx is done or fn fails.
+	Stream(ctx context.Context, from uint64, fn func(LogEntry) error) error
+	// Backup writes the snapshot and the log tail after it to the backup
+	// with the given name, see BackupPath.
+	Backup(name string, snapshot *Snapshot) (*BackupManifest, error)
 	Close() error
 }
 
+// FileWAL is a segmented write-ahead log. Every segment is a file of
+// newline-delimited JSON entries named after its index, e.g. wal-000001.log.
+// Only the last segment is written to; older ones are moved to the archive
+// directory once a checkpoint snapshot covers them.
 type FileWAL struct {
+	dir         string
 	file        *os.File
+	segment     uint64
 	mu          sync.Mutex
 	sequence    uint64
 	writeBuffer *bufio.Writer
 	stopFlush   chan struct{}
-	stopCompact chan struct{}
+	subscribers map[*subscriber]struct{}
+	readOnly    bool // opened by NewReadOnlyFileWAL, there is no active segment
 }
 
-func NewFileWAL(path string) (*FileWAL, error) {
+// NewFileWAL opens the log stored in dir, falling back to DEFAULT_LOG_DIR
+// when dir is empty.
+func NewFileWAL(dir string) (*FileWAL, error) {
+	if dir == "" {
+		dir = DEFAULT_LOG_DIR
+	}
 
 	// create folder if not exists
-	if _, err := os.Stat(DEFAULT_LOG_DIR); os.IsNotExist(err) {
-		err := os.Mkdir(DEFAULT_LOG_DIR, 0755)
-		if err != nil {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := migrateLegacyLog(dir); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segment := uint64(1)
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1]
+		if err := trimSegment(filepath.Join(dir, segmentName(segment))); err != nil {
 			return nil, err
 		}
 	}
 
-	// Set proper permissions for log file
-	logPath := filepath.Join(DEFAULT_LOG_DIR, DEFAULT_LOG_FILE)
-
-	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	sequence, err := recoverSequence(dir, segments)
 	if err != nil {
 		return nil, err
 	}
 
 	wal := &FileWAL{
-		file:        file,
-		writeBuffer: bufio.NewWriter(file),
-		stopFlush:   make(chan struct{}),
+		dir:       dir,
+		sequence:  sequence,
+		stopFlush: make(chan struct{}),
+	}
+	if err := wal.openSegment(segment); err != nil {
+		return nil, err
 	}
 
 	// Start periodic flush
 	go wal.periodicFlush()
-	go wal.periodicCompact()
 
 	return wal, nil
 }
 
+// NewReadOnlyFileWAL opens the log stored in dir for reading only, as
+// point-in-time recovery does. Unlike NewFileWAL it creates nothing, doesn't
+// migrate a legacy log and leaves a torn tail where it is; every write
+// returns ErrReadOnly.
+func NewReadOnlyFileWAL(dir string) (*FileWAL, error) {
+	if dir == "" {
+		dir = DEFAULT_LOG_DIR
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		if _, err := os.Stat(filepath.Join(dir, DEFAULT_LOG_FILE)); err == nil {
+			return nil, fmt.Errorf("%s predates segments, open the log once without a recovery target to migrate it", DEFAULT_LOG_FILE)
+		}
+	}
+
+	sequence, err := recoverSequence(dir, segments)
+	if err != nil {
+		return nil, err
+	}
+
+	var segment uint64
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1]
+	}
+	return &FileWAL{
+		dir:      dir,
+		segment:  segment,
+		sequence: sequence,
+		readOnly: true,
+	}, nil
+}
+
 func (w *FileWAL) AppendLog(entry LogEntry) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
 	w.sequence++
 	entry.Sequence = w.sequence
+	entry.Timestamp = time.Now()
+	entry.Checksum = entry.computeChecksum()
 
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return err
 	}
-	_, err = w.writeBuffer.Write(append(data, '\n'))
-	return err
+	if _, err := w.writeBuffer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	w.publish(entry)
+	return nil
 }
 
-func (w *FileWAL) Recover() ([]LogEntry, error) {
+func (w *FileWAL) Recover(target RecoveryTarget) (*Snapshot, []LogEntry, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if err := w.flush(); err != nil {
+		return nil, nil, err
+	}
+
+	if target.IsSet() {
+		return w.recoverUntil(target)
+	}
+
+	snapshot, err := loadLatestSnapshot(w.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var from uint64
+	if snapshot != nil {
+		from = snapshot.Segment
+	}
+
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	var entries []LogEntry
-	if _, err := w.file.Seek(0, 0); err != nil {
-		return nil, err
+	for _, segment := range segments {
+		if segment < from {
+			continue
+		}
+		segmentEntries, _, err := readSegment(filepath.Join(w.dir, segmentName(segment)))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range segmentEntries {
+			// Entries already covered by the snapshot are skipped
+			if snapshot != nil && entry.Sequence <= snapshot.Sequence {
+				continue
+			}
+			entries = append(entries, entry)
+		}
 	}
 
-	// TODO: decode each line individually
-	decoder := json.NewDecoder(w.file)
-	for {
-		var entry LogEntry
-		if err := decoder.Decode(&entry); err != nil {
+	return snapshot, entries, nil
+}
+
+// recoverUntil rebuilds the state as of the target from the newest snapshot
+// taken before it and the live and archived segments written after it.
+func (w *FileWAL) recoverUntil(target RecoveryTarget) (*Snapshot, []LogEntry, error) {
+	archiveDir := filepath.Join(w.dir, ARCHIVE_DIR)
+
+	snapshotPaths, err := listWithArchive(w.dir, archiveDir, SNAPSHOT_PREFIX, SNAPSHOT_SUFFIX)
+	if err != nil {
+		return nil, nil, err
+	}
+	segmentPaths, err := listWithArchive(w.dir, archiveDir, SEGMENT_PREFIX, SEGMENT_SUFFIX)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var snapshot *Snapshot
+	snapshotIndexes := sortedKeys(snapshotPaths)
+	for i := len(snapshotIndexes) - 1; i >= 0; i-- {
+		candidate, err := readSnapshot(snapshotPaths[snapshotIndexes[i]])
+		if err != nil {
+			log.Printf("skipping invalid snapshot %s: %v", snapshotPaths[snapshotIndexes[i]], err)
+			continue
+		}
+		if target.includesSnapshot(candidate) {
+			snapshot = candidate
 			break
 		}
-		entries = append(entries, entry)
 	}
 
-	return entries, nil
+	from := uint64(1)
+	if snapshot != nil {
+		from = snapshot.Segment
+	}
+
+	var entries []LogEntry
+	expected := from
+	for _, segment := range sortedKeys(segmentPaths) {
+		if segment < from {
+			continue
+		}
+		if segment != expected {
+			return nil, nil, fmt.Errorf("cannot recover to target: WAL segment %d is missing", expected)
+		}
+		expected++
+
+		segmentEntries, _, err := readSegment(segmentPaths[segment])
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range segmentEntries {
+			if snapshot != nil && entry.Sequence <= snapshot.Sequence {
+				continue
+			}
+			if !target.includesEntry(entry) {
+				return snapshot, entries, nil
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return snapshot, entries, nil
+}
+
+func (w *FileWAL) Rotate() (uint64, uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+
+	if err := w.closeSegment(); err != nil {
+		return 0, 0, err
+	}
+	if err := w.openSegment(w.segment + 1); err != nil {
+		return 0, 0, err
+	}
+	return w.segment, w.sequence, nil
+}
+
+func (w *FileWAL) Checkpoint(snapshot *Snapshot) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if err := writeSnapshot(w.dir, snapshot); err != nil {
+		return err
+	}
+
+	// Keep the previous snapshot around as a fallback in case the newest one
+	// turns out to be unreadable, along with the segments needed to replay it.
+	snapshots, err := listSnapshots(w.dir)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > SNAPSHOT_RETAIN {
+		for _, index := range snapshots[:len(snapshots)-SNAPSHOT_RETAIN] {
+			if err := archiveFile(w.dir, snapshotName(index)); err != nil {
+				return err
+			}
+		}
+		snapshots = snapshots[len(snapshots)-SNAPSHOT_RETAIN:]
+	}
+
+	if err := w.truncateBefore(snapshots[0]); err != nil {
+		return err
+	}
+	return pruneArchive(w.dir)
+}
+
+func (w *FileWAL) Size() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readOnly {
+		info, err := os.Stat(filepath.Join(w.dir, segmentName(w.segment)))
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() + int64(w.writeBuffer.Buffered()), nil
+}
+
+func (w *FileWAL) LastSequence() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.sequence
 }
 
 func (w *FileWAL) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if w.readOnly {
+		return nil
+	}
+
 	// Stop periodic routines
 	close(w.stopFlush)
-	close(w.stopCompact)
 
 	// Final flush and sync
-	w.writeBuffer.Flush()
-	w.file.Sync()
-	return w.file.Close()
+	return w.closeSegment()
 }
 
 func (w *FileWAL) periodicFlush() {
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(FLUSH_INTERVAL)
 	defer ticker.Stop()
 
 	for {
@@ -148,100 +479,343 @@ func (w *FileWAL) periodicFlush() {
 	}
 }
 
-func (w *FileWAL) compactWAL() error {
+// truncateBefore archives every segment with an index lower than segment.
+// The active segment is never archived.
+func (w *FileWAL) truncateBefore(segment uint64) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Flush current buffer
-	w.writeBuffer.Flush()
-	w.file.Sync()
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, index := range segments {
+		if index >= segment || index == w.segment {
+			continue
+		}
+		if err := archiveFile(w.dir, segmentName(index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *FileWAL) openSegment(segment uint64) error {
+	file, err := os.OpenFile(filepath.Join(w.dir, segmentName(segment)), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.segment = segment
+	w.writeBuffer = bufio.NewWriter(file)
+	return nil
+}
 
-	// Track latest sequence per key
-	latestSequence := make(map[string]uint64)
-	keyEntries := make(map[string]LogEntry)
+// flush writes the buffered entries to the active segment. Called with w.mu
+// held.
+func (w *FileWAL) flush() error {
+	if w.readOnly {
+		return nil
+	}
+	return w.writeBuffer.Flush()
+}
 
-	// Scan existing WAL
-	scanner := bufio.NewScanner(w.file)
-	for scanner.Scan() {
-		var entry LogEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+func (w *FileWAL) closeSegment() error {
+	if err := w.writeBuffer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// segmentScan is the result of decoding a segment up to its first invalid
+// entry.
+type segmentScan struct {
+	entries   []LogEntry
+	unchecked int    // entries written before checksums were added
+	size      int64  // size of the valid prefix
+	total     int64  // size of the whole file
+	problem   string // why decoding stopped early, empty if the segment is valid
+}
+
+// scanSegment decodes a segment line by line. A line that fails to decode,
+// fails its checksum or is missing its trailing newline ends the scan.
+func scanSegment(path string) (*segmentScan, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scan := &segmentScan{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		scan.total += int64(len(line))
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				scan.problem = fmt.Sprintf("incomplete entry at offset %d", scan.size)
+			}
+			return scan, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if scan.problem != "" {
 			continue
 		}
 
-		// Track only the latest sequence for each key
-		if seq, exists := latestSequence[entry.Key]; !exists || entry.Sequence > seq {
-			latestSequence[entry.Key] = entry.Sequence
-			keyEntries[entry.Key] = entry
+		var entry LogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			scan.problem = fmt.Sprintf("corrupted entry at offset %d: %v", scan.size, err)
+			continue
+		}
+		if entry.Checksum == 0 {
+			scan.unchecked++
+		} else if entry.Checksum != entry.computeChecksum() {
+			scan.problem = fmt.Sprintf("checksum mismatch for sequence %d at offset %d", entry.Sequence, scan.size)
+			continue
 		}
+		scan.entries = append(scan.entries, entry)
+		scan.size += int64(len(line))
 	}
+}
 
-	// Create temp file
-	tempPath := w.file.Name() + ".tmp"
-	tempFile, err := os.Create(tempPath)
+// readSegment returns the valid entries of a segment and the size of its
+// valid prefix. Anything after the first invalid entry is treated as a torn
+// write and ignored.
+func readSegment(path string) ([]LogEntry, int64, error) {
+	scan, err := scanSegment(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if scan.problem != "" {
+		log.Printf("WAL segment %s: ignoring %d bytes after %s", path, scan.total-scan.size, scan.problem)
+	}
+	return scan.entries, scan.size, nil
+}
+
+// trimSegment cuts a torn write off the end of a segment so that new
+// entries are not appended to a partial line.
+func trimSegment(path string) error {
+	scan, err := scanSegment(path)
 	if err != nil {
 		return err
 	}
-	tempWriter := bufio.NewWriter(tempFile)
+	if scan.problem == "" {
+		return nil
+	}
+	log.Printf("WAL segment %s: truncating %d bytes of torn tail after %s", path, scan.total-scan.size, scan.problem)
+	return os.Truncate(path, scan.size)
+}
 
-	// Write only latest entries
-	for _, entry := range keyEntries {
-		data, err := json.Marshal(entry)
+// recoverSequence returns the highest sequence found in the log tail or in
+// the newest snapshot, so new entries never reuse a sequence after a restart.
+func recoverSequence(dir string, segments []uint64) (uint64, error) {
+	var sequence uint64
+
+	snapshot, err := loadLatestSnapshot(dir)
+	if err != nil {
+		return 0, err
+	}
+	if snapshot != nil {
+		sequence = snapshot.Sequence
+	}
+
+	// Walk back from the newest segment until one holds entries
+	for i := len(segments) - 1; i >= 0; i-- {
+		entries, _, err := readSegment(filepath.Join(dir, segmentName(segments[i])))
 		if err != nil {
-			tempFile.Close()
-			os.Remove(tempPath)
-			return err
+			return 0, err
 		}
-		if _, err := tempWriter.Write(append(data, '\n')); err != nil {
-			tempFile.Close()
-			os.Remove(tempPath)
-			return err
+		if len(entries) == 0 {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Sequence > sequence {
+				sequence = entry.Sequence
+			}
 		}
+		break
+	}
+	return sequence, nil
+}
+
+func segmentName(segment uint64) string {
+	return fmt.Sprintf("%s%06d%s", SEGMENT_PREFIX, segment, SEGMENT_SUFFIX)
+}
+
+// listSegments returns the indexes of the segments in dir in ascending order.
+func listSegments(dir string) ([]uint64, error) {
+	return listIndexed(dir, SEGMENT_PREFIX, SEGMENT_SUFFIX)
+}
+
+func listIndexed(dir, prefix, suffix string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
 
-	// Flush and rotate
-	tempWriter.Flush()
-	tempFile.Sync()
-	tempFile.Close()
+	var indexes []uint64
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		index, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes, nil
+}
 
-	oldPath := w.file.Name()
-	w.file.Close()
+// listWithArchive maps the indexes of the files in dir and archiveDir to
+// their paths. Files in dir win over archived copies with the same index.
+func listWithArchive(dir, archiveDir, prefix, suffix string) (map[uint64]string, error) {
+	paths := make(map[uint64]string)
 
-	if err := os.Rename(tempPath, oldPath); err != nil {
+	archived, err := listIndexed(archiveDir, prefix, suffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, index := range archived {
+		paths[index] = filepath.Join(archiveDir, fmt.Sprintf("%s%06d%s", prefix, index, suffix))
+	}
+
+	live, err := listIndexed(dir, prefix, suffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range live {
+		paths[index] = filepath.Join(dir, fmt.Sprintf("%s%06d%s", prefix, index, suffix))
+	}
+	return paths, nil
+}
+
+func sortedKeys(paths map[uint64]string) []uint64 {
+	keys := make([]uint64, 0, len(paths))
+	for key := range paths {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// archiveFile moves a truncated segment or an old snapshot into the archive
+// directory, where it stays available for point-in-time recovery. The
+// modification time of the archived file is set to when it was archived,
+// pruning goes by it.
+func archiveFile(dir, name string) error {
+	archiveDir := filepath.Join(dir, ARCHIVE_DIR)
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return err
+	}
+	archived := filepath.Join(archiveDir, name)
+	if err := os.Rename(filepath.Join(dir, name), archived); err != nil {
 		return err
 	}
+	now := time.Now()
+	return os.Chtimes(archived, now, now)
+}
 
-	// Reopen WAL
-	file, err := os.OpenFile(oldPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+// pruneArchive removes archived generations that were archived longer than
+// ARCHIVE_RETENTION ago. A generation is a snapshot with the segments
+// replayed on top of it up to the next snapshot, the segments written before
+// the first snapshot are one too. Generations go whole and oldest first, so
+// every snapshot left keeps the segments it needs and no segment is left
+// without a snapshot or the start of the log to replay it from.
+func pruneArchive(dir string) error {
+	archiveDir := filepath.Join(dir, ARCHIVE_DIR)
+	archivedSnapshots, err := listIndexed(archiveDir, SNAPSHOT_PREFIX, SNAPSHOT_SUFFIX)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	archivedSegments, err := listIndexed(archiveDir, SEGMENT_PREFIX, SEGMENT_SUFFIX)
+	if err != nil {
+		return err
+	}
+	liveSnapshots, err := listSnapshots(dir)
 	if err != nil {
 		return err
 	}
-	w.file = file
-	w.writeBuffer = bufio.NewWriter(file)
 
-	return nil
-}
+	// a generation starts at the segment its snapshot replays from, the
+	// first one at the start of the log
+	starts := map[uint64]bool{1: true}
+	for _, index := range append(archivedSnapshots, liveSnapshots...) {
+		starts[index] = true
+	}
+	boundaries := make([]uint64, 0, len(starts))
+	for index := range starts {
+		boundaries = append(boundaries, index)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+	isArchivedSnapshot := make(map[uint64]bool, len(archivedSnapshots))
+	for _, index := range archivedSnapshots {
+		isArchivedSnapshot[index] = true
+	}
 
-func (w *FileWAL) periodicCompact() {
-	ticker := time.NewTicker(COMPACT_INTERVAL)
-	defer ticker.Stop()
+	cutoff := time.Now().Add(-ARCHIVE_RETENTION)
+	for i := 0; i+1 < len(boundaries); i++ {
+		start, end := boundaries[i], boundaries[i+1]
+		var names []string
+		if isArchivedSnapshot[start] {
+			names = append(names, snapshotName(start))
+		}
+		for _, index := range archivedSegments {
+			if index >= start && index < end {
+				names = append(names, segmentName(index))
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
 
-	for {
-		select {
-		case <-ticker.C:
-			// Check file size
-			info, err := w.file.Stat()
+		// the generation was archived when its last file was
+		var archivedAt time.Time
+		for _, name := range names {
+			info, err := os.Stat(filepath.Join(archiveDir, name))
 			if err != nil {
-				continue
+				return err
 			}
-
-			// Compact if file size exceeds threshold
-			if info.Size() > COMPACT_THRESHOLD {
-				if err := w.compactWAL(); err != nil {
-					log.Printf("WAL compaction failed: %v", err)
-				}
+			if info.ModTime().After(archivedAt) {
+				archivedAt = info.ModTime()
 			}
-		case <-w.stopCompact:
-			return
 		}
+		if !archivedAt.Before(cutoff) {
+			return nil
+		}
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(archiveDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateLegacyLog turns a single-file wal.log from older versions into the
+// first segment.
+func migrateLegacyLog(dir string) error {
+	legacyPath := filepath.Join(dir, DEFAULT_LOG_FILE)
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		return nil
 	}
+	return os.Rename(legacyPath, filepath.Join(dir, segmentName(1)))
 }
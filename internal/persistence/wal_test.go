@@ -1,17 +1,510 @@
 package wal_test
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	wal "github.com/sk25469/kv/internal/persistence"
 )
 
+func appendEntries(t *testing.T, w *wal.FileWAL, entries ...wal.LogEntry) {
+	t.Helper()
+	for _, entry := range entries {
+		if err := w.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog(%v): %v", entry, err)
+		}
+	}
+}
+
 func TestFileWAL_AppendLog(t *testing.T) {
-	t.Skip("TODO: implement")
+	w, err := wal.NewFileWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"},
+		wal.LogEntry{Operation: wal.SET, Key: "b", Value: "2"},
+		wal.LogEntry{Operation: wal.DELETE, Key: "a"},
+	)
+
+	_, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Sequence != uint64(i+1) {
+			t.Errorf("entry %d: expected sequence %d, got %d", i, i+1, entry.Sequence)
+		}
+	}
+	if entries[2].Operation != wal.DELETE || entries[2].Key != "a" {
+		t.Errorf("unexpected last entry: %+v", entries[2])
+	}
 }
 
 func TestFileWAL_Recover(t *testing.T) {
-	t.Skip("TODO: implement")
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, w, wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a torn write at the tail of the log
+	segment := filepath.Join(dir, "wal-000001.log")
+	file, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"operation":"SET","key":"b","val`)
+	file.Close()
+
+	w, err = wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	snapshot, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot != nil {
+		t.Errorf("expected no snapshot, got %+v", snapshot)
+	}
+	if len(entries) != 1 || entries[0].Key != "a" {
+		t.Fatalf("expected only the complete entry, got %+v", entries)
+	}
+
+	// The sequence carries on from the log tail instead of starting over
+	if w.LastSequence() != 1 {
+		t.Fatalf("expected recovered sequence 1, got %d", w.LastSequence())
+	}
+	appendEntries(t, w, wal.LogEntry{Operation: wal.SET, Key: "c", Value: "3"})
+	_, entries, err = w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Key != "c" || entries[1].Sequence != 2 {
+		t.Fatalf("expected new entry after the torn tail with sequence 2, got %+v", entries)
+	}
+}
+
+func TestFileWAL_SequenceFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"},
+		wal.LogEntry{Operation: wal.SET, Key: "b", Value: "2"},
+	)
+	segment, sequence, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &wal.Snapshot{Sequence: sequence, Segment: segment, CreatedAt: time.Now(), Data: map[string]string{"a": "1", "b": "2"}}
+	if err := w.Checkpoint(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// Every entry now lives in the snapshot, the active segment is empty
+	w, err = wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.LastSequence() != 2 {
+		t.Fatalf("expected sequence 2 from the snapshot, got %d", w.LastSequence())
+	}
+}
+
+func TestFileWAL_SnapshotMeta(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := wal.KeyMeta{Flags: 42, ExpiresAt: time.Now().Add(time.Hour).UnixMilli()}
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1", KeyMeta: meta},
+		wal.LogEntry{Operation: wal.SET, Key: "b", Value: "2"},
+	)
+	segment, sequence, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &wal.Snapshot{
+		Sequence:  sequence,
+		Segment:   segment,
+		CreatedAt: time.Now(),
+		Data:      map[string]string{"a": "1", "b": "2"},
+		Meta:      map[string]wal.KeyMeta{"a": meta},
+	}
+	if err := w.Checkpoint(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, w, wal.LogEntry{Operation: wal.SET, Key: "c", Value: "3", KeyMeta: wal.KeyMeta{Flags: 7}})
+	w.Close()
+
+	w, err = wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	recovered, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered == nil || recovered.Meta["a"] != meta || len(recovered.Meta) != 1 {
+		t.Fatalf("expected the metadata of a in the snapshot, got %+v", recovered)
+	}
+	if len(entries) != 1 || entries[0].Flags != 7 {
+		t.Fatalf("expected the flags of c in the WAL tail, got %+v", entries)
+	}
 }
 
 func TestFileWAL_Close(t *testing.T) {
-	t.Skip("TODO: implement")
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, w, wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buffered entries must be on disk once the WAL is closed
+	data, err := os.ReadFile(filepath.Join(dir, "wal-000001.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		t.Fatal("expected WAL segment to be flushed on close")
+	}
+}
+
+func TestFileWAL_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		appendEntries(t, w, wal.LogEntry{Operation: wal.SET, Key: "k", Value: "v"})
+		segment, sequence, err := w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Checkpoint(&wal.Snapshot{
+			Sequence:  sequence,
+			Segment:   segment,
+			CreatedAt: time.Now(),
+			Data:      map[string]string{"k": "v"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendEntries(t, w, wal.LogEntry{Operation: wal.DELETE, Key: "k"})
+
+	snapshot, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || snapshot.Sequence != 3 || snapshot.Data["k"] != "v" {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	if len(entries) != 1 || entries[0].Operation != wal.DELETE {
+		t.Fatalf("expected only the entry after the checkpoint, got %+v", entries)
+	}
+
+	// Only the previous checkpoint's segments are kept as a fallback
+	if _, err := os.Stat(filepath.Join(dir, "wal-000001.log")); !os.IsNotExist(err) {
+		t.Errorf("expected first segment to be truncated")
+	}
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "snapshot-*.snap"))
+	if len(snapshots) != wal.SNAPSHOT_RETAIN {
+		t.Errorf("expected %d snapshots, got %v", wal.SNAPSHOT_RETAIN, snapshots)
+	}
+
+	// A corrupted newest snapshot falls back to the previous one
+	os.WriteFile(filepath.Join(dir, "snapshot-000004.snap"), []byte("garbage\n"), 0644)
+	snapshot, entries, err = w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || snapshot.Segment != 3 || len(entries) != 2 {
+		t.Fatalf("expected fallback to previous snapshot, got %+v with %d entries", snapshot, len(entries))
+	}
+}
+
+func TestFileWAL_RecoverUntil(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"},
+		wal.LogEntry{Operation: wal.SET, Key: "b", Value: "2"},
+	)
+	for i := 0; i < wal.SNAPSHOT_RETAIN+1; i++ {
+		appendEntries(t, w, wal.LogEntry{Operation: wal.DELETE, Key: "a"})
+		segment, sequence, err := w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Checkpoint(&wal.Snapshot{Sequence: sequence, Segment: segment, CreatedAt: time.Now(), Data: map[string]string{"b": "2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first segment has been archived but is still usable
+	if _, err := os.Stat(filepath.Join(dir, wal.ARCHIVE_DIR, "wal-000001.log")); err != nil {
+		t.Fatalf("expected first segment in the archive: %v", err)
+	}
+
+	snapshot, entries, err := w.Recover(wal.RecoveryTarget{Sequence: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot != nil {
+		t.Fatalf("expected no snapshot before sequence 2, got %+v", snapshot)
+	}
+	if len(entries) != 2 || entries[1].Key != "b" {
+		t.Fatalf("expected the first two entries, got %+v", entries)
+	}
+
+	snapshot, entries, err = w.Recover(wal.RecoveryTarget{Time: entries[1].Timestamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot != nil || len(entries) != 2 {
+		t.Fatalf("expected the first two entries by time, got %+v and %+v", snapshot, entries)
+	}
+}
+
+func TestReadOnlyFileWALLeavesTheLogAsItIs(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"},
+		wal.LogEntry{Operation: wal.SET, Key: "b", Value: "2"},
+	)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segment := filepath.Join(dir, "wal-000001.log")
+	file, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"operation":"SET","key":"c","val`)
+	file.Close()
+	before, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = wal.NewReadOnlyFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, entries, err := w.Recover(wal.RecoveryTarget{Sequence: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "a" {
+		t.Fatalf("expected the first entry, got %+v", entries)
+	}
+	if err := w.AppendLog(wal.LogEntry{Operation: wal.SET, Key: "d", Value: "4"}); err != wal.ErrReadOnly {
+		t.Errorf("AppendLog on a read-only log: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("the read-only open changed the segment from %q to %q", before, after)
+	}
+	if _, err := wal.NewReadOnlyFileWAL(filepath.Join(dir, "missing")); err == nil {
+		t.Error("opened a log dir that doesn't exist")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("the read-only open created the log dir: %v", err)
+	}
+}
+
+func TestFileWAL_Stream(t *testing.T) {
+	w, err := wal.NewFileWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	appendEntries(t, w,
+		wal.LogEntry{Operation: wal.SET, Key: "a", Value: "1"},
+		wal.LogEntry{Operation: wal.SET, Key: "b", Value: "2"},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan wal.LogEntry)
+	go w.Stream(ctx, 1, func(entry wal.LogEntry) error {
+		received <- entry
+		return nil
+	})
+
+	// One entry from disk, then one delivered live
+	if entry := <-received; entry.Sequence != 2 || entry.Key != "b" {
+		t.Fatalf("unexpected retained entry: %+v", entry)
+	}
+	appendEntries(t, w, wal.LogEntry{Operation: wal.DELETE, Key: "a"})
+	if entry := <-received; entry.Sequence != 3 || entry.Operation != wal.DELETE {
+		t.Fatalf("unexpected live entry: %+v", entry)
+	}
+}
+
+func TestFileWAL_Batch(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, w, wal.LogEntry{
+		Operation: wal.BATCH,
+		Entries: []wal.LogEntry{
+			{Operation: wal.SET, Key: "a", Value: "1"},
+			{Operation: wal.DELETE, Key: "b"},
+		},
+	})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch cut short by a crash is dropped as a whole
+	segment := filepath.Join(dir, "wal-000001.log")
+	file, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"operation":"BATCH","key":"","entries":[{"operation":"SET","key":"c","value":"3"},`)
+	file.Close()
+
+	w, err = wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	_, entries, err := w.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Operation != wal.BATCH || entries[0].Sequence != 1 {
+		t.Fatalf("expected the complete batch only, got %+v", entries)
+	}
+	if len(entries[0].Entries) != 2 || entries[0].Entries[0].Key != "a" || entries[0].Entries[1].Operation != wal.DELETE {
+		t.Fatalf("unexpected batch writes: %+v", entries[0].Entries)
+	}
+}
+
+func TestFileWAL_PruneArchiveByGeneration(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.NewFileWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	checkpoint := func() {
+		t.Helper()
+		appendEntries(t, w, wal.LogEntry{Operation: wal.SET, Key: "k", Value: "v"})
+		segment, sequence, err := w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Checkpoint(&wal.Snapshot{Sequence: sequence, Segment: segment, CreatedAt: time.Now(), Data: map[string]string{"k": "v"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		checkpoint()
+	}
+
+	// The archive holds segment 1 from before the first snapshot, then
+	// snapshot 2 with segment 2 and snapshot 3 with segment 3. Only part of
+	// the generation of snapshot 2 is past the retention.
+	archive := filepath.Join(dir, wal.ARCHIVE_DIR)
+	old := time.Now().Add(-wal.ARCHIVE_RETENTION - time.Hour)
+	for _, name := range []string{"wal-000001.log", "snapshot-000002.snap", "snapshot-000003.snap", "wal-000003.log"} {
+		if err := os.Chtimes(filepath.Join(archive, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkpoint()
+
+	if _, err := os.Stat(filepath.Join(archive, "wal-000001.log")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired segments before the first snapshot to be pruned")
+	}
+	// the generation of snapshot 2 is kept whole, and with it the newer
+	// generation of snapshot 3
+	for _, name := range []string{"snapshot-000002.snap", "wal-000002.log", "snapshot-000003.snap", "wal-000003.log"} {
+		if _, err := os.Stat(filepath.Join(archive, name)); err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+	// with snapshot 3 unreadable, recovering to its sequence needs the
+	// previous generation to be whole
+	os.WriteFile(filepath.Join(archive, "snapshot-000003.snap"), []byte("garbage\n"), 0644)
+	os.Chtimes(filepath.Join(archive, "snapshot-000003.snap"), old, old)
+	snapshot, entries, err := w.Recover(wal.RecoveryTarget{Sequence: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot == nil || snapshot.Segment != 2 || len(entries) != 1 {
+		t.Fatalf("expected snapshot 2 and one entry, got %+v and %+v", snapshot, entries)
+	}
+
+	// once the generation of snapshot 2 expired it goes as a whole
+	if err := os.Chtimes(filepath.Join(archive, "wal-000002.log"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint()
+	for _, name := range []string{"snapshot-000002.snap", "wal-000002.log", "snapshot-000003.snap", "wal-000003.log"} {
+		if _, err := os.Stat(filepath.Join(archive, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be pruned", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(archive, "snapshot-000004.snap")); err != nil {
+		t.Errorf("expected the generation archived last to be kept: %v", err)
+	}
 }
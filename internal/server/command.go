@@ -1,9 +1,9 @@
 package server
 
 import (
-	"fmt"
 	"log"
 	"strings"
+	"unicode"
 
 	models "github.com/sk25469/kv/internal/model"
 	"github.com/sk25469/kv/utils"
@@ -13,8 +13,9 @@ import (
 type Command struct {
 	Name           string // Name of the command
 	CollectionName string
-	Args           []string // Arguments of the command
-	Result         string   // Result of the command execution
+	Args           []string  // Arguments of the command
+	Result         string    // Result of the command execution
+	Batch          []Command `json:",omitempty"` // Writes of a committed transaction
 }
 
 // ParseCommand parses a raw command string into a Command struct
@@ -34,6 +35,11 @@ func ParseCommand(rawCommand string) *Command {
 	if len(parts) > 2 {
 		Args = parts[2:]
 	}
+	// the writes of a PREPARE are JSON, whose strings can hold any
+	// whitespace, so they are kept as they were sent
+	if parts[0] == utils.PREPARE && len(parts) > 2 {
+		Args = []string{skipFields(rawCommand, 2)}
+	}
 
 	// Create a new Command struct and populate its fields
 	cmd := &Command{
@@ -45,15 +51,34 @@ func ParseCommand(rawCommand string) *Command {
 	return cmd
 }
 
+// skipFields returns what is left of s after its first n fields, trimmed.
+func skipFields(s string, n int) string {
+	for i := 0; i < n; i++ {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		s = s[end:]
+	}
+	return strings.TrimSpace(s)
+}
+
 // ExecuteCommand executes a command and returns the result
-func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub) string {
+func ExecuteCommand(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub) string {
+	if cc.ClientState.State == utils.QUEUING && !isMultiCommand(cmd.Name) {
+		return queueCommand(cmd, cc)
+	}
+
 	switch cmd.Name {
+	case utils.HELLO:
+		return hello(cmd, cc, kv)
 	case "AUTH":
 		if !kv.Config.ProtectedMode {
 			return "No need of password without protected mode"
 		}
 		if len(cmd.Args) < 1 {
-			return "Usage: AUTH <username> <password>"
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: AUTH <username> <password>")
 		}
 		username := cmd.CollectionName
 		password := cmd.Args[0]
@@ -65,64 +90,214 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		return result
 	case "BEGIN":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		if cc.ClientState.State == utils.TRANSACTIONAL {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction already started")
 		}
-		ts.BeginTransaction()
+		cc.Transaction = models.NewTransactionalKeyValueStore()
 		cc.ClientState.State = utils.TRANSACTIONAL
 		return "OK"
 	case "COMMIT":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
-		ts.ExecTransaction()
-		cc.ClientState.State = utils.ACTIVE
+		if cc.ClientState.State == utils.TRANSACTIONAL {
+			// the transaction stays open when a key is locked, so the client
+			// can retry or roll back
+			var reply string
+			var locked bool
+			cs.Exec(nil, func(tx *models.CollectionTx) {
+				for _, write := range cc.Transaction.Writes() {
+					if reply, locked = keyLocked(write.Collection, write.Key, cs, cc, kv); locked {
+						return
+					}
+				}
+				for _, write := range cc.Transaction.ExecTransaction() {
+					tx.Set(write.Collection, write.Key, write.Value)
+				}
+			})
+			if locked {
+				return reply
+			}
+			cc.Transaction = nil
+			cc.ClientState.State = utils.ACTIVE
+			releaseLocks(cc, kv)
+			return "OK"
+		}
+		if len(cmd.Batch) == 0 {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
+		}
+		// a transaction replayed from the dump or replicated from the master
+		cs.ApplyTransaction(BatchWrites(cmd.Batch))
 		return "OK"
 	case "ROLLBACK":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
-		ts.RollbackTransaction()
+		if cc.ClientState.State != utils.TRANSACTIONAL {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
+		}
+		// ROLLBACK TO <savepoint> keeps the transaction open
+		if strings.EqualFold(cmd.CollectionName, "TO") {
+			if len(cmd.Args) < 1 {
+				return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: ROLLBACK TO <savepoint>")
+			}
+			if err := cc.Transaction.RollbackToSavepoint(cmd.Args[0]); err != nil {
+				return utils.FormatError(err)
+			}
+			return "OK"
+		}
+		cc.Transaction.RollbackTransaction()
+		cc.Transaction = nil
 		cc.ClientState.State = utils.ACTIVE
+		releaseLocks(cc, kv)
+		return "OK"
+	case "SAVEPOINT":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		if cc.ClientState.State != utils.TRANSACTIONAL {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
+		}
+		if cmd.CollectionName == "" {
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: SAVEPOINT <name>")
+		}
+		cc.Transaction.Savepoint(cmd.CollectionName)
+		return "OK"
+	case "RELEASE":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		if cc.ClientState.State != utils.TRANSACTIONAL {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
+		}
+		if cmd.CollectionName == "" {
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: RELEASE <savepoint>")
+		}
+		if err := cc.Transaction.ReleaseSavepoint(cmd.CollectionName); err != nil {
+			return utils.FormatError(err)
+		}
+		return "OK"
+	case "LOCK":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		return lockKey(cmd, cs, cc, kv)
+	case "UNLOCK":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		if cc.ClientState.State != utils.TRANSACTIONAL {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
+		}
+		if len(cmd.Args) < 1 {
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: UNLOCK <collection> <key>")
+		}
+		if !kv.Locks.Unlock(cc.ClientID, models.WatchedKey{Collection: cmd.CollectionName, Key: cmd.Args[0]}) {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "key is not locked by this client")
+		}
 		return "OK"
 	case "TSET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
 		if cc.ClientState.State != utils.TRANSACTIONAL {
-			return "ERROR: Transaction not started"
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
 		}
 		if len(cmd.Args) < 2 {
-			return "Usage: TSET <collection_name> <key> <value>"
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: TSET <collection_name> <key> <value>")
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
 		value := strings.Join(cmd.Args[1:], " ")
-		ts.Set(collectionName, key, value)
+		cc.Transaction.Set(collectionName, key, value)
 		return "OK"
 	case "TGET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
 		if cc.ClientState.State != utils.TRANSACTIONAL {
-			return "ERROR: Transaction not started"
+			return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
 		}
 		if len(cmd.Args) < 1 {
-			return "Usage: TSET <collection_name> <key> <value>"
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: TGET <collection_name> <key>")
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
-		val, err := ts.Get(collectionName, key)
-		if err != nil {
-			log.Printf("error getting key from transaction: %v", err)
-			return "ERROR"
+		// read your own writes first, then the committed data
+		if val, err := cc.Transaction.Get(collectionName, key); err == nil {
+			return val
+		}
+		return cs.GetKeyInCollection(collectionName, key)
+	case "WATCH":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		return watchKeys(cmd, cs, cc)
+	case "UNWATCH":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		cc.Watched = nil
+		return "OK"
+	case "MULTI":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		if cc.ClientState.State == utils.QUEUING {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "MULTI calls can not be nested")
+		}
+		if cc.ClientState.State == utils.TRANSACTIONAL {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "MULTI inside a transaction is not allowed")
+		}
+		cc.Queue = nil
+		cc.ClientState.State = utils.QUEUING
+		return "OK"
+	case "EXEC":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		if cc.ClientState.State == utils.QUEUING {
+			return execQueued(cmd, cs, cc, kv)
+		}
+		if len(cmd.Batch) == 0 {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "EXEC without MULTI")
+		}
+		// an EXEC replayed from the dump or replicated from the master
+		replayExec(cmd.Batch, cs)
+		return "OK"
+	case "DISCARD":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		if cc.ClientState.State != utils.QUEUING {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "DISCARD without MULTI")
+		}
+		cc.Queue, cc.Watched = nil, nil
+		cc.ClientState.State = utils.ACTIVE
+		return "OK"
+	case "PREPARE":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		return prepareTransaction(cmd, cs, cc, kv)
+	case "COMMIT-PREPARED":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
-		return val
+		return commitPrepared(cmd, cs)
+	case "ABORT-PREPARED":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		return abortPrepared(cmd, cs)
 	case "SET-TTL":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
-		if len(cmd.Args) < 1 {
-			return "Usage: SET-TTL <collection> <key> <ttl>"
+		if len(cmd.Args) < 2 {
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: SET-TTL <collection> <key> <ttl>")
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
@@ -130,35 +305,37 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		duration, err := utils.ParseDuration(ttl)
 		if err != nil {
 			log.Printf("invalid time format: %v", err)
-			return "Usage: SET-TTL <collection> <key> <ttl (xm xhxm xxs)>"
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: SET-TTL <collection> <key> <ttl (xm xhxm xxs)>")
 		}
-		cs.UpdateKeyInCollectionWithTTL(collectionName, key, duration)
-		return "OK"
+		return lockedWrite(cmd, cs, cc, kv, func(tx *models.CollectionTx) {
+			tx.UpdateTTL(collectionName, key, duration)
+		})
 	case "SET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
 		if len(cmd.Args) < 2 {
-			return "Usage: SET <collection> <key> <value>"
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: SET <collection> <key> <value>")
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
 		value := strings.Join(cmd.Args[1:], " ")
-		cs.SetKeyInCollection(collectionName, key, value)
-		return "OK"
+		return lockedWrite(cmd, cs, cc, kv, func(tx *models.CollectionTx) {
+			tx.Set(collectionName, key, value)
+		})
 	case "GET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
 		if len(cmd.Args) < 1 {
-			return "Usage: GET <collection> <key>"
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: GET <collection> <key>")
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
 		return cs.GetKeyInCollection(collectionName, key)
 	case "SHOWALL":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
 		result := cs.GetAllKeyValues()
 		jsonString, err := utils.MapToJSON(result)
@@ -168,7 +345,7 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		return jsonString
 	case "SHOW":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
 		collectionName := cmd.CollectionName
 		result := cs.GetAllKeyValuesInCollection(collectionName)
@@ -179,23 +356,76 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		return jsonString
 	case "DELETE":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
-			return "unauthorized"
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
 		}
 		if len(cmd.Args) < 1 {
-			return "Usage: DELETE <collection> <key>"
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: DELETE <collection> <key>")
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
-		cs.DeleteKeyInCollection(collectionName, key)
-		return "OK"
+		return lockedWrite(cmd, cs, cc, kv, func(tx *models.CollectionTx) {
+			tx.Delete(collectionName, key)
+		})
+	case utils.MGET, utils.MSET, utils.MDEL:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "unauthorized")
+		}
+		return executeMultiKey(cmd, cs, cc, kv)
 	default:
-		return fmt.Sprintf("Unknown command: %s", cmd.Name)
+		return utils.ErrorReply(utils.ERROR_UNKNOWN, "Unknown command: %s", cmd.Name)
 	}
 }
 
+// ShouldWriteLog reports whether the command is written to the dump once it
+// ran. Transaction commands leave the writes to log in cmd.Batch and are not
+// logged if it is empty.
 func ShouldWriteLog(cmd Command) bool {
-	if cmd.Name == utils.SET || cmd.Name == utils.DEL || cmd.Name == utils.SET_TTL || cmd.Name == utils.SUBSCRIBE || cmd.Name == utils.PUBLISH {
+	switch cmd.Name {
+	case utils.COMMIT, utils.EXEC, utils.PREPARE, utils.COMMIT_PREPARED, utils.ABORT_PREPARED:
+		return len(cmd.Batch) > 0
+	}
+	if cmd.Name == utils.SET || cmd.Name == utils.DEL || cmd.Name == utils.MSET || cmd.Name == utils.MDEL || cmd.Name == utils.SET_TTL || cmd.Name == utils.SUBSCRIBE || cmd.Name == utils.PUBLISH {
 		return true
 	}
 	return false
 }
+
+// ShouldLogResult reports whether a command that ran with the given reply is
+// written to the dump. A write that was refused, by a lock for instance, must
+// not be replayed, and queued commands are logged with the EXEC running them.
+func ShouldLogResult(cmd Command, result string, clientConfig *models.ClientConfig) bool {
+	if _, failed := utils.ParseErrorReply(result); failed {
+		return false
+	}
+	return clientConfig.ClientState.State != utils.QUEUING && ShouldWriteLog(cmd)
+}
+
+// TransactionBatch turns the writes of a transaction into the SET commands
+// logged with its COMMIT.
+func TransactionBatch(writes []models.TransactionWrite) []Command {
+	batch := make([]Command, 0, len(writes))
+	for _, write := range writes {
+		batch = append(batch, Command{
+			Name:           utils.SET,
+			CollectionName: write.Collection,
+			Args:           []string{write.Key, write.Value},
+		})
+	}
+	return batch
+}
+
+// BatchWrites is the inverse of TransactionBatch.
+func BatchWrites(batch []Command) []models.TransactionWrite {
+	writes := make([]models.TransactionWrite, 0, len(batch))
+	for _, cmd := range batch {
+		if cmd.Name != utils.SET || len(cmd.Args) < 2 {
+			continue
+		}
+		writes = append(writes, models.TransactionWrite{
+			Collection: cmd.CollectionName,
+			Key:        cmd.Args[0],
+			Value:      strings.Join(cmd.Args[1:], " "),
+		})
+	}
+	return writes
+}
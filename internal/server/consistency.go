@@ -12,7 +12,7 @@ import (
 	models "github.com/sk25469/kv/internal/model"
 )
 
-func WatchSnapshotAndUpdate(file string, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub) {
+func WatchSnapshotAndUpdate(file string, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub) {
 	// Initialize the file watcher
 	err := waitUntilFind(file)
 	if err != nil {
@@ -32,7 +32,7 @@ func WatchSnapshotAndUpdate(file string, cs *models.CollectionStore, ts *models.
 
 	errCh := make(chan error)
 
-	go handleFileEvent(watcher, file, errCh, cs, ts, kvServer, ps)
+	go handleFileEvent(watcher, file, errCh, cs, kvServer, ps)
 	<-errCh
 
 }
@@ -53,7 +53,7 @@ func waitUntilFind(filename string) error {
 	return nil
 }
 
-func handleFileEvent(watcher *fsnotify.Watcher, file string, errCh chan error, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub) {
+func handleFileEvent(watcher *fsnotify.Watcher, file string, errCh chan error, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub) {
 	var lastPosition int64 = 0 // Keep track of the last read position
 	absFilePath, _ := filepath.Abs(file)
 	log.Printf("Absolute path being watched: %s", absFilePath)
@@ -96,7 +96,7 @@ func handleFileEvent(watcher *fsnotify.Watcher, file string, errCh chan error, c
 				}
 
 				log.Printf("Last Entry: %s", lastEntry)
-				result := ReplicateChanges(lastEntry, cs, ts, kvServer, ps)
+				result := ReplicateChanges(lastEntry, cs, kvServer, ps)
 				log.Printf("result for replication: %v -------- %v", lastEntry, result)
 
 				file.Close()
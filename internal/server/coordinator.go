@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	models "github.com/sk25469/kv/internal/model"
+)
+
+// States of a distributed transaction in the decision log
+const (
+	TX_PREPARING = "PREPARING"
+	TX_COMMIT    = "COMMIT"
+	TX_ABORT     = "ABORT"
+	TX_DONE      = "DONE"
+)
+
+// decisionRecord is a line of the decision log.
+type decisionRecord struct {
+	TxID         string    `json:"tx_id"`
+	State        string    `json:"state"`
+	Participants []string  `json:"participants,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+type CoordinatorParams struct {
+	DecisionLogPath string
+	// Route returns the id of the participant owning the key
+	Route func(collection, key string) string
+	// Participant resolves a participant id returned by Route
+	Participant func(id string) (Participant, error)
+}
+
+// Coordinator runs transactions spanning several shards with a two-phase
+// commit. The participants are recorded before they are asked to prepare and
+// the decision is synced to the log before any of them is told, so Recover
+// can finish every transaction that was in flight when the proxy stopped.
+type Coordinator struct {
+	logPath     string
+	route       func(collection, key string) string
+	participant func(id string) (Participant, error)
+	mu          sync.Mutex // serializes writes to the decision log
+}
+
+func NewCoordinator(params CoordinatorParams) *Coordinator {
+	return &Coordinator{
+		logPath:     params.DecisionLogPath,
+		route:       params.Route,
+		participant: params.Participant,
+	}
+}
+
+// Execute applies the writes on every shard owning one of their keys, or on
+// none of them. It returns the id of the transaction.
+func (c *Coordinator) Execute(writes []models.TransactionWrite) (string, error) {
+	if len(writes) == 0 {
+		return "", fmt.Errorf("transaction has no writes")
+	}
+
+	txID := uuid.New().String()
+	groups := make(map[string][]models.TransactionWrite)
+	for _, write := range writes {
+		id := c.route(write.Collection, write.Key)
+		groups[id] = append(groups[id], write)
+	}
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if err := c.logDecision(txID, TX_PREPARING, ids); err != nil {
+		return "", err
+	}
+
+	var prepareErr error
+	for _, id := range ids {
+		participant, err := c.participant(id)
+		if err == nil {
+			err = participant.Prepare(txID, groups[id])
+		}
+		if err != nil {
+			prepareErr = fmt.Errorf("prepare on %s failed: %v", id, err)
+			break
+		}
+	}
+
+	decision := TX_COMMIT
+	if prepareErr != nil {
+		decision = TX_ABORT
+	}
+	if err := c.logDecision(txID, decision, ids); err != nil {
+		// nothing is decided until the log says so, Recover aborts it
+		return "", err
+	}
+
+	if err := c.finish(txID, decision, ids); err != nil {
+		log.Printf("transaction %s decided %s but not finished: %v", txID, decision, err)
+	}
+	if prepareErr != nil {
+		return "", prepareErr
+	}
+	return txID, nil
+}
+
+// Recover finishes the transactions left unfinished in the decision log.
+// Transactions without a decision are aborted.
+func (c *Coordinator) Recover() error {
+	records, err := c.readDecisions()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		decision := record.State
+		switch decision {
+		case TX_DONE:
+			continue
+		case TX_PREPARING:
+			decision = TX_ABORT
+			if err := c.logDecision(record.TxID, decision, record.Participants); err != nil {
+				return err
+			}
+		}
+
+		if err := c.finish(record.TxID, decision, record.Participants); err != nil {
+			log.Printf("transaction %s still in doubt: %v", record.TxID, err)
+			continue
+		}
+		log.Printf("recovered transaction %s: %s", record.TxID, decision)
+	}
+	return nil
+}
+
+// finish sends the decision to every participant and marks the transaction
+// done once all of them acknowledged it.
+func (c *Coordinator) finish(txID, decision string, ids []string) error {
+	for _, id := range ids {
+		participant, err := c.participant(id)
+		if err != nil {
+			return err
+		}
+		if decision == TX_COMMIT {
+			err = participant.Commit(txID)
+		} else {
+			err = participant.Abort(txID)
+		}
+		if err != nil {
+			return fmt.Errorf("%s on %s failed: %v", decision, id, err)
+		}
+	}
+	return c.logDecision(txID, TX_DONE, nil)
+}
+
+func (c *Coordinator) logDecision(txID, state string, ids []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.Marshal(decisionRecord{TxID: txID, State: state, Participants: ids, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(c.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readDecisions returns the latest record of every transaction in the log,
+// in the order they were started. A torn last line is ignored.
+func (c *Coordinator) readDecisions() ([]decisionRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	file, err := os.Open(c.logPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	latest := make(map[string]*decisionRecord)
+	var order []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record decisionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("skipping invalid decision record: %v", err)
+			continue
+		}
+		previous, ok := latest[record.TxID]
+		if !ok {
+			order = append(order, record.TxID)
+		} else if len(record.Participants) == 0 {
+			record.Participants = previous.Participants
+		}
+		latest[record.TxID] = &record
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	records := make([]decisionRecord, 0, len(order))
+	for _, txID := range order {
+		records = append(records, *latest[txID])
+	}
+	return records, nil
+}
@@ -0,0 +1,160 @@
+package server_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+// flakyParticipant fails commits while down is set, like a shard that
+// crashed after preparing.
+type flakyParticipant struct {
+	server.Participant
+	down bool
+}
+
+func (p *flakyParticipant) Commit(txID string) error {
+	if p.down {
+		return errors.New("connection refused")
+	}
+	return p.Participant.Commit(txID)
+}
+
+func newCoordinator(t *testing.T, participants map[string]server.Participant) *server.Coordinator {
+	t.Helper()
+	return server.NewCoordinator(server.CoordinatorParams{
+		DecisionLogPath: filepath.Join(t.TempDir(), "decisions.log"),
+		// every collection lives on the shard of the same name
+		Route: func(collection, key string) string {
+			return collection
+		},
+		Participant: func(id string) (server.Participant, error) {
+			participant, ok := participants[id]
+			if !ok {
+				return nil, fmt.Errorf("unknown shard %s", id)
+			}
+			return participant, nil
+		},
+	})
+}
+
+// replayDump rebuilds a shard store from its dump, as a restarted shard does.
+func replayDump(t *testing.T, path string) *models.CollectionStore {
+	t.Helper()
+	cmds, err := server.ReadCommandsFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := models.NewCollectionStore()
+	cc := &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}
+	for _, cmd := range cmds {
+		if server.ShouldWriteLog(cmd) {
+			server.ExecuteCommand(&cmd, cs, cc, &models.KVServer{Config: &models.Config{}}, nil)
+		}
+	}
+	return cs
+}
+
+func TestCoordinator_Commit(t *testing.T) {
+	users, orders := models.NewCollectionStore(), models.NewCollectionStore()
+	coordinator := newCoordinator(t, map[string]server.Participant{
+		"users":  &server.LocalParticipant{Store: users},
+		"orders": &server.LocalParticipant{Store: orders},
+	})
+
+	_, err := coordinator.Execute([]models.TransactionWrite{
+		{Collection: "users", Key: "u1", Value: "alice"},
+		{Collection: "orders", Key: "o1", Value: "u1 book"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := users.GetKeyInCollection("users", "u1"); got != "alice" {
+		t.Errorf("users/u1 = %q", got)
+	}
+	if got := orders.GetKeyInCollection("orders", "o1"); got != "u1 book" {
+		t.Errorf("orders/o1 = %q", got)
+	}
+	if len(users.Prepared.InDoubt()) != 0 || len(orders.Prepared.InDoubt()) != 0 {
+		t.Error("expected no transactions left prepared")
+	}
+}
+
+func TestCoordinator_AbortOnConflict(t *testing.T) {
+	users, orders := models.NewCollectionStore(), models.NewCollectionStore()
+	coordinator := newCoordinator(t, map[string]server.Participant{
+		"users":  &server.LocalParticipant{Store: users},
+		"orders": &server.LocalParticipant{Store: orders},
+	})
+
+	// another transaction holds the order key
+	if err := orders.Prepared.Prepare("other", []models.TransactionWrite{{Collection: "orders", Key: "o1", Value: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := coordinator.Execute([]models.TransactionWrite{
+		{Collection: "users", Key: "u1", Value: "alice"},
+		{Collection: "orders", Key: "o1", Value: "u1 book"},
+	})
+	if err == nil {
+		t.Fatal("expected the transaction to abort")
+	}
+
+	if got := users.GetKeyInCollection("users", "u1"); got == "alice" {
+		t.Error("aborted write reached the users shard")
+	}
+	if _, locked := users.Prepared.LockedBy("users", "u1"); locked {
+		t.Error("abort did not release the lock on the users shard")
+	}
+}
+
+func TestCoordinator_Recover(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "orders.dump")
+	users := models.NewCollectionStore()
+	orders := &flakyParticipant{Participant: &server.LocalParticipant{Store: models.NewCollectionStore(), SnapshotPath: dump}, down: true}
+	participants := map[string]server.Participant{
+		"users":  &server.LocalParticipant{Store: users},
+		"orders": orders,
+	}
+	coordinator := newCoordinator(t, participants)
+
+	// the orders shard goes down after it prepared
+	txID, err := coordinator.Execute([]models.TransactionWrite{
+		{Collection: "users", Key: "u1", Value: "alice"},
+		{Collection: "orders", Key: "o1", Value: "u1 book"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it comes back from its dump with the transaction still in doubt
+	restarted := replayDump(t, dump)
+	if inDoubt := restarted.Prepared.InDoubt(); len(inDoubt) != 1 || inDoubt[0] != txID {
+		t.Fatalf("expected %s in doubt after restart, got %v", txID, inDoubt)
+	}
+	if _, locked := restarted.Prepared.LockedBy("orders", "o1"); !locked {
+		t.Fatal("expected the prepared key to stay locked after restart")
+	}
+	participants["orders"] = &server.LocalParticipant{Store: restarted, SnapshotPath: dump}
+
+	if err := coordinator.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.GetKeyInCollection("orders", "o1"); got != "u1 book" {
+		t.Errorf("orders/o1 = %q after recovery", got)
+	}
+	if len(restarted.Prepared.InDoubt()) != 0 {
+		t.Error("expected recovery to resolve the transaction")
+	}
+
+	// the commit is in the dump now, so another restart keeps it
+	if got := replayDump(t, dump).GetKeyInCollection("orders", "o1"); got != "u1 book" {
+		t.Errorf("orders/o1 = %q after second restart", got)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// shardFeatures are the features a shard server offers over the text
+// protocol, reported by HELLO.
+var shardFeatures = []string{"collections", "transactions", "multi", "watch", "locks", "ttl", "pubsub", "mget", "two-phase-commit"}
+
+// hello negotiates the protocol version, authenticates the client if it sent
+// credentials and names it, then describes the server.
+func hello(cmd *Command, cc *models.ClientConfig, kv *models.KVServer) string {
+	args := cmd.Args
+	if cmd.CollectionName != "" {
+		args = append([]string{cmd.CollectionName}, args...)
+	}
+	helloArgs, err := utils.ParseHello(args)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+
+	if helloArgs.Auth && kv.Config.ProtectedMode {
+		if result, ok := kv.Authenticate(helloArgs.Username, helloArgs.Password); !ok {
+			return utils.ErrorReply(utils.ERROR_NOAUTH, "%s", result)
+		}
+		cc.ClientState.IsAuthenticated = true
+	}
+	if helloArgs.Name != "" {
+		cc.Name = helloArgs.Name
+	}
+
+	role, auth := "replica", "none"
+	if kv.Config.IsMaster {
+		role = "master"
+	}
+	if kv.Config.ProtectedMode {
+		auth = "password"
+	}
+	return utils.HelloReply{
+		Server:     "kv",
+		Version:    utils.SERVER_VERSION,
+		Proto:      utils.PROTOCOL_VERSION,
+		ID:         kv.Config.IP + ":" + kv.Config.Port,
+		Role:       role,
+		Auth:       auth,
+		Codecs:     []string{"text"},
+		Features:   shardFeatures,
+		ClientName: cc.Name,
+	}.String()
+}
@@ -0,0 +1,38 @@
+package server_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+func TestHelloNegotiatesVersionAndNamesClient(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := &models.ClientConfig{ClientState: models.NewClientState()}
+	kv := &models.KVServer{Config: &models.Config{IP: "127.0.0.1", Port: "6380", IsMaster: true}}
+
+	reply := server.ExecuteCommand(server.ParseCommand("HELLO 1 SETNAME worker-1"), cs, cc, kv, nil)
+	var hello utils.HelloReply
+	if err := json.Unmarshal([]byte(reply), &hello); err != nil {
+		t.Fatalf("HELLO replied %q: %v", reply, err)
+	}
+	if hello.Proto != utils.PROTOCOL_VERSION || hello.Role != "master" || hello.ID != "127.0.0.1:6380" || hello.ClientName != "worker-1" {
+		t.Fatalf("HELLO replied %+v", hello)
+	}
+	if cc.Name != "worker-1" {
+		t.Fatalf("client name is %q", cc.Name)
+	}
+
+	reply = server.ExecuteCommand(server.ParseCommand("HELLO 2"), cs, cc, kv, nil)
+	if !strings.HasPrefix(reply, "ERROR NOPROTO ") {
+		t.Fatalf("HELLO 2 replied %q", reply)
+	}
+	reply = server.ExecuteCommand(server.ParseCommand("HELLO 1 AUTH alice"), cs, cc, kv, nil)
+	if !strings.HasPrefix(reply, "ERROR SYNTAX ") {
+		t.Fatalf("HELLO with a missing password replied %q", reply)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// lockKey handles LOCK <collection> <key> [SHARED|EXCLUSIVE] [timeout]. The
+// lock is held until UNLOCK or the end of the transaction. A client picked
+// as a deadlock victim has its transaction rolled back.
+func lockKey(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) string {
+	if cc.ClientState.State != utils.TRANSACTIONAL {
+		return utils.ErrorReply(utils.ERROR_GENERIC, "Transaction not started")
+	}
+	if len(cmd.Args) < 1 || len(cmd.Args) > 3 {
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: LOCK <collection> <key> [SHARED|EXCLUSIVE] [timeout]")
+	}
+	if kv.Locks == nil {
+		return utils.ErrorReply(utils.ERROR_GENERIC, "locking is not available")
+	}
+
+	mode := models.ExclusiveLock
+	timeout := utils.LOCK_TIMEOUT
+	for _, arg := range cmd.Args[1:] {
+		switch strings.ToUpper(arg) {
+		case "SHARED":
+			mode = models.SharedLock
+		case "EXCLUSIVE":
+			mode = models.ExclusiveLock
+		default:
+			duration, err := utils.ParseDuration(arg)
+			if err != nil {
+				return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: LOCK <collection> <key> [SHARED|EXCLUSIVE] [timeout (xm xhxm xxs)]")
+			}
+			timeout = duration
+		}
+	}
+
+	err := kv.Locks.Lock(cc.ClientID, models.WatchedKey{Collection: cmd.CollectionName, Key: cmd.Args[0]}, mode, timeout)
+	switch {
+	case errors.Is(err, models.ErrDeadlock):
+		cc.Transaction.RollbackTransaction()
+		cc.Transaction = nil
+		cc.ClientState.State = utils.ACTIVE
+		releaseLocks(cc, kv)
+		return utils.ErrorReply(utils.ERROR_DEADLOCK, "%v waiting for %s in %s, transaction aborted", err, cmd.Args[0], cmd.CollectionName)
+	case err != nil:
+		return utils.ErrorReply(utils.ErrorCodeOf(err), "%v after %v", err, timeout.Round(time.Millisecond))
+	}
+	// a write that found the key free before the lock was granted may still
+	// be applying, wait for it so the holder reads the key after it
+	cs.Exec(nil, func(*models.CollectionTx) {})
+	return "OK"
+}
+
+// keyLocked returns the error reply for a write to the key if a prepared
+// transaction or another client holds a lock on it. Writes call it inside
+// cs.Exec and write in the same call, so no PREPARE or LOCK lands between
+// the check and the write.
+func keyLocked(collection, key string, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) (string, bool) {
+	if txID, ok := cs.Prepared.LockedBy(collection, key); ok {
+		return utils.ErrorReply(utils.ERROR_LOCKED, "key %s is locked by prepared transaction %s", key, txID), true
+	}
+	if kv.Locks != nil && kv.Locks.LockedByOther(cc.ClientID, models.WatchedKey{Collection: collection, Key: key}) {
+		return utils.ErrorReply(utils.ERROR_LOCKED, "key %s is locked by another client", key), true
+	}
+	return "", false
+}
+
+// lockedWrite runs write inside cs.Exec unless one of the keys of cmd is
+// locked, and returns OK or the error reply for the locked key.
+func lockedWrite(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, write func(tx *models.CollectionTx)) string {
+	reply := "OK"
+	cs.Exec(nil, func(tx *models.CollectionTx) {
+		var locked bool
+		if reply, locked = lockedKey(cmd, cs, cc, kv); locked {
+			return
+		}
+		reply = "OK"
+		write(tx)
+	})
+	return reply
+}
+
+func releaseLocks(cc *models.ClientConfig, kv *models.KVServer) {
+	if kv.Locks != nil {
+		kv.Locks.ReleaseAll(cc.ClientID)
+	}
+}
@@ -0,0 +1,109 @@
+package server_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+func TestLockedKeysRefuseEveryWrite(t *testing.T) {
+	cs := models.NewCollectionStore()
+	kv := &models.KVServer{Config: &models.Config{}, Locks: models.NewLockManager()}
+	alice := &models.ClientConfig{ClientID: "alice", ClientState: models.NewClientState()}
+	bob := &models.ClientConfig{ClientID: "bob", ClientState: models.NewClientState()}
+	run := func(cc *models.ClientConfig, command string) string {
+		t.Helper()
+		return server.ExecuteCommand(server.ParseCommand(command), cs, cc, kv, nil)
+	}
+
+	run(alice, "SET users amy 1")
+	for _, command := range []string{"BEGIN", "LOCK users amy SHARED"} {
+		if reply := run(bob, command); reply != "OK" {
+			t.Fatalf("%s replied %q", command, reply)
+		}
+	}
+
+	for _, commands := range [][]string{
+		{"SET users amy 2"},
+		{"DELETE users amy"},
+		{"SET-TTL users amy 10s"},
+		{"MDEL users amy"},
+		{"BEGIN", "TSET users amy 2", "COMMIT"},
+		{"MULTI", "SET users amy 2", "EXEC"},
+	} {
+		var reply string
+		for _, command := range commands {
+			reply = run(alice, command)
+		}
+		if !strings.HasPrefix(reply, "ERROR LOCKED ") {
+			t.Errorf("%v replied %q while bob holds a shared lock", commands, reply)
+		}
+		if alice.ClientState.State == utils.TRANSACTIONAL {
+			run(alice, "ROLLBACK")
+		}
+	}
+	if got := cs.GetKeyInCollection("users", "amy"); got != "1" {
+		t.Errorf("a locked key was written: %q", got)
+	}
+
+	// the holder writes, and others do once the lock is gone
+	if reply := run(bob, "TSET users amy 2"); reply != "OK" {
+		t.Fatalf("TSET replied %q", reply)
+	}
+	if reply := run(bob, "COMMIT"); reply != "OK" {
+		t.Fatalf("the lock holder's COMMIT replied %q", reply)
+	}
+	if reply := run(alice, "SET users amy 3"); reply != "OK" {
+		t.Errorf("SET after the lock was released replied %q", reply)
+	}
+}
+
+func TestPrepareRefusesKeysLockedByClients(t *testing.T) {
+	cs := models.NewCollectionStore()
+	kv := &models.KVServer{Config: &models.Config{}, Locks: models.NewLockManager()}
+	bob := &models.ClientConfig{ClientID: "bob", ClientState: models.NewClientState()}
+	coordinator := &models.ClientConfig{ClientID: "coordinator", ClientState: models.NewClientState()}
+	prepare := `PREPARE tx1 [{"Collection":"users","Key":"amy","Value":"2"}]`
+
+	for _, command := range []string{"BEGIN", "LOCK users amy"} {
+		if reply := server.ExecuteCommand(server.ParseCommand(command), cs, bob, kv, nil); reply != "OK" {
+			t.Fatalf("%s replied %q", command, reply)
+		}
+	}
+	if reply := server.ExecuteCommand(server.ParseCommand(prepare), cs, coordinator, kv, nil); !strings.HasPrefix(reply, "ERROR LOCKED ") {
+		t.Errorf("PREPARE of a locked key replied %q", reply)
+	}
+	if txs := cs.Prepared.InDoubt(); len(txs) != 0 {
+		t.Errorf("a refused PREPARE left %v prepared", txs)
+	}
+
+	server.ExecuteCommand(server.ParseCommand("ROLLBACK"), cs, bob, kv, nil)
+	if reply := server.ExecuteCommand(server.ParseCommand(prepare), cs, coordinator, kv, nil); reply != "OK" {
+		t.Errorf("PREPARE after the lock was released replied %q", reply)
+	}
+}
+
+func TestLockTakenWhileAWriteWaitsRefusesIt(t *testing.T) {
+	cs := models.NewCollectionStore()
+	kv := &models.KVServer{Config: &models.Config{}, Locks: models.NewLockManager()}
+	alice := &models.ClientConfig{ClientID: "alice", ClientState: models.NewClientState()}
+
+	// the SET waits for the store while bob takes the key
+	reply := make(chan string)
+	cs.Exec(nil, func(*models.CollectionTx) {
+		go func() {
+			reply <- server.ExecuteCommand(server.ParseCommand("SET users amy 1"), cs, alice, kv, nil)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if err := kv.Locks.Lock("bob", models.WatchedKey{Collection: "users", Key: "amy"}, models.ExclusiveLock, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got := <-reply; !strings.HasPrefix(got, "ERROR LOCKED ") {
+		t.Errorf("SET replied %q after bob locked the key", got)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// isMultiCommand reports whether the command controls a MULTI block instead
+// of being queued in it.
+func isMultiCommand(name string) bool {
+	switch name {
+	case utils.WATCH, utils.UNWATCH, utils.MULTI, utils.EXEC, utils.DISCARD:
+		return true
+	}
+	return false
+}
+
+// watchKeys records the current version of every key in the command, so
+// EXEC can tell whether one of them was written in the meantime.
+func watchKeys(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig) string {
+	if cc.ClientState.State == utils.QUEUING {
+		return utils.ErrorReply(utils.ERROR_GENERIC, "WATCH inside MULTI is not allowed")
+	}
+	if len(cmd.Args) < 1 {
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: WATCH <collection> <key> [key...]")
+	}
+	if cc.Watched == nil {
+		cc.Watched = make(map[models.WatchedKey]uint64)
+	}
+	for _, key := range cmd.Args {
+		watched := models.WatchedKey{Collection: cmd.CollectionName, Key: key}
+		// keep the first version seen if the key is watched twice
+		if _, ok := cc.Watched[watched]; !ok {
+			cc.Watched[watched] = cs.KeyVersion(cmd.CollectionName, key)
+		}
+	}
+	return "OK"
+}
+
+func queueCommand(cmd *Command, cc *models.ClientConfig) string {
+	switch cmd.Name {
+	case utils.SET, utils.GET, utils.DEL, utils.MGET, utils.MSET, utils.MDEL:
+	default:
+		return utils.ErrorReply(utils.ERROR_GENERIC, "%s cannot be queued in MULTI", cmd.Name)
+	}
+	cc.Queue = append(cc.Queue, models.QueuedCommand{
+		Name:       cmd.Name,
+		Collection: cmd.CollectionName,
+		Args:       cmd.Args,
+	})
+	return "QUEUED"
+}
+
+// execQueued runs the queued commands atomically if none of the watched keys
+// changed. The results are returned as a JSON array, or NIL_REPLY if the
+// transaction was aborted. The writes are left in cmd.Batch to be logged.
+// Nothing runs if one of the keys written is locked.
+func execQueued(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) string {
+	queue, watched := cc.Queue, cc.Watched
+	cc.Queue, cc.Watched = nil, nil
+	cc.ClientState.State = utils.ACTIVE
+
+	results := make([]string, 0, len(queue))
+	var batch []Command
+	var reply string
+	var locked bool
+	ok := cs.Exec(watched, func(tx *models.CollectionTx) {
+		for _, queued := range queue {
+			write := &Command{Name: queued.Name, CollectionName: queued.Collection, Args: queued.Args}
+			if reply, locked = lockedKey(write, cs, cc, kv); locked {
+				return
+			}
+		}
+		for _, queued := range queue {
+			result, write := runQueued(queued, tx)
+			results = append(results, result)
+			if write != nil {
+				batch = append(batch, *write)
+			}
+		}
+	})
+	if !ok {
+		return utils.NIL_REPLY
+	}
+	if locked {
+		return reply
+	}
+	cmd.Batch = batch
+
+	jsonResults, err := json.Marshal(results)
+	if err != nil {
+		log.Printf("error converting to json: %v", err)
+	}
+	return string(jsonResults)
+}
+
+// replayExec applies the writes of an EXEC replayed from the dump or
+// replicated from the master.
+func replayExec(batch []Command, cs *models.CollectionStore) {
+	cs.Exec(nil, func(tx *models.CollectionTx) {
+		for _, cmd := range batch {
+			runQueued(models.QueuedCommand{Name: cmd.Name, Collection: cmd.CollectionName, Args: cmd.Args}, tx)
+		}
+	})
+}
+
+// runQueued runs a single queued command and returns its result and, for
+// writes, the command to log.
+func runQueued(queued models.QueuedCommand, tx *models.CollectionTx) (string, *Command) {
+	switch queued.Name {
+	case utils.SET:
+		if len(queued.Args) < 2 {
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: SET <collection> <key> <value>"), nil
+		}
+		value := strings.Join(queued.Args[1:], " ")
+		tx.Set(queued.Collection, queued.Args[0], value)
+		return "OK", &Command{Name: utils.SET, CollectionName: queued.Collection, Args: []string{queued.Args[0], value}}
+	case utils.GET:
+		if len(queued.Args) < 1 {
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: GET <collection> <key>"), nil
+		}
+		return tx.Get(queued.Collection, queued.Args[0]), nil
+	case utils.DEL:
+		if len(queued.Args) < 1 {
+			return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: DELETE <collection> <key>"), nil
+		}
+		tx.Delete(queued.Collection, queued.Args[0])
+		return "OK", &Command{Name: utils.DEL, CollectionName: queued.Collection, Args: []string{queued.Args[0]}}
+	case utils.MGET, utils.MSET, utils.MDEL:
+		if reply, ok := validMultiKey(queued.Name, queued.Args); !ok {
+			return reply, nil
+		}
+		result := runMultiKey(queued.Name, queued.Collection, queued.Args, tx)
+		if queued.Name == utils.MGET {
+			return result, nil
+		}
+		return result, &Command{Name: queued.Name, CollectionName: queued.Collection, Args: queued.Args}
+	default:
+		return utils.ErrorReply(utils.ERROR_UNKNOWN, "Unknown command: %s", queued.Name), nil
+	}
+}
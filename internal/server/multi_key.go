@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// Multi-key commands act on several keys of a collection in one round trip:
+//
+//	MGET <collection> <key> [key...]                 JSON array of values, null for missing keys
+//	MSET <collection> <key> <value> [key value...]   OK
+//	MDEL <collection> <key> [key...]                 OK
+//
+// They run under the store lock, so MSET and MDEL are applied atomically and
+// logged as a single line. Values of MSET can't hold spaces.
+
+func isMultiKeyCommand(name string) bool {
+	switch name {
+	case utils.MGET, utils.MSET, utils.MDEL:
+		return true
+	}
+	return false
+}
+
+func multiKeyUsage(name string) string {
+	switch name {
+	case utils.MGET:
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: MGET <collection> <key> [key...]")
+	case utils.MSET:
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: MSET <collection> <key> <value> [key value...]")
+	}
+	return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: MDEL <collection> <key> [key...]")
+}
+
+// validMultiKey checks the arguments of a multi-key command and returns the
+// error reply if they are wrong.
+func validMultiKey(name string, args []string) (string, bool) {
+	if len(args) < 1 || (name == utils.MSET && len(args)%2 != 0) {
+		return multiKeyUsage(name), false
+	}
+	return "", true
+}
+
+// lockedKey returns the error reply for the first key of a write that is
+// locked by a prepared transaction or another client. Call it inside
+// cs.Exec, see keyLocked.
+func lockedKey(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) (string, bool) {
+	for _, key := range writtenKeys(cmd.Name, cmd.Args) {
+		if reply, locked := keyLocked(cmd.CollectionName, key, cs, cc, kv); locked {
+			return reply, true
+		}
+	}
+	return "", false
+}
+
+// writtenKeys returns the keys a write command writes.
+func writtenKeys(name string, args []string) []string {
+	switch name {
+	case utils.SET, utils.DEL, utils.SET_TTL:
+		return args[:min(len(args), 1)]
+	case utils.MSET:
+		keys := make([]string, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case utils.MDEL:
+		return args
+	}
+	return nil
+}
+
+func executeMultiKey(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) string {
+	if reply, ok := validMultiKey(cmd.Name, cmd.Args); !ok {
+		return reply
+	}
+	var result string
+	cs.Exec(nil, func(tx *models.CollectionTx) {
+		if cmd.Name != utils.MGET {
+			var locked bool
+			if result, locked = lockedKey(cmd, cs, cc, kv); locked {
+				return
+			}
+		}
+		result = runMultiKey(cmd.Name, cmd.CollectionName, cmd.Args, tx)
+	})
+	return result
+}
+
+// runMultiKey runs a multi-key command whose arguments were checked.
+func runMultiKey(name, collection string, args []string, tx *models.CollectionTx) string {
+	switch name {
+	case utils.MGET:
+		values := make([]*string, len(args))
+		for i, key := range args {
+			value := tx.Get(collection, key)
+			if _, isErr := utils.ParseErrorReply(value); !isErr {
+				values[i] = &value
+			}
+		}
+		jsonValues, err := json.Marshal(values)
+		if err != nil {
+			log.Printf("error converting to json: %v", err)
+		}
+		return string(jsonValues)
+	case utils.MSET:
+		for i := 0; i < len(args); i += 2 {
+			tx.Set(collection, args[i], args[i+1])
+		}
+	case utils.MDEL:
+		for _, key := range args {
+			tx.Delete(collection, key)
+		}
+	}
+	return "OK"
+}
@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+func TestScatterMultiKeyMergesInRequestOrder(t *testing.T) {
+	shards := map[string]*models.CollectionStore{"a": models.NewCollectionStore(), "b": models.NewCollectionStore()}
+	cc := &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}
+	kv := &models.KVServer{Config: &models.Config{}}
+
+	// keys starting with a-m live on shard a, the others on shard b
+	route := func(collection, key string) string {
+		if key < "n" {
+			return "a"
+		}
+		return "b"
+	}
+	// send is called from one goroutine per shard
+	var mu sync.Mutex
+	sent := make(map[string]string)
+	send := func(shardID, command string) (string, error) {
+		mu.Lock()
+		sent[shardID] = command
+		mu.Unlock()
+		return server.ExecuteCommand(server.ParseCommand(command), shards[shardID], cc, kv, nil), nil
+	}
+
+	reply := server.ScatterMultiKey(server.ParseCommand("MSET users zed 1 amy 2 pat 3"), route, send)
+	if reply != "OK" {
+		t.Fatalf("MSET replied %q", reply)
+	}
+	if sent["a"] != "MSET users amy 2" || sent["b"] != "MSET users zed 1 pat 3" {
+		t.Fatalf("MSET was split as %v", sent)
+	}
+
+	reply = server.ScatterMultiKey(server.ParseCommand("MGET users pat amy bob zed"), route, send)
+	if reply != `["3","2",null,"1"]` {
+		t.Fatalf("MGET replied %q", reply)
+	}
+
+	server.ScatterMultiKey(server.ParseCommand("MDEL users amy zed"), route, send)
+	reply = server.ScatterMultiKey(server.ParseCommand("MGET users amy pat zed"), route, send)
+	if reply != `[null,"3",null]` {
+		t.Fatalf("MGET after MDEL replied %q", reply)
+	}
+
+	reply = server.ScatterMultiKey(server.ParseCommand("MSET users amy"), route, send)
+	if !strings.HasPrefix(reply, utils.ERROR_REPLY_PREFIX+string(utils.ERROR_SYNTAX)) {
+		t.Fatalf("MSET without a value replied %q", reply)
+	}
+}
+
+func TestSingleAndMultiKeyCommandsRouteAlike(t *testing.T) {
+	for _, command := range []string{"SET users amy 1", "GET users amy", "DELETE users amy", "SET-TTL users amy 10s"} {
+		if got := server.RouteKey(server.ParseCommand(command), "10.0.0.1:5000"); got != server.ShardKey("users", "amy") {
+			t.Errorf("%s is routed by %q, MSET users amy by %q", command, got, server.ShardKey("users", "amy"))
+		}
+	}
+	if got := server.RouteKey(server.ParseCommand("BEGIN"), "10.0.0.1:5000"); got != "10.0.0.1:5000" {
+		t.Errorf("BEGIN is routed by %q, want the client address", got)
+	}
+}
+
+func TestRefusedMultiKeyWritesAreNotLogged(t *testing.T) {
+	cs := models.NewCollectionStore()
+	kv := &models.KVServer{Config: &models.Config{}, Locks: models.NewLockManager()}
+	alice := &models.ClientConfig{ClientID: "alice", ClientState: models.NewClientState()}
+	bob := &models.ClientConfig{ClientID: "bob", ClientState: models.NewClientState()}
+	run := func(cc *models.ClientConfig, command string) (string, bool) {
+		t.Helper()
+		cmd := server.ParseCommand(command)
+		reply := server.ExecuteCommand(cmd, cs, cc, kv, nil)
+		return reply, server.ShouldLogResult(*cmd, reply, cc)
+	}
+
+	if _, logged := run(alice, "MSET users amy 1 pat 2"); !logged {
+		t.Error("MSET is not logged")
+	}
+	run(bob, "BEGIN")
+	run(bob, "LOCK users pat")
+	for _, command := range []string{"MSET users amy 3 pat 4", "MDEL users amy pat"} {
+		if reply, logged := run(alice, command); logged {
+			t.Errorf("%s replied %q and is logged", command, reply)
+		}
+	}
+	run(alice, "MULTI")
+	if _, logged := run(alice, "MSET users amy 5"); logged {
+		t.Error("a queued MSET is logged before EXEC")
+	}
+}
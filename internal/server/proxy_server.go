@@ -3,11 +3,16 @@ package server
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 
 	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
 )
 
 func RouteRequestsToShards(port string, ch *models.ConsistentHash, shardList *models.ShardsList) {
@@ -19,6 +24,23 @@ func RouteRequestsToShards(port string, ch *models.ConsistentHash, shardList *mo
 		return
 	}
 
+	coordinator := NewCoordinator(CoordinatorParams{
+		DecisionLogPath: utils.DECISION_LOG_FILE,
+		Route: func(collection, key string) string {
+			return ch.GetNode(ShardKey(collection, key))
+		},
+		Participant: func(shardID string) (Participant, error) {
+			shard := shardList.GetShard(shardID)
+			if shard == nil || len(shard.Nodes) == 0 {
+				return nil, fmt.Errorf("shard %v not found", shardID)
+			}
+			return &TCPParticipant{Address: shard.Nodes[0].Config.IP + ":" + shard.Nodes[0].Config.Port}, nil
+		},
+	})
+	if err := coordinator.Recover(); err != nil {
+		log.Printf("error recovering distributed transactions: %v", err)
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -31,24 +53,76 @@ func RouteRequestsToShards(port string, ch *models.ConsistentHash, shardList *mo
 				continue
 			}
 		}
-		shardID := ch.GetNode(conn.RemoteAddr().String())
-		log.Printf("shardID = %v for routing with consistent hash", shardID)
-		go sendRequestToShard(shardID, &conn, shardList)
+		go sendRequestToShard(&conn, ch, shardList, coordinator)
 	}
 }
 
-func sendRequestToShard(shardID string, conn *net.Conn, shardList *models.ShardsList) {
+// ShardKey returns what a key of a collection is hashed by to pick its
+// shard. Every command reaching a key routes by it, so a key written one way
+// is found by the others.
+func ShardKey(collection, key string) string {
+	return collection + ":" + key
+}
+
+// RouteKey returns what a command is routed by: the ShardKey of its key for
+// the commands on a single key and the client address for the others.
+func RouteKey(cmd *Command, remoteAddress string) string {
+	switch cmd.Name {
+	case utils.SET, utils.GET, utils.DEL, utils.SET_TTL:
+		if len(cmd.Args) > 0 {
+			return ShardKey(cmd.CollectionName, cmd.Args[0])
+		}
+	}
+	return remoteAddress
+}
+
+func sendRequestToShard(conn *net.Conn, ch *models.ConsistentHash, shardList *models.ShardsList, coordinator *Coordinator) {
 	// Code
 	reader := bufio.NewReader(*conn)
-	command, err := reader.ReadString('\n')
+	command, err := utils.ReadLine(reader, utils.DEFAULT_MAX_REQUEST_SIZE)
+	if errors.Is(err, utils.ErrTooLarge) {
+		fmt.Fprintln(*conn, utils.FormatError(err))
+		return
+	}
 	if err != nil {
 		// fmt.Println("Error reading from connection:", err)
 		return
 	}
+
+	// TXN <json writes> spans shards, the coordinator talks to them itself
+	cmd := ParseCommand(command)
+	if cmd != nil && cmd.Name == utils.TXN {
+		(*conn).Write([]byte(runDistributedTransaction(command, coordinator) + "\n"))
+		return
+	}
+	// the keys of a multi-key command can live on different shards
+	if cmd != nil && isMultiKeyCommand(cmd.Name) {
+		route := func(collection, key string) string {
+			return ch.GetNode(ShardKey(collection, key))
+		}
+		send := func(shardID, command string) (string, error) {
+			shard := shardList.GetShard(shardID)
+			if shard == nil || len(shard.Nodes) == 0 {
+				return "", fmt.Errorf("shard %v not found", shardID)
+			}
+			return sendCommand(command, shard.Nodes[0].Config.IP+":"+shard.Nodes[0].Config.Port)
+		}
+		(*conn).Write([]byte(ScatterMultiKey(cmd, route, send) + "\n"))
+		return
+	}
+	if cmd == nil {
+		return
+	}
+	shardID := ch.GetNode(RouteKey(cmd, (*conn).RemoteAddr().String()))
+	log.Printf("shardID = %v for routing with consistent hash", shardID)
 	shard := shardList.GetShard(shardID)
+	if shard == nil || len(shard.Nodes) == 0 {
+		(*conn).Write([]byte(utils.ErrorReply(utils.ERROR_GENERIC, "shard %v unavailable", shardID) + "\n"))
+		return
+	}
 	shardIP := shard.Nodes[0].Config.IP + ":" + shard.Nodes[0].Config.Port
 
-	shardList.GetShard(shardID).PrintActiveConnections()
+	shard.PrintActiveConnections()
 	res, err := sendCommand(command, shardIP)
 	if err != nil {
 		log.Printf("Error sending command to shard: %v", err)
@@ -78,3 +152,86 @@ func sendCommand(command string, ip string) (string, error) {
 
 	return response, nil
 }
+
+func runDistributedTransaction(command string, coordinator *Coordinator) string {
+	var writes []models.TransactionWrite
+	data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(command), utils.TXN))
+	if err := json.Unmarshal([]byte(data), &writes); err != nil {
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: TXN [{\"Collection\":..,\"Key\":..,\"Value\":..}, ...]")
+	}
+
+	txID, err := coordinator.Execute(writes)
+	if err != nil {
+		return utils.ErrorReply(utils.ERROR_GENERIC, "transaction aborted: %v", err)
+	}
+	return "OK " + txID
+}
+
+// ScatterMultiKey splits a multi-key command into one command per shard,
+// runs them concurrently and merges the replies back in request order. MSET
+// and MDEL are atomic on each shard but not across shards.
+func ScatterMultiKey(cmd *Command, route func(collection, key string) string, send func(shardID, command string) (string, error)) string {
+	if reply, ok := validMultiKey(cmd.Name, cmd.Args); !ok {
+		return reply
+	}
+	step := 1
+	if cmd.Name == utils.MSET {
+		step = 2
+	}
+
+	// positions of the keys owned by each shard, in request order
+	var shards []string
+	positions := make(map[string][]int)
+	for i := 0; i < len(cmd.Args); i += step {
+		shardID := route(cmd.CollectionName, cmd.Args[i])
+		if _, ok := positions[shardID]; !ok {
+			shards = append(shards, shardID)
+		}
+		positions[shardID] = append(positions[shardID], i)
+	}
+
+	replies := make([]string, len(shards))
+	var wg sync.WaitGroup
+	for s, shardID := range shards {
+		parts := []string{cmd.Name, cmd.CollectionName}
+		for _, i := range positions[shardID] {
+			parts = append(parts, cmd.Args[i:i+step]...)
+		}
+		wg.Add(1)
+		go func(s int, shardID, command string) {
+			defer wg.Done()
+			reply, err := send(shardID, command)
+			if err != nil {
+				log.Printf("error sending command to shard %v: %v", shardID, err)
+				reply = utils.ErrorReply(utils.ERROR_GENERIC, "shard %v unavailable", shardID)
+			}
+			replies[s] = strings.TrimRight(reply, "\r\n")
+		}(s, shardID, strings.Join(parts, " "))
+	}
+	wg.Wait()
+
+	for _, reply := range replies {
+		if _, isErr := utils.ParseErrorReply(reply); isErr {
+			return reply
+		}
+	}
+	if cmd.Name != utils.MGET {
+		return "OK"
+	}
+
+	values := make([]*string, len(cmd.Args))
+	for s, shardID := range shards {
+		var shardValues []*string
+		if err := json.Unmarshal([]byte(replies[s]), &shardValues); err != nil || len(shardValues) != len(positions[shardID]) {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "invalid reply from shard %v", shardID)
+		}
+		for j, i := range positions[shardID] {
+			values[i] = shardValues[j]
+		}
+	}
+	jsonValues, err := json.Marshal(values)
+	if err != nil {
+		log.Printf("error converting to json: %v", err)
+	}
+	return string(jsonValues)
+}
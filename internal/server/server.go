@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -34,16 +35,15 @@ func StartServer(config *models.Config, isMaster bool, readySignal chan<- bool,
 	log.Printf("creating all the stores for the server: %v", config.Port)
 	cs := models.NewCollectionStore()
 	ps := models.NewPubSub()
-	ts := models.NewTransactionalKeyValueStore()
 	kvServer := models.NewKVServer(config)
 
 	shard.AddNode(kvServer)
 
-	Start(config, readySignal, cs, ps, ts, kvServer, shardConfigDb, shard)
+	Start(config, readySignal, cs, ps, kvServer, shardConfigDb, shard)
 }
 
 // Start initializes the server
-func Start(config *models.Config, readySignal chan<- bool, cs *models.CollectionStore, ps *models.PubSub, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, shardConfigDb *models.ShardDbConfig, shard *models.Shard) {
+func Start(config *models.Config, readySignal chan<- bool, cs *models.CollectionStore, ps *models.PubSub, kvServer *models.KVServer, shardConfigDb *models.ShardDbConfig, shard *models.Shard) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	contexts[config.Port] = ctx
@@ -65,7 +65,7 @@ func Start(config *models.Config, readySignal chan<- bool, cs *models.Collection
 	}
 
 	snapshotPath := shardConfigDb.GetSnapshotPath()
-	go WatchSnapshotAndUpdate(snapshotPath, cs, ts, kvServer, ps)
+	go WatchSnapshotAndUpdate(snapshotPath, cs, kvServer, ps)
 
 	log.Printf("starting TTL cleanups")
 	StartKVCleanup(cs, utils.CLEANUP_DURATION)
@@ -91,7 +91,7 @@ func Start(config *models.Config, readySignal chan<- bool, cs *models.Collection
 		// log.Printf("adding new connection to shard: %v", shard.ShardID)
 		shard.DbState.AddConnection(conn.RemoteAddr().String(), &conn)
 		// log.Printf("connected with client: %v", conn.RemoteAddr().String())
-		go handleConnection(conn, cs, ts, kvServer, ps, shardConfigDb, shard)
+		go handleConnection(conn, cs, kvServer, ps, shardConfigDb, shard)
 	}
 }
 
@@ -105,7 +105,7 @@ func Start(config *models.Config, readySignal chan<- bool, cs *models.Collection
 // 6. Admin commands: SHUTDOWN, MAKE_MASTER, MAKE_SLAVE
 // 7. Config commands: CONFIG = get or set configuration
 // 8. Health commands: PING
-func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub, shardConfigDb *models.ShardDbConfig, shard *models.Shard) {
+func handleConnection(conn net.Conn, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub, shardConfigDb *models.ShardDbConfig, shard *models.Shard) {
 
 	reader := bufio.NewReader(conn)
 	remoteAddress := conn.RemoteAddr().String()
@@ -128,7 +128,11 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 
 	for {
 		// Read the next line from the connection
-		command, err := reader.ReadString('\n')
+		command, err := utils.ReadLine(reader, utils.DEFAULT_MAX_REQUEST_SIZE)
+		if errors.Is(err, utils.ErrTooLarge) {
+			fmt.Fprintln(conn, utils.FormatError(err))
+			continue
+		}
 		// log.Printf("parsed command: %v", command)
 		if err != nil || command == "" {
 			// fmt.Println("Error reading from connection:", err)
@@ -136,12 +140,10 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 		}
 		cmd := ParseCommand(command)
 
-		if cmd != nil && ShouldWriteLog(*cmd) {
-			snapshotPath := shardConfigDb.GetSnapshotPath()
-			err = WriteCommandsToFile(*cmd, snapshotPath)
-			if err != nil {
-				log.Printf("error writing operation to dump")
-			}
+		// a commit is logged as a single line holding all of its writes, so
+		// it is replayed and replicated atomically
+		if cmd != nil && cmd.Name == utils.COMMIT && clientConfig.ClientState.State == utils.TRANSACTIONAL {
+			cmd.Batch = TransactionBatch(clientConfig.Transaction.Writes())
 		}
 
 		if cmd == nil {
@@ -151,6 +153,9 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 
 		switch cmd.Name {
 		case utils.SUBSCRIBE, utils.PUBLISH:
+			if err := WriteCommandsToFile(*cmd, shardConfigDb.GetSnapshotPath()); err != nil {
+				log.Printf("error writing operation to dump")
+			}
 			handlePubSubMode(cmd, conn, ps, clientConfig)
 		case utils.SHUTDOWN, utils.MAKE_MASTER, utils.MAKE_SLAVE:
 			handleAdminCommands(conn, kvServer, cmd)
@@ -160,7 +165,13 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 			handleHealthCommands(conn)
 		default:
 
-			result := ExecuteCommand(cmd, cs, ts, clientConfig, kvServer, ps)
+			result := ExecuteCommand(cmd, cs, clientConfig, kvServer, ps)
+			if ShouldLogResult(*cmd, result, clientConfig) {
+				err = WriteCommandsToFile(*cmd, shardConfigDb.GetSnapshotPath())
+				if err != nil {
+					log.Printf("error writing operation to dump")
+				}
+			}
 			// log.Printf("result for cmd: %v -------- %v", cmd, result)
 			_, err := fmt.Fprintln(conn, result)
 			if err != nil {
@@ -181,7 +192,7 @@ func handleInitLoad(cs *models.CollectionStore, shardConfig *models.ShardDbConfi
 	}
 	for _, cmd := range cmds {
 		if ShouldWriteLog(cmd) {
-			result := ExecuteCommand(&cmd, cs, nil, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, &models.KVServer{Config: &models.Config{ProtectedMode: false}}, nil)
+			result := ExecuteCommand(&cmd, cs, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, &models.KVServer{Config: &models.Config{ProtectedMode: false}}, nil)
 			log.Printf("successfully executed curr cmd: %v ------------ %v", cmd, result)
 		}
 	}
@@ -203,7 +214,7 @@ func handlePubSubMode(cmd *Command, conn net.Conn, pubSub *models.PubSub, cc *mo
 		message := strings.Join(cmd.Args[0:], " ")
 		publishToTopic(topic, message, conn, pubSub)
 	} else {
-		conn.Write([]byte("Unknown command in pub/sub mode.\n"))
+		conn.Write([]byte(utils.ErrorReply(utils.ERROR_UNKNOWN, "Unknown command in pub/sub mode.") + "\n"))
 	}
 }
 
@@ -218,7 +229,7 @@ func publishToTopic(topic, message string, conn net.Conn, pubSub *models.PubSub)
 	conn.Write([]byte("Published message to " + topic + "\n"))
 }
 
-func ReplicateChanges(jsonCmd string, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub) string {
+func ReplicateChanges(jsonCmd string, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub) string {
 	var cmd Command
 	err := json.Unmarshal([]byte(jsonCmd), &cmd)
 	if err != nil {
@@ -227,7 +238,7 @@ func ReplicateChanges(jsonCmd string, cs *models.CollectionStore, ts *models.Tra
 
 	log.Printf("parsed command for replication: %v", cmd)
 	// Execute the command on the slave server
-	result := ExecuteCommand(&cmd, cs, ts, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, kvServer, ps)
+	result := ExecuteCommand(&cmd, cs, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, kvServer, ps)
 	return result
 }
 
@@ -0,0 +1,90 @@
+package server_test
+
+import (
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestTransactionsAreIsolatedPerClient(t *testing.T) {
+	cs := models.NewCollectionStore()
+	kv := &models.KVServer{Config: &models.Config{}}
+	alice := &models.ClientConfig{ClientID: "alice", ClientState: models.NewClientState()}
+	bob := &models.ClientConfig{ClientID: "bob", ClientState: models.NewClientState()}
+	run := func(cc *models.ClientConfig, command string) string {
+		t.Helper()
+		return server.ExecuteCommand(server.ParseCommand(command), cs, cc, kv, nil)
+	}
+
+	run(alice, "SET users amy 1")
+	for _, command := range []string{"BEGIN", "TSET users amy 2", "TSET users zed 3"} {
+		if reply := run(alice, command); reply != "OK" {
+			t.Fatalf("%s replied %q", command, reply)
+		}
+	}
+	if reply := run(bob, "BEGIN"); reply != "OK" {
+		t.Fatalf("a second client couldn't begin a transaction: %q", reply)
+	}
+	run(bob, "TSET users pat 4")
+
+	// each client reads its own writes, nobody else sees them before COMMIT
+	if reply := run(alice, "TGET users amy"); reply != "2" {
+		t.Errorf("alice read %q of her own write", reply)
+	}
+	if reply := run(bob, "TGET users amy"); reply != "1" {
+		t.Errorf("bob read %q, the uncommitted write of alice", reply)
+	}
+	if reply := run(bob, "TGET users zed"); !strings.HasPrefix(reply, "ERROR NOTFOUND ") {
+		t.Errorf("bob read %q of a key only alice wrote", reply)
+	}
+	if reply := run(alice, "GET users pat"); !strings.HasPrefix(reply, "ERROR NOTFOUND ") {
+		t.Errorf("alice read %q, the uncommitted write of bob", reply)
+	}
+
+	if reply := run(alice, "COMMIT"); reply != "OK" {
+		t.Fatalf("COMMIT replied %q", reply)
+	}
+	if reply := run(bob, "TGET users zed"); reply != "3" {
+		t.Errorf("bob read %q after alice committed", reply)
+	}
+
+	// rolling back leaves the store as alice committed it
+	if reply := run(bob, "ROLLBACK"); reply != "OK" {
+		t.Fatalf("ROLLBACK replied %q", reply)
+	}
+	for key, want := range map[string]string{"amy": "2", "zed": "3"} {
+		if reply := run(bob, "GET users "+key); reply != want {
+			t.Errorf("GET %s replied %q, want %q", key, reply, want)
+		}
+	}
+	if reply := run(bob, "GET users pat"); !strings.HasPrefix(reply, "ERROR NOTFOUND ") {
+		t.Errorf("a rolled back write was stored: %q", reply)
+	}
+	if reply := run(alice, "TSET users amy 5"); !strings.HasPrefix(reply, "ERROR ") {
+		t.Errorf("TSET after COMMIT replied %q", reply)
+	}
+}
+
+func TestRollbackToSavepoint(t *testing.T) {
+	cs := models.NewCollectionStore()
+	kv := &models.KVServer{Config: &models.Config{}}
+	cc := &models.ClientConfig{ClientID: "alice", ClientState: models.NewClientState()}
+	run := func(command string) string {
+		t.Helper()
+		return server.ExecuteCommand(server.ParseCommand(command), cs, cc, kv, nil)
+	}
+
+	for _, command := range []string{"BEGIN", "TSET users amy 1", "SAVEPOINT first", "TSET users amy 2", "TSET users pat 3", "ROLLBACK to first", "COMMIT"} {
+		if reply := run(command); reply != "OK" {
+			t.Fatalf("%s replied %q", command, reply)
+		}
+	}
+	if reply := run("GET users amy"); reply != "1" {
+		t.Errorf("GET amy replied %q", reply)
+	}
+	if reply := run("GET users pat"); !strings.HasPrefix(reply, "ERROR NOTFOUND ") {
+		t.Errorf("a write rolled back to the savepoint was committed: %q", reply)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// Participant side of the two-phase commit run by the Coordinator. A shard
+// master handles:
+//
+//	PREPARE <tx id> <json writes>  locks the keys and persists the writes
+//	COMMIT-PREPARED <tx id>        applies the writes and releases the locks
+//	ABORT-PREPARED <tx id>         drops the writes and releases the locks
+//
+// All three are written to the shard dump once they succeed, so a restarted
+// shard replays its prepared transactions and keeps their keys locked until
+// the coordinator resolves them.
+
+func prepareTransaction(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) string {
+	txID := cmd.CollectionName
+	if txID == "" {
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: PREPARE <tx id> <json writes>")
+	}
+
+	writes := BatchWrites(cmd.Batch)
+	if len(cmd.Batch) == 0 {
+		if err := json.Unmarshal([]byte(strings.Join(cmd.Args, " ")), &writes); err != nil {
+			return utils.ErrorReply(utils.ERROR_GENERIC, "invalid writes: %v", err)
+		}
+	}
+	if len(writes) == 0 {
+		return utils.ErrorReply(utils.ERROR_GENERIC, "nothing to prepare")
+	}
+
+	// the keys are checked and taken with the store locked, as writes check
+	// them, so no write or LOCK of another client slips in between
+	var err error
+	cs.Exec(nil, func(*models.CollectionTx) {
+		for _, write := range writes {
+			if kv.Locks != nil && kv.Locks.LockedByOther(cc.ClientID, models.WatchedKey{Collection: write.Collection, Key: write.Key}) {
+				err = utils.NewError(utils.ERROR_LOCKED, "key %s in %s is locked by another client", write.Key, write.Collection)
+				return
+			}
+		}
+		err = cs.Prepared.Prepare(txID, writes)
+	})
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	cmd.Batch = TransactionBatch(writes)
+	return "OK"
+}
+
+func commitPrepared(cmd *Command, cs *models.CollectionStore) string {
+	txID := cmd.CollectionName
+	if txID == "" {
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: COMMIT-PREPARED <tx id>")
+	}
+
+	writes, ok := cs.Prepared.Writes(txID)
+	if !ok {
+		if len(cmd.Batch) == 0 {
+			// already committed, the coordinator is retrying
+			return "OK"
+		}
+		// replayed from a dump that lost the PREPARE
+		writes = BatchWrites(cmd.Batch)
+	}
+
+	cs.ApplyTransaction(writes)
+	cs.Prepared.Finish(txID)
+	cmd.Batch = TransactionBatch(writes)
+	return "OK"
+}
+
+func abortPrepared(cmd *Command, cs *models.CollectionStore) string {
+	txID := cmd.CollectionName
+	if txID == "" {
+		return utils.ErrorReply(utils.ERROR_SYNTAX, "Usage: ABORT-PREPARED <tx id>")
+	}
+
+	// the dropped writes are logged so the abort is replayed too
+	if writes, ok := cs.Prepared.Finish(txID); ok {
+		cmd.Batch = TransactionBatch(writes)
+	}
+	return "OK"
+}
+
+// Participant is a shard master taking part in a two-phase commit.
+type Participant interface {
+	Prepare(txID string, writes []models.TransactionWrite) error
+	Commit(txID string) error
+	Abort(txID string) error
+}
+
+// TCPParticipant reaches a shard master over its client port.
+type TCPParticipant struct {
+	Address string
+}
+
+func (p *TCPParticipant) Prepare(txID string, writes []models.TransactionWrite) error {
+	data, err := json.Marshal(writes)
+	if err != nil {
+		return err
+	}
+	return p.send(fmt.Sprintf("%s %s %s", utils.PREPARE, txID, data))
+}
+
+func (p *TCPParticipant) Commit(txID string) error {
+	return p.send(fmt.Sprintf("%s %s", utils.COMMIT_PREPARED, txID))
+}
+
+func (p *TCPParticipant) Abort(txID string) error {
+	return p.send(fmt.Sprintf("%s %s", utils.ABORT_PREPARED, txID))
+}
+
+func (p *TCPParticipant) send(command string) error {
+	res, err := sendCommand(command, p.Address)
+	if err != nil {
+		return err
+	}
+	return participantError(strings.TrimSpace(res))
+}
+
+// LocalParticipant runs the participant commands against an in-process
+// store, logging them to its dump like a shard server would.
+type LocalParticipant struct {
+	Store        *models.CollectionStore
+	SnapshotPath string
+}
+
+func (p *LocalParticipant) Prepare(txID string, writes []models.TransactionWrite) error {
+	return p.run(&Command{Name: utils.PREPARE, CollectionName: txID, Batch: TransactionBatch(writes)})
+}
+
+func (p *LocalParticipant) Commit(txID string) error {
+	return p.run(&Command{Name: utils.COMMIT_PREPARED, CollectionName: txID})
+}
+
+func (p *LocalParticipant) Abort(txID string) error {
+	return p.run(&Command{Name: utils.ABORT_PREPARED, CollectionName: txID})
+}
+
+func (p *LocalParticipant) run(cmd *Command) error {
+	cc := &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}
+	result := ExecuteCommand(cmd, p.Store, cc, &models.KVServer{Config: &models.Config{ProtectedMode: false}}, nil)
+	if err := participantError(result); err != nil {
+		return err
+	}
+	if p.SnapshotPath != "" && ShouldWriteLog(*cmd) {
+		return WriteCommandsToFile(*cmd, p.SnapshotPath)
+	}
+	return nil
+}
+
+func participantError(result string) error {
+	if result == "OK" {
+		return nil
+	}
+	if kvErr, ok := utils.ParseErrorReply(result); ok {
+		return kvErr
+	}
+	return fmt.Errorf("participant replied: %s", result)
+}
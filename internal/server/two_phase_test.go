@@ -0,0 +1,104 @@
+package server_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+// serveStore answers every line on a TCP port with the reply of the store,
+// like a shard master does.
+func serveStore(t *testing.T, cs *models.CollectionStore) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	cc := &models.ClientConfig{ClientState: models.NewClientState()}
+	kv := &models.KVServer{Config: &models.Config{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil {
+				conn.Write([]byte(server.ExecuteCommand(server.ParseCommand(line), cs, cc, kv, nil) + "\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTCPParticipantKeepsWhitespaceInValues(t *testing.T) {
+	cs := models.NewCollectionStore()
+	participant := &server.TCPParticipant{Address: serveStore(t, cs)}
+
+	value := "two  spaces\tand a tab"
+	if err := participant.Prepare("tx1", []models.TransactionWrite{{Collection: "users", Key: "amy", Value: value}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := participant.Commit("tx1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := cs.GetKeyInCollection("users", "amy"); got != value {
+		t.Fatalf("committed %q, want %q", got, value)
+	}
+}
+
+func TestPreparedKeysRefuseEveryWrite(t *testing.T) {
+	cs := models.NewCollectionStore()
+	kv := &models.KVServer{Config: &models.Config{}}
+	cc := &models.ClientConfig{ClientID: "alice", ClientState: models.NewClientState()}
+	run := func(command string) string {
+		t.Helper()
+		return server.ExecuteCommand(server.ParseCommand(command), cs, cc, kv, nil)
+	}
+
+	run("SET users amy 1")
+	if reply := run(`PREPARE tx1 [{"Collection":"users","Key":"amy","Value":"2"}]`); reply != "OK" {
+		t.Fatalf("PREPARE replied %q", reply)
+	}
+
+	for _, commands := range [][]string{
+		{"SET users amy 3"},
+		{"DELETE users amy"},
+		{"SET-TTL users amy 10s"},
+		{"MSET users pat 1 amy 3"},
+		{"BEGIN", "TSET users amy 3", "COMMIT"},
+		{"MULTI", "SET users pat 1", "SET users amy 3", "EXEC"},
+	} {
+		var reply string
+		for _, command := range commands {
+			reply = run(command)
+		}
+		if !strings.HasPrefix(reply, "ERROR LOCKED ") {
+			t.Errorf("%v replied %q", commands, reply)
+		}
+		if cc.ClientState.State == utils.TRANSACTIONAL {
+			// a refused COMMIT leaves the transaction open
+			run("ROLLBACK")
+		}
+	}
+	if got := cs.GetKeyInCollection("users", "amy"); got != "1" {
+		t.Errorf("a prepared key was written: %q", got)
+	}
+	if got := cs.GetKeyInCollection("users", "pat"); !strings.HasPrefix(got, "ERROR NOTFOUND ") {
+		t.Errorf("a refused EXEC ran some of its writes: %q", got)
+	}
+
+	if reply := run("COMMIT-PREPARED tx1"); reply != "OK" {
+		t.Fatalf("COMMIT-PREPARED replied %q", reply)
+	}
+	if reply := run("SET users amy 3"); reply != "OK" {
+		t.Errorf("SET after the commit replied %q", reply)
+	}
+}
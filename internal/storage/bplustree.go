@@ -1,39 +1,165 @@
 // bplustree.go
 package storage
 
+import "sort"
+
+// BPLUS_DEFAULT_DEGREE is the number of keys a node holds before it splits,
+// when the tree is created without one.
+const BPLUS_DEFAULT_DEGREE = 32
+
 type BPlusNode struct {
 	isLeaf   bool
 	keys     []string
-	values   []string
-	children []*BPlusNode
+	values   []string     // leaves only
+	children []*BPlusNode // inner nodes only, children[i] holds the keys below keys[i]
+	next     *BPlusNode   // the leaf to the right, so the leaves can be walked in order
 }
 
+// InMemoryBPlusTree keeps the keys in order. Deleting a key doesn't merge
+// nodes, a leaf can be left with few or no keys, which lookups don't mind.
 type InMemoryBPlusTree struct {
 	root   *BPlusNode
 	degree int
 }
 
 func NewInMemoryBPlusTree(degree int) *InMemoryBPlusTree {
+	if degree < 3 {
+		degree = BPLUS_DEFAULT_DEGREE
+	}
 	return &InMemoryBPlusTree{
 		root:   &BPlusNode{isLeaf: true},
 		degree: degree,
 	}
 }
 
-// Implementation of IStorage interface methods...
-// (Full B+ tree implementation would be quite lengthy)
-
 func (b *InMemoryBPlusTree) Set(key string, value string) error {
-	// Implementation
+	separator, right := b.insert(b.root, key, value)
+	if right != nil {
+		b.root = &BPlusNode{
+			keys:     []string{separator},
+			children: []*BPlusNode{b.root, right},
+		}
+	}
 	return nil
 }
 
+// insert stores the key under node. When node splits, it returns the first
+// key of the new right node and the node itself.
+func (b *InMemoryBPlusTree) insert(node *BPlusNode, key, value string) (string, *BPlusNode) {
+	if node.isLeaf {
+		i := sort.SearchStrings(node.keys, key)
+		if i < len(node.keys) && node.keys[i] == key {
+			node.values[i] = value
+			return "", nil
+		}
+		node.keys = insertAt(node.keys, i, key)
+		node.values = insertAt(node.values, i, value)
+		if len(node.keys) <= b.degree {
+			return "", nil
+		}
+
+		mid := len(node.keys) / 2
+		right := &BPlusNode{
+			isLeaf: true,
+			keys:   append([]string(nil), node.keys[mid:]...),
+			values: append([]string(nil), node.values[mid:]...),
+			next:   node.next,
+		}
+		node.keys = node.keys[:mid:mid]
+		node.values = node.values[:mid:mid]
+		node.next = right
+		return right.keys[0], right
+	}
+
+	i := childIndex(node, key)
+	separator, child := b.insert(node.children[i], key, value)
+	if child == nil {
+		return "", nil
+	}
+	node.keys = insertAt(node.keys, i, separator)
+	node.children = insertAt(node.children, i+1, child)
+	if len(node.keys) <= b.degree {
+		return "", nil
+	}
+
+	// the middle key moves up, it doesn't stay in either half
+	mid := len(node.keys) / 2
+	separator = node.keys[mid]
+	right := &BPlusNode{
+		keys:     append([]string(nil), node.keys[mid+1:]...),
+		children: append([]*BPlusNode(nil), node.children[mid+1:]...),
+	}
+	node.keys = node.keys[:mid:mid]
+	node.children = node.children[: mid+1 : mid+1]
+	return separator, right
+}
+
 func (b *InMemoryBPlusTree) Get(key string) (string, error) {
-	// Implementation
-	return "", nil
+	leaf := b.leaf(key)
+	i := sort.SearchStrings(leaf.keys, key)
+	if i < len(leaf.keys) && leaf.keys[i] == key {
+		return leaf.values[i], nil
+	}
+	return "", ErrKeyNotFound
 }
 
 func (b *InMemoryBPlusTree) Delete(key string) error {
-	// Implementation
+	leaf := b.leaf(key)
+	i := sort.SearchStrings(leaf.keys, key)
+	if i < len(leaf.keys) && leaf.keys[i] == key {
+		leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
+		leaf.values = append(leaf.values[:i], leaf.values[i+1:]...)
+	}
 	return nil
 }
+
+func (b *InMemoryBPlusTree) GetAll() (map[string]string, error) {
+	data := make(map[string]string)
+	node := b.root
+	for !node.isLeaf {
+		node = node.children[0]
+	}
+	for ; node != nil; node = node.next {
+		for i, key := range node.keys {
+			data[key] = node.values[i]
+		}
+	}
+	return data, nil
+}
+
+func (b *InMemoryBPlusTree) Range(from string, fn func(key, value string) bool) error {
+	node := b.leaf(from)
+	i := sort.SearchStrings(node.keys, from)
+	for ; node != nil; node, i = node.next, 0 {
+		for ; i < len(node.keys); i++ {
+			if !fn(node.keys[i], node.values[i]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// leaf returns the leaf the key belongs in.
+func (b *InMemoryBPlusTree) leaf(key string) *BPlusNode {
+	node := b.root
+	for !node.isLeaf {
+		node = node.children[childIndex(node, key)]
+	}
+	return node
+}
+
+// childIndex returns the child of an inner node the key belongs under.
+func childIndex(node *BPlusNode, key string) int {
+	return sort.Search(len(node.keys), func(i int) bool {
+		return key < node.keys[i]
+	})
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
@@ -59,26 +59,17 @@ func (t *FileBPlusTree) Set(key, value string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	root, err := t.readNode(t.root)
-	if err != nil {
-		return err
-	}
-
-	// Insert logic here (simplified)
-	return t.insertIntoNode(root, key, value)
+	// Insert logic here, until then the tree is left as it is rather than
+	// half written by a call that reports a failure
+	return ErrNotImplemented
 }
 
 func (t *FileBPlusTree) Get(key string) (string, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	node, err := t.readNode(t.root)
-	if err != nil {
-		return "", err
-	}
-
-	// Search logic here (simplified)
-	return t.searchInNode(node, key)
+	// Search logic here
+	return "", ErrNotImplemented
 }
 
 func (t *FileBPlusTree) Delete(key string) error {
@@ -86,7 +77,16 @@ func (t *FileBPlusTree) Delete(key string) error {
 	defer t.mu.Unlock()
 
 	// Delete logic here
-	return nil
+	return ErrNotImplemented
+}
+
+func (t *FileBPlusTree) GetAll() (map[string]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// Traversal logic here, until then checkpoints must not take the tree
+	// for empty
+	return nil, ErrNotImplemented
 }
 
 // Helper methods for node operations
@@ -4,7 +4,6 @@ package storage
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
 	"sync"
 )
@@ -49,7 +48,7 @@ func (f *FileHashMap) Get(key string) (string, error) {
 	if val, ok := f.data[key]; ok {
 		return val, nil
 	}
-	return "", fmt.Errorf("key not found")
+	return "", ErrKeyNotFound
 }
 
 func (f *FileHashMap) Delete(key string) error {
@@ -60,6 +59,17 @@ func (f *FileHashMap) Delete(key string) error {
 	return f.persist()
 }
 
+func (f *FileHashMap) GetAll() (map[string]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	data := make(map[string]string, len(f.data))
+	for key, value := range f.data {
+		data[key] = value
+	}
+	return data, nil
+}
+
 func (f *FileHashMap) persist() error {
 	data, err := json.Marshal(f.data)
 	if err != nil {
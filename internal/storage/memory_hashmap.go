@@ -2,8 +2,6 @@
 package storage
 
 import (
-	"fmt"
-
 	"github.com/sk25469/kv/logger"
 )
 
@@ -28,10 +26,18 @@ func (s *InMemoryHashMap) Get(key string) (string, error) {
 	if val, exists := s.data[key]; exists {
 		return val, nil
 	}
-	return "", fmt.Errorf("key not found")
+	return "", ErrKeyNotFound
 }
 
 func (s *InMemoryHashMap) Delete(key string) error {
 	delete(s.data, key)
 	return nil
 }
+
+func (s *InMemoryHashMap) GetAll() (map[string]string, error) {
+	data := make(map[string]string, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	return data, nil
+}
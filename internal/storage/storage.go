@@ -4,12 +4,30 @@ import (
 	"fmt"
 
 	storage "github.com/sk25469/kv/internal/storage/model"
+	"github.com/sk25469/kv/utils"
 )
 
+// ErrKeyNotFound is returned by Get for a key that is not stored.
+var ErrKeyNotFound = utils.NewError(utils.ERROR_NOTFOUND, "key not found")
+
+// ErrNotImplemented is returned by the operations of backends that are not
+// written yet.
+var ErrNotImplemented = utils.NewError(utils.ERROR_GENERIC, "storage backend is not implemented")
+
 type IStorage interface {
 	Set(key string, value string) error
 	Get(key string) (string, error)
 	Delete(key string) error
+	// GetAll returns a copy of every key-value pair in the storage
+	GetAll() (map[string]string, error)
+}
+
+// IRangeStorage is implemented by the storages that keep their keys in
+// order, so a scan reads only the keys it returns.
+type IRangeStorage interface {
+	// Range calls fn with every pair whose key sorts at or after from, in
+	// key order, until fn returns false.
+	Range(from string, fn func(key, value string) bool) error
 }
 
 type StorageServiceParams struct {
@@ -14,7 +14,7 @@ import (
 
 var (
 	instance *logrus.Logger
-	once     sync.Once
+	mu       sync.Mutex
 )
 
 type Config struct {
@@ -28,27 +28,36 @@ type Config struct {
 	JSONFormat   bool
 }
 
+// InitLogger configures the logger. The package loggers share it, so it can
+// be configured after they were created, once the node config is read.
 func InitLogger(config Config) *logrus.Logger {
-	once.Do(func() {
-		instance = logrus.New()
+	mu.Lock()
+	defer mu.Unlock()
+	configure(config)
+	return instance
+}
 
-		// Set log level
-		level, err := logrus.ParseLevel(config.LogLevel)
-		if err != nil {
-			level = logrus.InfoLevel
-		}
-		instance.SetLevel(level)
+func configure(config Config) {
+	if instance == nil {
+		instance = logrus.New()
+	}
 
-		// Configure output writers
-		writers := []io.Writer{os.Stdout} // Always write to console
+	// Set log level
+	level, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	instance.SetLevel(level)
 
-		if config.LogFile != "" {
-			// Create log directory if it doesn't exist
-			logDir := path.Dir(config.LogFile)
-			if err := os.MkdirAll(logDir, 0755); err != nil {
-				panic(err)
-			}
+	// Configure output writers
+	writers := []io.Writer{os.Stdout} // Always write to console
 
+	if config.LogFile != "" {
+		// Create log directory if it doesn't exist
+		logDir := path.Dir(config.LogFile)
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			instance.Errorf("Error creating log directory, logging to the console only: %v", err)
+		} else {
 			// Configure log rotation
 			fileWriter := &lumberjack.Logger{
 				Filename:   config.LogFile,
@@ -59,39 +68,33 @@ func InitLogger(config Config) *logrus.Logger {
 			}
 			writers = append(writers, fileWriter)
 		}
+	}
 
-		// Set multi-writer
-		instance.SetOutput(io.MultiWriter(writers...))
+	// Set multi-writer
+	instance.SetOutput(io.MultiWriter(writers...))
 
-		// Configure formatter
-		if config.JSONFormat {
-			instance.SetFormatter(&logrus.JSONFormatter{
-				TimestampFormat: time.RFC3339,
-			})
-		} else {
-			instance.SetFormatter(&logrus.TextFormatter{
-				FullTimestamp:   true,
-				TimestampFormat: time.RFC3339,
-			})
-		}
-
-		instance.SetReportCaller(config.ReportCaller)
-	})
+	// Configure formatter
+	if config.JSONFormat {
+		instance.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339,
+		})
+	} else {
+		instance.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339,
+		})
+	}
 
-	return instance
+	instance.SetReportCaller(config.ReportCaller)
 }
 
 func GetLogger() *logrus.Logger {
+	mu.Lock()
+	defer mu.Unlock()
 	if instance == nil {
-		// Default configuration if not initialized
-		InitLogger(Config{
-			LogLevel:   "info",
-			LogFile:    "logs/app.log",
-			MaxSize:    100,
-			MaxBackups: 3,
-			MaxAge:     28,
-			Compress:   true,
-		})
+		// Default configuration if not initialized, the console only so
+		// tests and tools don't leave log files where they run
+		configure(Config{LogLevel: "info"})
 	}
 	return instance
 }
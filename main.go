@@ -86,27 +86,55 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/sk25469/kv/internal/certs"
 	"github.com/sk25469/kv/internal/codec"
 	"github.com/sk25469/kv/internal/comm"
 	"github.com/sk25469/kv/internal/core"
 	"github.com/sk25469/kv/internal/middleware"
+	models "github.com/sk25469/kv/internal/model"
 	"github.com/sk25469/kv/internal/network"
 	node_config "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
 	"github.com/sk25469/kv/internal/replication"
 	"github.com/sk25469/kv/internal/storage"
 	storage_model "github.com/sk25469/kv/internal/storage/model"
+	"github.com/sk25469/kv/logger"
 	"github.com/sk25469/kv/utils"
 )
 
 func main() {
+	// Offline subcommands run instead of the node
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "wal":
+			runWAL(os.Args[2:])
+			return
+		}
+	}
+
 	// Define command-line flags
 	configPath := flag.String("config", utils.MASTER_CONFIG_FILE, "Path to master config file")
+	recoverUntilSeq := flag.Uint64("recover-until-seq", 0, "Rebuild state up to this WAL sequence and serve it read-only")
+	recoverUntilTime := flag.String("recover-until-time", "", "Rebuild state as of this RFC3339 time and serve it read-only")
 
 	// Parse flags
 	flag.Parse()
 	utils.AsciiArt()
 
+	recoveryTarget := wal.RecoveryTarget{Sequence: *recoverUntilSeq}
+	if *recoverUntilTime != "" {
+		until, err := time.Parse(time.RFC3339, *recoverUntilTime)
+		if err != nil {
+			log.Fatalf("Invalid --recover-until-time: %v", err)
+		}
+		recoveryTarget.Time = until
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -120,7 +148,44 @@ func main() {
 		cancel()
 	}()
 
-	communicationService := comm.NewCommunicationService()
+	nodeConfig := node_config.NewNodeConfig(*configPath)
+
+	// the package loggers write to the console until the node log file is
+	// known
+	logger.InitLogger(logger.Config{
+		LogLevel:   "info",
+		LogFile:    nodeConfig.LogPath,
+		MaxSize:    100,
+		MaxBackups: 3,
+		MaxAge:     28,
+		Compress:   true,
+	})
+
+	// serve TLS and talk to other nodes over mutual TLS if the node has a
+	// certificate
+	var certStore *certs.Store
+	if nodeConfig.HasTLS() {
+		if nodeConfig.TLSCAFile == "" {
+			log.Fatalf("tls_cert_file needs tls_ca_file, other nodes are verified with it")
+		}
+		var err error
+		certStore, err = certs.NewStore(certs.StoreParams{
+			CertFile: nodeConfig.TLSCertFile,
+			KeyFile:  nodeConfig.TLSKeyFile,
+			CAFile:   nodeConfig.TLSCAFile,
+		})
+		if err != nil {
+			log.Fatalf("Error loading TLS certificates: %v", err)
+		}
+		defer certStore.Close()
+	} else if nodeConfig.TLSRequired {
+		log.Fatalf("tls_required needs tls_cert_file and tls_key_file")
+	}
+
+	communicationService := comm.NewCommunicationService(comm.CommunicationServiceParams{
+		Certs:      certStore,
+		NodeConfig: nodeConfig,
+	})
 	replicationService := replication.NewReplicationService(replication.ReplicationServiceParams{
 		CommunicationLayer: communicationService,
 	})
@@ -133,14 +198,17 @@ func main() {
 		log.Fatalf("Error creating storage: %v", err)
 	}
 
-	nodeConfig := node_config.NewNodeConfig(*configPath)
-
-	storageMiddleware, err := middleware.NewStorageMiddleware(storage, nodeConfig.LogPath)
+	// a point-in-time recovery only reads the log
+	newStorageMiddleware := middleware.NewStorageMiddleware
+	if recoveryTarget.IsSet() {
+		newStorageMiddleware = middleware.NewReadOnlyStorageMiddleware
+	}
+	storageMiddleware, err := newStorageMiddleware(storage, nodeConfig.DataDir)
 	if err != nil {
 		log.Fatalf("Error creating storage middleware: %v", err)
 	}
 
-	err = storageMiddleware.Recover()
+	err = storageMiddleware.Recover(recoveryTarget)
 	if err != nil {
 		log.Fatalf("Error recovering storage: %v", err)
 	}
@@ -160,6 +228,8 @@ func main() {
 		CoreLayer:          coreLayer,
 		CommunicationLayer: communicationService,
 		CodecLayer:         codecLayer,
+		PubSub:             models.NewPubSub(),
+		Certs:              certStore,
 	})
 
 	// Create a context that is cancelled on termination signals
@@ -180,14 +250,57 @@ func main() {
 	healthCheckService.StartHealthCheck()
 	healthCheckService.StartPeriodicHealthChecks(utils.HEALTH_CHECK_INTERVAL)
 
+	// start the gRPC API if the node has a port for it
+	var grpcService *network.GRPCService
+	if nodeConfig.GRPCPort != 0 {
+		grpcService = network.NewGRPCService(network.GRPCServiceParams{
+			Port:       nodeConfig.GRPCPort,
+			NodeConfig: nodeConfig,
+			CoreLayer:  coreLayer,
+			Certs:      certStore,
+		})
+		go func() {
+			if err := grpcService.Start(); err != nil {
+				log.Fatalf("Error starting gRPC server: %v", err)
+			}
+		}()
+	}
+
+	// start the memcached listener if the node has a port for it
+	var memcachedService *network.MemcachedService
+	if nodeConfig.MemcachedPort != 0 {
+		memcachedService = network.NewMemcachedService(network.MemcachedServiceParams{
+			Port:       nodeConfig.MemcachedPort,
+			NodeConfig: nodeConfig,
+			CoreLayer:  coreLayer,
+			Certs:      certStore,
+		})
+		go func() {
+			if err := memcachedService.Start(); err != nil {
+				log.Fatalf("Error starting memcached listener: %v", err)
+			}
+		}()
+	}
+
 	// Wait for the context to be cancelled
 	<-ctx.Done()
 
+	if grpcService != nil {
+		grpcService.Stop()
+	}
+	if memcachedService != nil {
+		memcachedService.Stop()
+	}
+
 	// Stop the network service
 	if err := networkLayer.Stop(); err != nil {
 		log.Fatalf("Error stopping network layer: %v", err)
 	}
 
+	if err := storageMiddleware.Close(); err != nil {
+		log.Printf("Error closing storage: %v", err)
+	}
+
 	log.Println("Server stopped gracefully")
 
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	node_config "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+)
+
+// runRestore rebuilds a node's data dir from a backup written by BACKUP,
+// found in the backups directory of the data dir it was taken on.
+//
+//	kv restore -from /var/lib/kvstore/backups/nightly [-config conf/kv.conf | -data-dir /var/lib/kvstore-new/]
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "Backup directory to restore from")
+	configPath := flags.String("config", utils.MASTER_CONFIG_FILE, "Path to the config file of the node to restore")
+	dataDir := flags.String("data-dir", "", "Data directory to restore into, overrides the config")
+	flags.Parse(args)
+
+	if *from == "" {
+		log.Fatalf("Usage: kv restore -from <backup dir> [-config <file> | -data-dir <dir>]")
+	}
+
+	target := *dataDir
+	if target == "" {
+		target = node_config.NewNodeConfig(*configPath).DataDir
+	}
+	if target == "" {
+		target = wal.DEFAULT_LOG_DIR
+	}
+
+	manifest, err := wal.RestoreBackup(*from, target)
+	if err != nil {
+		log.Fatalf("Error restoring backup: %v", err)
+	}
+	log.Printf("Restored backup from %s into %s up to sequence %d", *from, target, manifest.Sequence)
+}
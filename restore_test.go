@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	wal "github.com/sk25469/kv/internal/persistence"
+)
+
+func TestRunRestore(t *testing.T) {
+	source := t.TempDir()
+	w, err := wal.NewFileWAL(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendLog(wal.LogEntry{Operation: wal.SET, Key: "k", Value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Backup("nightly", &wal.Snapshot{CreatedAt: time.Now(), Data: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	from, _ := wal.BackupPath(source, "nightly")
+
+	target := t.TempDir()
+	runRestore([]string{"-from", from, "-data-dir", target})
+
+	restored, err := wal.NewFileWAL(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	_, entries, err := restored.Recover(wal.RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "k" {
+		t.Fatalf("expected the backed up write, got %+v", entries)
+	}
+}
@@ -13,6 +13,7 @@ var (
 	SLAVE_3_CONFIG     = CONF_DIRECTORY + "slave3.conf"
 	SNAPSHOT_FILE      = SNAPSHOT_DIRECTORY + "snapshot.txt"
 	SHARD_CONFIG_FILE  = CONF_DIRECTORY + "shard-conf.json"
+	DECISION_LOG_FILE  = SNAPSHOT_DIRECTORY + "2pc-decisions.log"
 )
 
 var EtcdEndpoints = []string{"http://localhost:2379"}
@@ -29,11 +30,15 @@ const (
 	SNAPSHOT_DIRECTORY    = "/home/sahilsarwar/projects/kv/snapshot/"
 	CONF_DIRECTORY        = "/home/sahilsarwar/projects/kv/conf/"
 	PUB_SUB               = 2
+	QUEUING               = 3
 	SUBSCRIBE             = "SUBSCRIBE"
 	PUBLISH               = "PUBLISH"
 	GET                   = "GET"
 	SET                   = "SET"
 	DEL                   = "DELETE"
+	MGET                  = "MGET"
+	MSET                  = "MSET"
+	MDEL                  = "MDEL"
 	SET_TTL               = "SET-TTL"
 	EXISTS                = "EXISTS"
 	EXPIRE                = "EXPIRE"
@@ -42,6 +47,21 @@ const (
 	BEGIN                 = "BEGIN"
 	COMMIT                = "COMMIT"
 	ROLLBACK              = "ROLLBACK"
+	SAVEPOINT             = "SAVEPOINT"
+	RELEASE               = "RELEASE"
+	LOCK                  = "LOCK"
+	UNLOCK                = "UNLOCK"
+	LOCK_TIMEOUT          = 10 * time.Second // default wait for LOCK
+	WATCH                 = "WATCH"
+	UNWATCH               = "UNWATCH"
+	MULTI                 = "MULTI"
+	EXEC                  = "EXEC"
+	DISCARD               = "DISCARD"
+	NIL_REPLY             = "(nil)"
+	PREPARE               = "PREPARE"
+	COMMIT_PREPARED       = "COMMIT-PREPARED"
+	ABORT_PREPARED        = "ABORT-PREPARED"
+	TXN                   = "TXN"
 	SHUTDOWN              = "SHUTDOWN"
 	MAKE_MASTER           = "MAKE_MASTER"
 	MAKE_SLAVE            = "MAKE_SLAVE"
@@ -50,4 +70,11 @@ const (
 	COMM                  = "COMM"
 	KV_ETCD_ENDPOINT      = "http://localhost:2379"
 	KV_ETCD_KEY           = "/kv/"
+	SERVER_VERSION        = "0.1.0"
+	PROTOCOL_VERSION      = 1 // version of the text protocol, negotiated with HELLO
+	HELLO                 = "HELLO"
+	SCAN_DEFAULT_COUNT    = 100
+	// DEFAULT_MAX_REQUEST_SIZE caps a single request unless the node config
+	// sets max_request_size. Larger values are uploaded with SETCHUNK.
+	DEFAULT_MAX_REQUEST_SIZE = 64 * 1024 * 1024
 )
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCode tells clients what kind of error a reply carries, so they don't
+// have to match on the message.
+type ErrorCode string
+
+const (
+	ERROR_GENERIC   ErrorCode = "ERR"       // anything without a more specific code
+	ERROR_SYNTAX    ErrorCode = "SYNTAX"    // wrong arguments, the message holds the usage
+	ERROR_UNKNOWN   ErrorCode = "UNKNOWN"   // unknown command
+	ERROR_NOTFOUND  ErrorCode = "NOTFOUND"  // the key or collection does not exist
+	ERROR_WRONGTYPE ErrorCode = "WRONGTYPE" // the key holds a value the command does not apply to
+	ERROR_NOAUTH    ErrorCode = "NOAUTH"    // the client has to authenticate first
+	ERROR_READONLY  ErrorCode = "READONLY"  // the node does not take writes
+	ERROR_MOVED     ErrorCode = "MOVED"     // the key is served by another node, the message holds its address
+	ERROR_TIMEOUT   ErrorCode = "TIMEOUT"   // the command did not finish in time
+	ERROR_LOCKED    ErrorCode = "LOCKED"    // the key is locked by another client or transaction
+	ERROR_DEADLOCK  ErrorCode = "DEADLOCK"  // waiting for a lock would deadlock, the transaction is aborted
+	ERROR_NOPROTO   ErrorCode = "NOPROTO"   // the server does not speak the protocol version HELLO asked for
+	ERROR_TOOLARGE  ErrorCode = "TOOLARGE"  // the request is over the size limit of the node
+	ERROR_NOSCRIPT  ErrorCode = "NOSCRIPT"  // EVALSHA of a script that was not loaded
+)
+
+// ERROR_REPLY_PREFIX starts every error reply of the text protocol:
+// "ERROR <code> <message>"
+const ERROR_REPLY_PREFIX = "ERROR "
+
+// KVError is an error with a code.
+type KVError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func NewError(code ErrorCode, format string, args ...interface{}) *KVError {
+	return &KVError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *KVError) Error() string {
+	return e.Message
+}
+
+// Is matches errors by code, so errors.Is(err, &KVError{Code: ERROR_NOTFOUND})
+// holds for any not-found error.
+func (e *KVError) Is(target error) bool {
+	t, ok := target.(*KVError)
+	return ok && t.Message == "" && t.Code == e.Code
+}
+
+// ErrorCodeOf returns the code of the error. Deadlines map to TIMEOUT and
+// errors without a code to ERR.
+func ErrorCodeOf(err error) ErrorCode {
+	var kvErr *KVError
+	switch {
+	case errors.As(err, &kvErr):
+		return kvErr.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return ERROR_TIMEOUT
+	}
+	return ERROR_GENERIC
+}
+
+// ErrorReply formats an error reply of the text protocol.
+func ErrorReply(code ErrorCode, format string, args ...interface{}) string {
+	return ERROR_REPLY_PREFIX + string(code) + " " + fmt.Sprintf(format, args...)
+}
+
+// FormatError formats err as an error reply of the text protocol.
+func FormatError(err error) string {
+	return ErrorReply(ErrorCodeOf(err), "%s", err.Error())
+}
+
+// ParseErrorReply returns the error carried by a reply, if it is an error
+// reply.
+func ParseErrorReply(reply string) (*KVError, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimRight(reply, "\r\n"), ERROR_REPLY_PREFIX)
+	if !ok {
+		return nil, false
+	}
+	code, message, _ := strings.Cut(rest, " ")
+	return &KVError{Code: ErrorCode(code), Message: message}, true
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// HelloArgs are the arguments of
+// HELLO <version> [AUTH <username> <password>] [SETNAME <name>].
+type HelloArgs struct {
+	Version  int
+	Auth     bool // the client sent credentials
+	Username string
+	Password string
+	Name     string
+}
+
+// HelloReply describes the server to a client that sent HELLO. The text
+// protocol sends it as a JSON line.
+type HelloReply struct {
+	Server     string   `json:"server"`
+	Version    string   `json:"version"`
+	Proto      int      `json:"proto"`
+	ID         string   `json:"id"`
+	Role       string   `json:"role"` // master or replica
+	Auth       string   `json:"auth"` // password if clients have to authenticate, none otherwise
+	Codecs     []string `json:"codecs"`
+	Features   []string `json:"features"`
+	ClientName string   `json:"client_name,omitempty"`
+}
+
+const HELLO_USAGE = "Usage: HELLO <version> [AUTH <username> <password>] [SETNAME <name>]"
+
+// ParseHello parses the arguments following HELLO. A version the server
+// doesn't speak is a NOPROTO error, so clients fail before sending anything
+// else.
+func ParseHello(args []string) (HelloArgs, error) {
+	var hello HelloArgs
+	if len(args) == 0 {
+		return hello, NewError(ERROR_SYNTAX, HELLO_USAGE)
+	}
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		return hello, NewError(ERROR_SYNTAX, HELLO_USAGE)
+	}
+	if version != PROTOCOL_VERSION {
+		return hello, NewError(ERROR_NOPROTO, "unsupported protocol version %d, the server speaks %d", version, PROTOCOL_VERSION)
+	}
+	hello.Version = version
+
+	for i := 1; i < len(args); {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return hello, NewError(ERROR_SYNTAX, HELLO_USAGE)
+			}
+			hello.Auth = true
+			hello.Username, hello.Password = args[i+1], args[i+2]
+			i += 3
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return hello, NewError(ERROR_SYNTAX, HELLO_USAGE)
+			}
+			hello.Name = args[i+1]
+			i += 2
+		default:
+			return hello, NewError(ERROR_SYNTAX, HELLO_USAGE)
+		}
+	}
+	return hello, nil
+}
+
+// String returns the reply as the JSON line the text protocol sends.
+func (h HelloReply) String() string {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return ErrorReply(ERROR_GENERIC, err.Error())
+	}
+	return string(data)
+}
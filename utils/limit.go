@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// ErrTooLarge is returned for a request over the size limit of the node.
+var ErrTooLarge = NewError(ERROR_TOOLARGE, "request too large")
+
+// ReadLine reads a line of the text protocol, holding at most maxSize bytes
+// of it in memory. A longer line is skipped up to its newline, so the next
+// command can still be read, and ErrTooLarge is returned. A maxSize of 0
+// means no limit.
+func ReadLine(r *bufio.Reader, maxSize int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if maxSize > 0 && len(line)+len(chunk) > maxSize {
+			if err := skipLine(r, err); err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("%w: over %d bytes", ErrTooLarge, maxSize)
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// skipLine discards the rest of a line. err is the error of the last read.
+func skipLine(r *bufio.Reader, err error) error {
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
+	}
+	return err
+}
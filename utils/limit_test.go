@@ -0,0 +1,41 @@
+package utils_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sk25469/kv/utils"
+)
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	// a buffer smaller than the long line, so it is read in several slices
+	r := bufio.NewReaderSize(strings.NewReader("SET a 1\n"+long+"\nGET a\n"+long[:20]+"\nlast"), 16)
+
+	for _, want := range []struct {
+		line string
+		err  error
+	}{
+		{"SET a 1\n", nil},
+		{"", utils.ErrTooLarge}, // skipped, the next line is read after it
+		{"GET a\n", nil},
+		{long[:20] + "\n", nil}, // longer than the buffer, within the limit
+		{"last", io.EOF},
+	} {
+		line, err := utils.ReadLine(r, 100)
+		if line != want.line || !errors.Is(err, want.err) {
+			t.Fatalf("ReadLine = %q, %v, want %q, %v", line, err, want.line, want.err)
+		}
+	}
+}
+
+func TestReadLineWithoutLimit(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	r := bufio.NewReaderSize(strings.NewReader(long+"\n"), 16)
+	if line, err := utils.ReadLine(r, 0); err != nil || line != long+"\n" {
+		t.Fatalf("ReadLine = %d bytes, %v", len(line), err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	node_config "github.com/sk25469/kv/internal/network/model"
+	wal "github.com/sk25469/kv/internal/persistence"
+	"github.com/sk25469/kv/utils"
+)
+
+const walUsage = "Usage: kv wal <dump|verify|stats|repair> [-config <file> | -dir <data dir>]"
+
+// runWAL inspects or repairs the WAL of a stopped node.
+//
+//	kv wal dump   prints every entry with its sequence
+//	kv wal verify checks framing and checksums of segments and snapshots
+//	kv wal stats  prints per-key counts, the operation mix and sizes
+//	kv wal repair truncates segments at their first invalid entry
+func runWAL(args []string) {
+	if len(args) == 0 {
+		log.Fatal(walUsage)
+	}
+
+	flags := flag.NewFlagSet("wal "+args[0], flag.ExitOnError)
+	configPath := flags.String("config", utils.MASTER_CONFIG_FILE, "Path to the config file of the node")
+	dir := flags.String("dir", "", "Data directory holding the WAL, overrides the config")
+	top := flags.Int("top", 10, "Number of keys listed by stats")
+	flags.Parse(args[1:])
+
+	dataDir := *dir
+	if dataDir == "" {
+		dataDir = node_config.NewNodeConfig(*configPath).DataDir
+	}
+	if dataDir == "" {
+		dataDir = wal.DEFAULT_LOG_DIR
+	}
+
+	var err error
+	switch args[0] {
+	case "dump":
+		err = dumpWAL(dataDir)
+	case "verify":
+		var ok bool
+		ok, err = verifyWAL(dataDir)
+		if err == nil && !ok {
+			os.Exit(1)
+		}
+	case "stats":
+		err = walStats(dataDir, *top)
+	case "repair":
+		err = repairWAL(dataDir)
+	default:
+		log.Fatal(walUsage)
+	}
+	if err != nil {
+		log.Fatalf("Error running wal %s: %v", args[0], err)
+	}
+}
+
+func dumpWAL(dir string) error {
+	reports, err := wal.InspectSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "SEQUENCE\tTIMESTAMP\tOPERATION\tKEY\tVALUE")
+	for _, report := range reports {
+		for _, entry := range report.Entries {
+			fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%q\n", entry.Sequence, entry.Timestamp.Format(time.RFC3339Nano), entry.Operation, entry.Key, entry.Value)
+			for _, write := range entry.Entries {
+				fmt.Fprintf(out, "\t\t  %s\t%s\t%q\n", write.Operation, write.Key, write.Value)
+			}
+		}
+		if report.Problem != "" {
+			fmt.Fprintf(out, "-\t-\t-\t-\t%s: %s\n", report.Path, report.Problem)
+		}
+	}
+	return out.Flush()
+}
+
+// verifyWAL reports every segment and snapshot and whether all of them are
+// valid.
+func verifyWAL(dir string) (bool, error) {
+	segments, err := wal.InspectSegments(dir)
+	if err != nil {
+		return false, err
+	}
+	snapshots, err := wal.InspectSnapshots(dir)
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	var lastSequence uint64
+	for _, report := range segments {
+		status := "ok"
+		if report.Problem != "" {
+			ok = false
+			status = report.Problem
+		}
+		for _, entry := range report.Entries {
+			if entry.Sequence <= lastSequence {
+				ok = false
+				status = fmt.Sprintf("sequence %d does not follow %d", entry.Sequence, lastSequence)
+				break
+			}
+			lastSequence = entry.Sequence
+		}
+		fmt.Printf("%s: %d entries (%d without checksum), %d bytes: %s\n", report.Path, len(report.Entries), report.Unchecked, report.Size, status)
+	}
+	for _, report := range snapshots {
+		status := "ok"
+		if report.Problem != "" {
+			ok = false
+			status = report.Problem
+		}
+		fmt.Printf("%s: sequence %d, %d keys: %s\n", report.Path, report.Sequence, report.Keys, status)
+	}
+	return ok, nil
+}
+
+func walStats(dir string, top int) error {
+	reports, err := wal.InspectSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	var entries, bytes int64
+	operations := make(map[wal.Operation]int)
+	keys := make(map[string]int)
+	var first, last wal.LogEntry
+	for _, report := range reports {
+		bytes += report.Size
+		for _, entry := range report.Entries {
+			if entries == 0 {
+				first = entry
+			}
+			last = entry
+			entries++
+			operations[entry.Operation]++
+			if entry.Operation != wal.BATCH {
+				keys[entry.Key]++
+			}
+			for _, write := range entry.Entries {
+				operations[write.Operation]++
+				keys[write.Key]++
+			}
+		}
+	}
+
+	fmt.Printf("segments: %d\nentries: %d\nbytes: %d\nkeys: %d\n", len(reports), entries, bytes, len(keys))
+	if entries > 0 {
+		fmt.Printf("sequences: %d - %d\n", first.Sequence, last.Sequence)
+		fmt.Printf("average entry size: %d bytes\n", bytes/entries)
+	}
+
+	fmt.Println("operations:")
+	for operation, count := range operations {
+		fmt.Printf("  %s: %d\n", operation, count)
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if keys[sorted[i]] != keys[sorted[j]] {
+			return keys[sorted[i]] > keys[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	fmt.Println("most written keys:")
+	for _, key := range sorted {
+		fmt.Printf("  %s: %d\n", key, keys[key])
+	}
+	return nil
+}
+
+func repairWAL(dir string) error {
+	repaired, err := wal.RepairSegments(dir)
+	if err != nil {
+		return err
+	}
+	if len(repaired) == 0 {
+		fmt.Println("nothing to repair")
+		return nil
+	}
+	for _, report := range repaired {
+		fmt.Printf("%s: truncated %d bytes after %s\n", report.Path, report.Size-report.ValidSize, report.Problem)
+	}
+	return nil
+}